@@ -1,5 +1,12 @@
 package cache
 
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+)
+
 //
 // 定义Cache的接口
 //
@@ -10,6 +17,87 @@ type Cache interface {
 	Exists(key string) bool
 }
 
+//
+// 支持流式读写的Cache, 避免将整个文件读入内存
+//
+type StreamCache interface {
+	Cache
+
+	// GetReader returns a reader of the data of key and its size.
+	// The reader must be closed.
+	GetReader(key string) (rc io.ReadCloser, size int64, ok bool)
+
+	// SetWriter returns a writer storing size bytes as key. The data is
+	// committed by Close only if exactly size bytes were written.
+	SetWriter(key string, size int64) (io.WriteCloser, error)
+}
+
+//
+// 支持过期时间的Cache, 过期的数据在Get时不再返回
+//
+type TTLCache interface {
+	Cache
+
+	// SetTTL saves data as key, expiring after ttl; ttl <= 0 means never.
+	SetTTL(key string, data []byte, ttl time.Duration)
+
+	// GetWithExpiry is like Get, but also returns when key expires;
+	// the zero time means never.
+	GetWithExpiry(key string) (data []byte, expires time.Time, ok bool)
+}
+
+//
+// 支持集合操作的存储, 用于VariantIndex
+// SAdd是原子的, 多个improxy实例共享同一个存储(例如: redis)时不会互相覆盖
+//
+type SetStore interface {
+	// SAdd adds member to the set key; adding an existing member does nothing.
+	SAdd(key string, member string)
+
+	// SMembers returns the members of the set key.
+	SMembers(key string) []string
+
+	// Delete removes the set key.
+	Delete(key string)
+}
+
+//
+// 保存数据, ttl > 0时设置过期时间; 不支持过期时间的Cache直接保存
+//
+func SetWithTTL(c Cache, key string, data []byte, ttl time.Duration) {
+	if tc, ok := c.(TTLCache); ok && ttl > 0 {
+		tc.SetTTL(key, data, ttl)
+		return
+	}
+	c.Set(key, data)
+}
+
+func getWithExpiry(c Cache, key string) ([]byte, time.Time, bool) {
+	if tc, ok := c.(TTLCache); ok {
+		return tc.GetWithExpiry(key)
+	}
+	data, ok := c.Get(key)
+	return data, time.Time{}, ok
+}
+
+//
+// 缓冲之后通过Set写入, 用于不支持流式写入的Cache
+//
+type bufferedWriter struct {
+	bytes.Buffer
+	c    Cache
+	key  string
+	size int64
+}
+
+func (w *bufferedWriter) Close() error {
+	if int64(w.Len()) != w.size {
+		return fmt.Errorf("incomplete write: %d of %d bytes", w.Len(), w.size)
+	}
+	w.c.Set(w.key, w.Bytes())
+	return nil
+}
+
 //
 // NopCache的实现，Operation
 //
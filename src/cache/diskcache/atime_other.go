@@ -0,0 +1,13 @@
+// +build !linux,!darwin
+
+package diskcache
+
+import (
+	"os"
+	"time"
+)
+
+// 不支持atime的平台使用mtime
+func accessTime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"io"
+	"time"
 )
 
 //
@@ -17,19 +18,65 @@ type Cache struct {
 
 // Get returns the response corresponding to key if present
 func (c *Cache) Get(key string) (resp []byte, ok bool) {
+	resp, _, ok = c.GetWithExpiry(key)
+	return resp, ok
+}
 
+//
+// 过期的文件当做不存在, 并且直接删除
+//
+func (c *Cache) GetWithExpiry(key string) ([]byte, time.Time, bool) {
 	key = keyToFilename(key)
-	resp, err := c.d.Read(key)
+	data, err := c.d.Read(key)
 	if err != nil {
-		return []byte{}, false
+		return []byte{}, time.Time{}, false
 	}
-	return resp, true
+	data, expires := unwrapTTL(data)
+	if expired(expires, time.Now()) {
+		c.d.Erase(key)
+		return []byte{}, time.Time{}, false
+	}
+	return data, expires, true
 }
 
 // Set saves a response to the cache as key
 func (c *Cache) Set(key string, resp []byte) {
+	c.SetTTL(key, resp, 0)
+}
+
+// SetTTL saves a response to the cache as key, expiring after ttl
+func (c *Cache) SetTTL(key string, resp []byte, ttl time.Duration) {
+	key = keyToFilename(key)
+	var r io.Reader = bytes.NewReader(resp)
+	if ttl > 0 {
+		r = io.MultiReader(bytes.NewReader(ttlHeader(time.Now().Add(ttl))), r)
+	}
+	c.d.WriteStream(key, r, true)
+}
+
+// GetReader streams the response corresponding to key from disk
+func (c *Cache) GetReader(key string) (io.ReadCloser, int64, bool) {
 	key = keyToFilename(key)
-	c.d.WriteStream(key, bytes.NewReader(resp), true)
+	rc, size, err := c.d.ReadStreamSize(key)
+	if err != nil {
+		return nil, 0, false
+	}
+	rc, size, expires, err := unwrapTTLReader(rc, size)
+	if err != nil {
+		return nil, 0, false
+	}
+	if expired(expires, time.Now()) {
+		rc.Close()
+		c.d.Erase(key)
+		return nil, 0, false
+	}
+	return rc, size, true
+}
+
+// SetWriter returns a writer saving size bytes to the cache as key
+func (c *Cache) SetWriter(key string, size int64) (io.WriteCloser, error) {
+	key = keyToFilename(key)
+	return c.d.NewWriter(key, size)
 }
 
 //
@@ -41,12 +88,19 @@ func (c *Cache) Delete(key string) {
 	c.d.Erase(key)
 }
 
+// Exists只检查文件是否存在, 不检查是否过期
 func (c *Cache) Exists(key string) bool {
 	key = keyToFilename(key)
 	hasKey := c.d.Has(key)
 	return hasKey
 }
 
+// Size returns the total bytes and the number of files of the disk cache.
+// It is only tracked when diskv.Options.DiskSizeMax is set.
+func (c *Cache) Size() (uint64, int) {
+	return c.d.DiskSize(), c.d.DiskCount()
+}
+
 //
 // 将 key 通过md5 转换成为 hex string
 //
@@ -2,9 +2,13 @@ package diskcache
 
 import (
 	"bytes"
+	"cache/diskv"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestDiskCache(t *testing.T) {
@@ -40,3 +44,235 @@ func TestDiskCache(t *testing.T) {
 		t.Fatal("deleted key still present")
 	}
 }
+
+func TestDiskCacheEviction(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	options := diskv.Options{
+		BasePath:     tempDir,
+		CacheSizeMax: 1024,
+		DiskSizeMax:  25,
+		Transform: func(s string) []string {
+			return []string{s[0:2], s[2:4]}
+		},
+	}
+	cache := NewWithDiskv(diskv.New(options))
+
+	val := bytes.Repeat([]byte("x"), 10)
+	cache.Set("a", val)
+	cache.Set("b", val)
+	cache.Set("c", val)
+
+	// a最久没有访问, 被删除
+	if cache.Exists("a") || !cache.Exists("b") || !cache.Exists("c") {
+		t.Fatal("least recently used key a was not evicted")
+	}
+
+	// 访问b之后, c成为最久没有访问的key
+	cache.Get("b")
+	cache.Set("d", val)
+	if cache.Exists("c") || !cache.Exists("b") || !cache.Exists("d") {
+		t.Fatal("least recently used key c was not evicted")
+	}
+	if size, count := cache.Size(); size != 20 || count != 2 {
+		t.Fatalf("Size() returned %d, %d, want 20, 2", size, count)
+	}
+
+	// 删除之后更新统计信息
+	cache.Delete("d")
+	if size, count := cache.Size(); size != 10 || count != 1 {
+		t.Fatalf("Size() after delete returned %d, %d, want 10, 1", size, count)
+	}
+
+	// 重启之后通过扫描目录重建统计信息, 并且删除遗留的临时文件
+	cache.Set("e", val)
+	tmp := filepath.Join(tempDir, diskv.TempPrefix+"crashed")
+	ioutil.WriteFile(tmp, val, 0666)
+	restarted := NewWithDiskv(diskv.New(options))
+	if size, count := restarted.Size(); size != 20 || count != 2 {
+		t.Fatalf("Size() after restart returned %d, %d, want 20, 2", size, count)
+	}
+	if _, err := os.Stat(tmp); err == nil {
+		t.Errorf("restart did not remove the temp file %s", tmp)
+	}
+
+	// 重启时超过限制的文件会被删除
+	options.DiskSizeMax = 10
+	restarted = NewWithDiskv(diskv.New(options))
+	if size, count := restarted.Size(); size != 10 || count != 1 {
+		t.Fatalf("Size() after shrinking returned %d, %d, want 10, 1", size, count)
+	}
+}
+
+func TestDiskCacheHotLayer(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	d := diskv.New(diskv.Options{
+		BasePath:     tempDir,
+		CacheSizeMax: 25,
+	})
+	cache := NewWithDiskv(d)
+
+	small := []byte("0123456789")
+	large := bytes.Repeat([]byte("x"), 30)
+	cache.Set("small", small)
+	cache.Set("small2", small)
+	cache.Set("large", large)
+
+	// 超过内存限制的数据只从磁盘读取
+	for i := 0; i < 2; i++ {
+		for key, val := range map[string][]byte{"small": small, "small2": small, "large": large} {
+			if got, ok := cache.Get(key); !ok || !bytes.Equal(got, val) {
+				t.Fatalf("Get(%s) returned %q, %v", key, got, ok)
+			}
+		}
+	}
+
+	stats := d.CacheStats()
+	if stats.Size > 25 || stats.Items != 2 || stats.Hits == 0 {
+		t.Errorf("CacheStats() returned %+v", stats)
+	}
+}
+
+func TestDiskCacheStream(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache := New(tempDir)
+	val := bytes.Repeat([]byte("x"), 100)
+
+	// 没有写入完整的数据时不保存
+	w, err := cache.SetWriter("key", int64(len(val)))
+	if err != nil {
+		t.Fatalf("SetWriter: %v", err)
+	}
+	w.Write(val[:50])
+	if err := w.Close(); err == nil || cache.Exists("key") {
+		t.Fatal("incomplete write was committed")
+	}
+
+	w, _ = cache.SetWriter("key", int64(len(val)))
+	w.Write(val[:50])
+	w.Write(val[50:])
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	rc, size, ok := cache.GetReader("key")
+	if !ok || size != int64(len(val)) {
+		t.Fatalf("GetReader returned size %d, %v", size, ok)
+	}
+	data, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(data, val) {
+		t.Fatal("retrieved a different value than what we put in")
+	}
+
+	// 临时文件都已经被删除
+	files, _ := filepath.Glob(filepath.Join(tempDir, ".tmp-*"))
+	if len(files) != 0 {
+		t.Errorf("temporary files left: %v", files)
+	}
+
+	if _, _, ok := cache.GetReader("missing"); ok {
+		t.Fatal("GetReader returned missing key")
+	}
+}
+
+func TestDiskCacheTTL(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	cache := New(tempDir)
+	val := []byte("some bytes")
+
+	cache.SetTTL("fresh", val, time.Hour)
+	cache.SetTTL("stale", val, time.Nanosecond)
+	cache.Set("forever", val)
+	time.Sleep(time.Millisecond)
+
+	data, expires, ok := cache.GetWithExpiry("fresh")
+	if !ok || !bytes.Equal(data, val) || time.Until(expires) <= 0 {
+		t.Fatalf("GetWithExpiry(fresh) returned %q, %v, %v", data, expires, ok)
+	}
+	if data, expires, ok := cache.GetWithExpiry("forever"); !ok || !bytes.Equal(data, val) || !expires.IsZero() {
+		t.Fatalf("GetWithExpiry(forever) returned %q, %v, %v", data, expires, ok)
+	}
+
+	// 流式读取时去掉header
+	rc, size, ok := cache.GetReader("fresh")
+	if !ok || size != int64(len(val)) {
+		t.Fatalf("GetReader(fresh) returned size %d, %v", size, ok)
+	}
+	data, _ = ioutil.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(data, val) {
+		t.Fatalf("GetReader(fresh) read %q", data)
+	}
+
+	// 过期的文件当做没有命中, 并且被删除
+	if _, _, ok := cache.GetReader("stale"); ok {
+		t.Fatal("GetReader returned expired key")
+	}
+	if _, ok := cache.Get("stale"); ok || cache.Exists("stale") {
+		t.Fatal("expired key still present")
+	}
+}
+
+func TestIndexStore(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	indexDir := filepath.Join(tempDir, ".index")
+	s := NewIndexStore(indexDir)
+	for _, m := range []string{"k1", "k2", "k1"} {
+		s.SAdd("idx2:a", m)
+	}
+	s.SAdd("idx2:b", "k3")
+
+	// 重启之后索引仍然有效
+	s = NewIndexStore(indexDir)
+	if got, want := s.SMembers("idx2:a"), []string{"k1", "k2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SMembers returned %v, want %v", got, want)
+	}
+	s.Delete("idx2:a")
+	if got := s.SMembers("idx2:a"); len(got) != 0 {
+		t.Errorf("SMembers after Delete returned %v, want empty", got)
+	}
+
+	// 缓存目录下的索引不属于磁盘缓存
+	d := diskv.New(diskv.Options{
+		BasePath:    tempDir,
+		DiskSizeMax: 1024 * 1024,
+		Transform: func(s string) []string {
+			return []string{s[0:2], s[2:4]}
+		},
+	})
+	if got := d.DiskCount(); got != 0 {
+		t.Errorf("disk cache counted %d index files, want 0", got)
+	}
+	report, err := Prune(tempDir, PrunePolicy{MaxAge: time.Nanosecond}, time.Now().Add(time.Hour), nil)
+	if err != nil {
+		t.Fatalf("Prune() returned error: %v", err)
+	}
+	if report.Files != 0 || len(s.SMembers("idx2:b")) != 1 {
+		t.Errorf("Prune() touched the index: %+v", report)
+	}
+}
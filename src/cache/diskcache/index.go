@@ -0,0 +1,89 @@
+package diskcache
+
+import (
+	"bytes"
+	"cache"
+	"cache/diskv"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"strings"
+	"sync"
+)
+
+// 磁盘索引最多占用的空间, 超过之后按照LRU删除最久没有更新的索引
+const indexSizeMax = 64 * 1024 * 1024
+
+//
+// 磁盘上的SetStore, 用于VariantIndex: 每个集合一个文件, 成员按行保存
+// 和磁盘缓存一样在重启之后仍然有效(启动时扫描目录), 因此之前缓存的文件也能被purge
+// 索引只属于当前实例, 多个实例共享时应该使用redis
+//
+type IndexStore struct {
+	mu sync.Mutex
+	d  *diskv.Diskv
+}
+
+// NewIndexStore returns a SetStore saving the sets under dir, e.g. <cache dir>/.index
+// 目录不符合磁盘缓存的文件布局(ab/cd/md5), 放在缓存目录下也不会被扫描或者prune
+func NewIndexStore(dir string) *IndexStore {
+	return &IndexStore{
+		d: diskv.New(diskv.Options{
+			BasePath:     dir,
+			CacheSizeMax: 8 * 1024 * 1024,
+			DiskSizeMax:  indexSizeMax,
+			Transform: func(s string) []string {
+				return []string{s[0:2], s[2:4]}
+			},
+		}),
+	}
+}
+
+func (s *IndexStore) SAdd(key string, member string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key = keyToFilename(key)
+	data, _ := s.d.Read(key)
+	members := splitMembers(data)
+	for _, m := range members {
+		if m == member {
+			return
+		}
+	}
+	if len(members) >= cache.MaxIndexKeys {
+		log.Printf("Variant index full, skip: %s, key: %s", key, member)
+		return
+	}
+
+	buf := bytes.NewBuffer(data)
+	buf.WriteString(member)
+	buf.WriteByte('\n')
+	if err := s.d.Write(key, buf.Bytes()); err != nil {
+		log.ErrorErrorf(err, "Write variant index failed: %s", key)
+	}
+}
+
+func (s *IndexStore) SMembers(key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := s.d.Read(keyToFilename(key))
+	if err != nil {
+		return nil
+	}
+	return splitMembers(data)
+}
+
+func (s *IndexStore) Delete(key string) {
+	s.mu.Lock()
+	s.d.Erase(keyToFilename(key))
+	s.mu.Unlock()
+}
+
+func splitMembers(data []byte) []string {
+	var members []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if len(line) > 0 {
+			members = append(members, line)
+		}
+	}
+	return members
+}
@@ -0,0 +1,269 @@
+package diskcache
+
+import (
+	"cache/diskv"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errCanceled = errors.New("canceled")
+
+//
+// 磁盘缓存的维护: 统计, 清理, 校验
+// 只处理符合diskcache布局的文件(basePath/ab/cd/abcd...32位md5), 避免误删其他目录的文件
+//
+type Entry struct {
+	Path       string
+	Size       int64
+	ModTime    time.Time
+	AccessTime time.Time
+}
+
+//
+// 遍历dir下所有的缓存文件; cancel被关闭之后停止遍历
+//
+func Walk(dir string, cancel <-chan struct{}, fn func(e *Entry) error) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		select {
+		case <-cancel:
+			return errCanceled
+		default:
+		}
+
+		if info.IsDir() || !isCacheFile(dir, path, info.Name()) {
+			return nil
+		}
+		return fn(&Entry{
+			Path:       path,
+			Size:       info.Size(),
+			ModTime:    info.ModTime(),
+			AccessTime: accessTime(info),
+		})
+	})
+}
+
+// 文件名为32位的md5, 并且位于 name[0:2]/name[2:4] 目录下
+func isCacheFile(dir, path, name string) bool {
+	if len(name) != 32 {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return filepath.Join(dir, name[0:2], name[2:4], name) == filepath.Clean(path)
+}
+
+type AgeBucket struct {
+	Age   string `json:"age"`
+	Files int64  `json:"files"`
+	Bytes int64  `json:"bytes"`
+}
+
+type Stats struct {
+	Files int64        `json:"files"`
+	Bytes int64        `json:"bytes"`
+	Ages  []*AgeBucket `json:"ages"` // 按照mtime统计的文件分布
+}
+
+var ageBuckets = []struct {
+	label string
+	age   time.Duration
+}{
+	{"<1h", time.Hour},
+	{"<1d", 24 * time.Hour},
+	{"<7d", 7 * 24 * time.Hour},
+	{"<30d", 30 * 24 * time.Hour},
+	{">=30d", 1<<63 - 1},
+}
+
+// DirStats returns the file count, total bytes and age histogram of the cache in dir.
+func DirStats(dir string, now time.Time, cancel <-chan struct{}) (*Stats, error) {
+	stats := &Stats{}
+	for _, b := range ageBuckets {
+		stats.Ages = append(stats.Ages, &AgeBucket{Age: b.label})
+	}
+
+	err := Walk(dir, cancel, func(e *Entry) error {
+		stats.Files++
+		stats.Bytes += e.Size
+		age := now.Sub(e.ModTime)
+		for i, b := range ageBuckets {
+			if age < b.age {
+				stats.Ages[i].Files++
+				stats.Ages[i].Bytes += e.Size
+				break
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+//
+// 清理策略, 各个条件之间是"或"的关系; 为0表示不启用
+//
+type PrunePolicy struct {
+	MaxAge     time.Duration // 按照mtime删除过期的文件
+	MaxIdle    time.Duration // 按照atime删除长时间没有访问的文件
+	TargetSize int64         // 按照atime(LRU)删除文件, 直到总大小不超过TargetSize
+	DryRun     bool          // 只输出报告, 不删除文件
+}
+
+// 超过这个时间的临时文件(diskv.TempPrefix)一定不再写入, 例如: 进程崩溃时遗留的
+const staleTempAge = time.Hour
+
+type PruneReport struct {
+	DryRun       bool     `json:"dry_run"`
+	Files        int64    `json:"files"`
+	Bytes        int64    `json:"bytes"`
+	Deleted      int64    `json:"deleted"`
+	DeletedBytes int64    `json:"deleted_bytes"`
+	TempFiles    int64    `json:"temp_files"` // 遗留的临时文件, 和policy无关, 都会被删除
+	TempBytes    int64    `json:"temp_bytes"`
+	Paths        []string `json:"paths,omitempty"` // dry run时将被删除的文件
+}
+
+// Prune deletes the cache files in dir selected by policy.
+func Prune(dir string, policy PrunePolicy, now time.Time, cancel <-chan struct{}) (*PruneReport, error) {
+	report := &PruneReport{DryRun: policy.DryRun}
+
+	var entries []*Entry
+	err := Walk(dir, cancel, func(e *Entry) error {
+		report.Files++
+		report.Bytes += e.Size
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	if err := pruneTempFiles(dir, policy.DryRun, now, report); err != nil {
+		return report, err
+	}
+
+	// 最久没有访问的文件在前面
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].AccessTime.Before(entries[j].AccessTime)
+	})
+
+	remaining := report.Bytes
+	for _, e := range entries {
+		expired := policy.MaxAge > 0 && now.Sub(e.ModTime) > policy.MaxAge
+		idle := policy.MaxIdle > 0 && now.Sub(e.AccessTime) > policy.MaxIdle
+		oversize := policy.TargetSize > 0 && remaining > policy.TargetSize
+		if !expired && !idle && !oversize {
+			continue
+		}
+
+		select {
+		case <-cancel:
+			return report, errCanceled
+		default:
+		}
+
+		if !policy.DryRun {
+			if err := os.Remove(e.Path); err != nil && !os.IsNotExist(err) {
+				return report, err
+			}
+			removeEmptyDirs(dir, filepath.Dir(e.Path))
+
+			// 降低对磁盘IO的影响
+			if (report.Deleted+1)%1000 == 0 {
+				time.Sleep(200 * time.Millisecond)
+			}
+		}
+		remaining -= e.Size
+		report.Deleted++
+		report.DeletedBytes += e.Size
+		if policy.DryRun {
+			report.Paths = append(report.Paths, e.Path)
+		}
+	}
+	return report, nil
+}
+
+//
+// 删除dir下遗留的临时文件; 正在写入的临时文件(修改时间在staleTempAge之内)保留
+//
+func pruneTempFiles(dir string, dryRun bool, now time.Time, report *PruneReport) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasPrefix(info.Name(), diskv.TempPrefix) ||
+			now.Sub(info.ModTime()) <= staleTempAge {
+			continue
+		}
+		path := filepath.Join(dir, info.Name())
+		if dryRun {
+			report.Paths = append(report.Paths, path)
+		} else if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		report.TempFiles++
+		report.TempBytes += info.Size()
+	}
+	return nil
+}
+
+type VerifyReport struct {
+	Files   int64    `json:"files"`
+	Corrupt int64    `json:"corrupt"`
+	Expired int64    `json:"expired"` // 已经过期的文件, 和损坏的文件一起删除
+	Deleted bool     `json:"deleted"`
+	Paths   []string `json:"paths,omitempty"` // 损坏的文件
+}
+
+// Verify runs check on every cache file in dir and optionally deletes the corrupt
+// and expired ones.
+func Verify(dir string, check func(data []byte) error, remove bool, cancel <-chan struct{}) (*VerifyReport, error) {
+	report := &VerifyReport{Deleted: remove}
+	now := time.Now()
+	err := Walk(dir, cancel, func(e *Entry) error {
+		report.Files++
+		data, err := ioutil.ReadFile(e.Path)
+		var expires time.Time
+		if err == nil {
+			data, expires = unwrapTTL(data)
+			err = check(data)
+		}
+		if err == nil && !expired(expires, now) {
+			return nil
+		}
+
+		if err != nil {
+			report.Corrupt++
+			report.Paths = append(report.Paths, e.Path)
+		} else {
+			report.Expired++
+		}
+		if remove {
+			os.Remove(e.Path)
+			removeEmptyDirs(dir, filepath.Dir(e.Path))
+		}
+		return nil
+	})
+	return report, err
+}
+
+// 删除dir下的空目录(不包含dir本身)
+func removeEmptyDirs(dir, path string) {
+	dir = filepath.Clean(dir)
+	for path = filepath.Clean(path); len(path) > len(dir); path = filepath.Dir(path) {
+		if os.Remove(path) != nil {
+			return
+		}
+	}
+}
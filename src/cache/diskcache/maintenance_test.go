@@ -0,0 +1,158 @@
+package diskcache
+
+import (
+	"bytes"
+	"cache/diskv"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 在dir下创建缓存文件, mtime/atime为now-age
+func writeCacheFile(t *testing.T, dir, key string, size int, age time.Duration) string {
+	name := keyToFilename(key)
+	path := filepath.Join(dir, name[0:2], name[2:4], name)
+	os.MkdirAll(filepath.Dir(path), 0777)
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte("x"), size), 0666); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	tm := time.Now().Add(-age)
+	os.Chtimes(path, tm, tm)
+	return path
+}
+
+func TestMaintenance(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	day := 24 * time.Hour
+	old := writeCacheFile(t, tempDir, "old", 10, 20*day)
+	idle := writeCacheFile(t, tempDir, "idle", 20, 5*day)
+	recent := writeCacheFile(t, tempDir, "recent", 30, time.Minute)
+	// 不符合缓存布局的文件不会被处理
+	other := filepath.Join(tempDir, "other.txt")
+	ioutil.WriteFile(other, []byte("other"), 0666)
+
+	now := time.Now()
+	stats, err := DirStats(tempDir, now, nil)
+	if err != nil {
+		t.Fatalf("DirStats: %v", err)
+	}
+	if stats.Files != 3 || stats.Bytes != 60 {
+		t.Errorf("DirStats returned %d files, %d bytes, want 3, 60", stats.Files, stats.Bytes)
+	}
+	if stats.Ages[0].Files != 1 || stats.Ages[2].Files != 1 || stats.Ages[3].Files != 1 {
+		t.Errorf("DirStats returned unexpected age histogram %+v %+v %+v", stats.Ages[0], stats.Ages[2], stats.Ages[3])
+	}
+
+	tests := []struct {
+		policy PrunePolicy
+		paths  []string
+	}{
+		{PrunePolicy{MaxAge: 10 * day, DryRun: true}, []string{old}},
+		{PrunePolicy{MaxIdle: day, DryRun: true}, []string{old, idle}},
+		{PrunePolicy{TargetSize: 40, DryRun: true}, []string{old, idle}},
+		{PrunePolicy{TargetSize: 50, DryRun: true}, []string{old}},
+		{PrunePolicy{TargetSize: 100, DryRun: true}, nil},
+	}
+	for i, tt := range tests {
+		report, err := Prune(tempDir, tt.policy, now, nil)
+		if err != nil {
+			t.Errorf("%d. Prune returned unexpected error: %v", i, err)
+			continue
+		}
+		if len(report.Paths) != len(tt.paths) {
+			t.Errorf("%d. Prune returned %v, want %v", i, report.Paths, tt.paths)
+			continue
+		}
+		for j := range tt.paths {
+			if report.Paths[j] != tt.paths[j] {
+				t.Errorf("%d. Prune returned %v, want %v", i, report.Paths, tt.paths)
+				break
+			}
+		}
+	}
+
+	// dry run不删除文件
+	for _, path := range []string{old, idle, recent, other} {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("dry run deleted %s", path)
+		}
+	}
+
+	report, err := Prune(tempDir, PrunePolicy{MaxIdle: day}, now, nil)
+	if err != nil || report.Deleted != 2 || report.DeletedBytes != 30 {
+		t.Fatalf("Prune returned %+v, %v", report, err)
+	}
+	for path, exists := range map[string]bool{old: false, idle: false, recent: true, other: true} {
+		if _, err := os.Stat(path); (err == nil) != exists {
+			t.Errorf("after prune %s exists: %v, want %v", path, err == nil, exists)
+		}
+	}
+	// 空的目录被删除
+	if _, err := os.Stat(filepath.Dir(old)); err == nil {
+		t.Errorf("prune did not remove empty dir of %s", old)
+	}
+
+	corrupt := writeCacheFile(t, tempDir, "corrupt", 5, 0)
+	check := func(data []byte) error {
+		if len(data) == 5 {
+			return errors.New("corrupt")
+		}
+		return nil
+	}
+	// 过期的文件去掉header之后检查通过, 但是也被删除
+	expiredPath := writeCacheFile(t, tempDir, "expired", 0, 0)
+	ioutil.WriteFile(expiredPath, append(ttlHeader(now.Add(-time.Hour)), "still valid"...), 0666)
+	verify, err := Verify(tempDir, check, true, nil)
+	if err != nil || verify.Files != 3 || verify.Corrupt != 1 || verify.Expired != 1 || verify.Paths[0] != corrupt {
+		t.Fatalf("Verify returned %+v, %v", verify, err)
+	}
+	for _, path := range []string{corrupt, expiredPath} {
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("Verify did not delete %s", path)
+		}
+	}
+}
+
+func TestPruneTempFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	// 进程崩溃时遗留的临时文件被删除, 正在写入的保留
+	stale := filepath.Join(tempDir, diskv.TempPrefix+"stale")
+	writing := filepath.Join(tempDir, diskv.TempPrefix+"writing")
+	for _, path := range []string{stale, writing} {
+		ioutil.WriteFile(path, []byte("partial"), 0666)
+	}
+	tm := time.Now().Add(-2 * staleTempAge)
+	os.Chtimes(stale, tm, tm)
+
+	now := time.Now()
+	report, err := Prune(tempDir, PrunePolicy{MaxAge: time.Hour, DryRun: true}, now, nil)
+	if err != nil || report.TempFiles != 1 || report.TempBytes != 7 || len(report.Paths) != 1 || report.Paths[0] != stale {
+		t.Fatalf("dry run Prune returned %+v, %v", report, err)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Fatalf("dry run deleted %s", stale)
+	}
+
+	report, err = Prune(tempDir, PrunePolicy{MaxAge: time.Hour}, now, nil)
+	if err != nil || report.TempFiles != 1 || report.Files != 0 {
+		t.Fatalf("Prune returned %+v, %v", report, err)
+	}
+	for path, exists := range map[string]bool{stale: false, writing: true} {
+		if _, err := os.Stat(path); (err == nil) != exists {
+			t.Errorf("after prune %s exists: %v, want %v", path, err == nil, exists)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package diskcache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+//
+// 带过期时间的文件格式: ttlMagic + int64(过期时间的UnixNano, big endian) + data
+// 0xff不会出现在HTTP response, ImageWithMeta或者文本索引的开头, 因此可以和普通的文件区分开
+//
+var ttlMagic = []byte{0xff, 'T', 'T', 'L', 1}
+
+const ttlHeaderSize = 5 + 8
+
+func ttlHeader(expires time.Time) []byte {
+	header := make([]byte, ttlHeaderSize)
+	copy(header, ttlMagic)
+	binary.BigEndian.PutUint64(header[len(ttlMagic):], uint64(expires.UnixNano()))
+	return header
+}
+
+//
+// 去掉ttl header, 返回数据和过期时间; 普通文件的过期时间为0
+//
+func unwrapTTL(data []byte) ([]byte, time.Time) {
+	if len(data) < ttlHeaderSize || !bytes.HasPrefix(data, ttlMagic) {
+		return data, time.Time{}
+	}
+	nanos := int64(binary.BigEndian.Uint64(data[len(ttlMagic):ttlHeaderSize]))
+	return data[ttlHeaderSize:], time.Unix(0, nanos)
+}
+
+func expired(expires, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
+
+//
+// 流式读取时只读取header, 其余的部分直接交给调用者
+//
+type ttlReader struct {
+	io.Reader
+	rc io.Closer
+}
+
+func (r *ttlReader) Close() error {
+	return r.rc.Close()
+}
+
+// 出错时会关闭rc
+func unwrapTTLReader(rc io.ReadCloser, size int64) (io.ReadCloser, int64, time.Time, error) {
+	header := make([]byte, ttlHeaderSize)
+	n, err := io.ReadFull(rc, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		rc.Close()
+		return nil, 0, time.Time{}, err
+	}
+	data, expires := unwrapTTL(header[:n])
+	if expires.IsZero() {
+		return &ttlReader{io.MultiReader(bytes.NewReader(data), rc), rc}, size, expires, nil
+	}
+	return rc, size - ttlHeaderSize, expires, nil
+}
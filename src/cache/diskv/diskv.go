@@ -2,18 +2,24 @@ package diskv
 
 import (
 	"bytes"
+	"cache"
+	"container/list"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
 const (
+	// NewWriter写入时的临时文件的前缀, 位于BasePath下; Close之后rename到最终的位置
+	TempPrefix = ".tmp-"
+
 	defaultBasePath = "diskv"
 	defaultFilePerm os.FileMode = 0666
 	defaultPathPerm os.FileMode = 0777
@@ -40,6 +46,7 @@ type Options struct {
 	BasePath     string
 	Transform    TransformFunction
 	CacheSizeMax uint64 // bytes, 内存中的Cache Size
+	DiskSizeMax  uint64 // bytes, 磁盘上的文件总大小, 超过之后按照LRU删除文件; 0表示不限制
 	PathPerm     os.FileMode
 	FilePerm     os.FileMode
 }
@@ -48,9 +55,20 @@ type Options struct {
 // structures directly; instead, use the New constructor.
 type Diskv struct {
 	Options
-	mu        sync.RWMutex // 读写锁
-	cache     map[string][]byte
-	cacheSize uint64
+	mu    sync.RWMutex       // 读写锁
+	cache *cache.MemoryCache // 内存中的热数据, 最多CacheSizeMax
+
+	// 磁盘文件的LRU, Front为最近访问的文件
+	// 读操作只持有mu的读锁, 因此lru由lruMu单独保护
+	lruMu    sync.Mutex
+	lru      *list.List
+	entries  map[string]*list.Element
+	diskSize uint64
+}
+
+type diskEntry struct {
+	key  string
+	size uint64
 }
 
 // New returns an initialized Diskv structure, ready to use.
@@ -72,14 +90,47 @@ func New(o Options) *Diskv {
 	}
 
 	d := &Diskv{
-		Options:   o,
-		cache:     map[string][]byte{},
-		cacheSize: 0,
+		Options: o,
+		cache:   cache.NewMemoryCacheWithSize(o.CacheSizeMax),
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+
+	// 之前的进程崩溃时遗留的临时文件不会再被rename, 也不会被统计, 直接删除
+	d.removeTempFiles()
+
+	// 重启之后通过扫描目录重建磁盘的统计信息
+	if d.DiskSizeMax > 0 {
+		d.mu.Lock()
+		d.scanWithLock()
+		d.evictWithLock("")
+		d.mu.Unlock()
 	}
 
 	return d
 }
 
+// CacheStats returns the counters of the in-memory hot layer.
+func (d *Diskv) CacheStats() cache.MemoryCacheStats {
+	return d.cache.Stats()
+}
+
+// DiskSize returns the total bytes of the files tracked on disk.
+// It is only maintained when DiskSizeMax is set.
+func (d *Diskv) DiskSize() uint64 {
+	d.lruMu.Lock()
+	defer d.lruMu.Unlock()
+	return d.diskSize
+}
+
+// DiskCount returns the number of files tracked on disk.
+// It is only maintained when DiskSizeMax is set.
+func (d *Diskv) DiskCount() int {
+	d.lruMu.Lock()
+	defer d.lruMu.Unlock()
+	return d.lru.Len()
+}
+
 // Write synchronously writes the key-value pair to disk, making it immediately
 // available for reads. Write relies on the filesystem to perform an eventual
 // sync to physical media. If you need stronger guarantees, see WriteStream.
@@ -143,6 +194,14 @@ func (d *Diskv) writeStreamWithLock(key string, r io.Reader, sync bool) error {
 		return fmt.Errorf("file close: %s", err)
 	}
 
+	// 更新磁盘的统计信息, 必要时删除最久没有访问的文件
+	if d.DiskSizeMax > 0 {
+		if fi, err := os.Stat(d.completeFilename(key)); err == nil {
+			d.touch(key, fi.Size())
+		}
+		d.evictWithLock(key)
+	}
+
 	// 删除对应的key，表示之前的数据无效
 	// 缓存只由Read操作来更新
 	d.bustCacheWithLock(key) // cache only on read
@@ -171,14 +230,23 @@ func (d *Diskv) Read(key string) ([]byte, error) {
 // If compression is enabled, ReadStream taps into the io.Reader stream prior
 // to decompression, and caches the compressed data.
 func (d *Diskv) ReadStream(key string) (io.ReadCloser, error) {
+	rc, _, err := d.ReadStreamSize(key)
+	return rc, err
+}
+
+// ReadStreamSize is like ReadStream, but also returns the size of the value.
+// The returned ReadCloser must be closed to release the file handle.
+func (d *Diskv) ReadStreamSize(key string) (io.ReadCloser, int64, error) {
 	d.mu.RLock()
 	defer d.mu.RUnlock()
 
 	// 判断是否在cache中，不是则直接返回
-	if val, ok := d.cache[key]; ok {
+	if val, ok := d.cache.Get(key); ok {
+		d.touch(key, -1)
+
 		// 将 []byte 转换成为 Buffer
 		buf := bytes.NewBuffer(val)
-		return ioutil.NopCloser(buf), nil
+		return ioutil.NopCloser(buf), int64(len(val)), nil
 	} else {
 		return d.readWithRLock(key)
 	}
@@ -188,34 +256,41 @@ func (d *Diskv) ReadStream(key string) (io.ReadCloser, error) {
 // decompressed data for the given key, streamed from the disk. Clients should
 // acquire a read lock on the Diskv and check the cache themselves before
 // calling read.
-func (d *Diskv) readWithRLock(key string) (io.ReadCloser, error) {
+func (d *Diskv) readWithRLock(key string) (io.ReadCloser, int64, error) {
 	filename := d.completeFilename(key)
 
-	fi, err := os.Stat(filename)
+	f, err := os.Open(filename)
 	if err != nil {
-		return nil, err
-	}
-	if fi.IsDir() {
-		return nil, os.ErrNotExist
+		return nil, 0, err
 	}
 
-	f, err := os.Open(filename)
+	// 使用打开的文件的信息, 避免文件被替换之后大小不一致
+	fi, err := f.Stat()
 	if err != nil {
-		return nil, err
+		f.Close()
+		return nil, 0, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, 0, os.ErrNotExist
 	}
 
-	// 如何处理CacheSize呢?
-	var r io.Reader
-	if d.CacheSizeMax > 0 {
+	// 更新文件的访问时间, 重启之后按照mtime恢复LRU的顺序
+	if d.CacheSizeMax > 0 || d.DiskSizeMax > 0 {
 		now := time.Now()
 		os.Chtimes(filename, now, now)
-		r = newSiphon(f, d, key)
-	} else {
-		r = &closingReader{f}
 	}
+	d.touch(key, fi.Size())
 
-	var rc = io.ReadCloser(ioutil.NopCloser(r))
-	return rc, nil
+	// 如何处理CacheSize呢?
+	// 超过内存缓存大小的文件不会被缓存, 直接读取, 避免在siphon中缓冲整个文件
+	var rc io.ReadCloser
+	if d.CacheSizeMax > 0 && uint64(fi.Size()) <= d.CacheSizeMax {
+		rc = newSiphon(f, d, key)
+	} else {
+		rc = &closingReader{f}
+	}
+	return rc, fi.Size(), nil
 }
 
 // closingReader provides a Reader that automatically closes the
@@ -224,7 +299,11 @@ type closingReader struct {
 	rc io.ReadCloser
 }
 
-func (cr closingReader) Read(p []byte) (int, error) {
+func (cr *closingReader) Close() error {
+	return cr.rc.Close()
+}
+
+func (cr *closingReader) Read(p []byte) (int, error) {
 	n, err := cr.rc.Read(p)
 	if err == io.EOF {
 		if closeErr := cr.rc.Close(); closeErr != nil {
@@ -246,7 +325,7 @@ type siphon struct {
 // newSiphon constructs a siphoning reader that represents the passed file.
 // When a successful series of reads ends in an EOF, the siphon will write
 // the buffered data to Diskv's cache under the given key.
-func newSiphon(f *os.File, d *Diskv, key string) io.Reader {
+func newSiphon(f *os.File, d *Diskv, key string) io.ReadCloser {
 	return &siphon{
 		f:   f,
 		d:   d,
@@ -255,6 +334,11 @@ func newSiphon(f *os.File, d *Diskv, key string) io.Reader {
 	}
 }
 
+// Close closes the file; data not read to EOF is not cached.
+func (s *siphon) Close() error {
+	return s.f.Close()
+}
+
 // Read implements the io.Reader interface for siphon.
 func (s *siphon) Read(p []byte) (int, error) {
 	n, err := s.f.Read(p)
@@ -274,6 +358,82 @@ func (s *siphon) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// NewWriter returns a WriteCloser that stores size bytes under key.
+// The data is written to a temporary file and moved into place by Close only
+// if exactly size bytes were written; otherwise it is discarded.
+func (d *Diskv) NewWriter(key string, size int64) (io.WriteCloser, error) {
+	if len(key) <= 0 {
+		return nil, errEmptyKey
+	}
+	if err := os.MkdirAll(d.BasePath, d.PathPerm); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(d.BasePath, TempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	return &atomicWriter{d: d, f: f, key: key, size: size}, nil
+}
+
+type atomicWriter struct {
+	d    *Diskv
+	f    *os.File
+	key  string
+	size int64
+	n    int64
+	err  error
+}
+
+func (w *atomicWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n, err := w.f.Write(p)
+	w.n += int64(n)
+	w.err = err
+	return n, err
+}
+
+func (w *atomicWriter) Close() error {
+	if w.f == nil {
+		return w.err
+	}
+	tmp := w.f.Name()
+	closeErr := w.f.Close()
+	w.f = nil
+
+	if w.err == nil && closeErr != nil {
+		w.err = closeErr
+	}
+	if w.err == nil && w.n != w.size {
+		w.err = fmt.Errorf("incomplete write: %d of %d bytes", w.n, w.size)
+	}
+	if w.err != nil {
+		os.Remove(tmp)
+		return w.err
+	}
+
+	d := w.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err := d.ensurePathWithLock(w.key); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, d.completeFilename(w.key)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	d.bustCacheWithLock(w.key)
+
+	if d.DiskSizeMax > 0 {
+		d.touch(w.key, w.n)
+		d.evictWithLock(w.key)
+	}
+	return nil
+}
+
 // Erase synchronously erases the given key from the disk and the cache.
 // 同时删除cache和文件
 //
@@ -294,6 +454,7 @@ func (d *Diskv) Erase(key string) error {
 		if err = os.Remove(filename); err != nil {
 			return err
 		}
+		d.untrack(key)
 	} else {
 		// Return err as-is so caller can do os.IsNotExist(err).
 		return err
@@ -316,8 +477,14 @@ func (d *Diskv) EraseAll() error {
 	}
 
 	// 直接清空cache 和删除 根目录
-	d.cache = make(map[string][]byte)
-	d.cacheSize = 0
+	d.cache = cache.NewMemoryCacheWithSize(d.CacheSizeMax)
+
+	d.lruMu.Lock()
+	d.lru.Init()
+	d.entries = make(map[string]*list.Element)
+	d.diskSize = 0
+	d.lruMu.Unlock()
+
 	return os.RemoveAll(d.BasePath)
 }
 
@@ -327,7 +494,7 @@ func (d *Diskv) Has(key string) bool {
 	defer d.mu.Unlock()
 
 	// 首先看内存是否有数据
-	if _, ok := d.cache[key]; ok {
+	if d.cache.Exists(key) {
 		return true
 	}
 
@@ -410,25 +577,11 @@ func (d *Diskv) completeFilename(key string) string {
 }
 
 //
-// 将val保存到key指定的文件下, 但是没有写文件
+// 将val保存到内存中, 但是没有写文件
+// 超过CacheSizeMax的数据不缓存, 其他数据按照LRU淘汰
 //
 func (d *Diskv) cacheWithLock(key string, val []byte) error {
-	valueSize := uint64(len(val))
-
-	// 确保有足够的磁盘空间
-	// 内存只保留cache的索引信息
-	if err := d.ensureCacheSpaceWithLock(valueSize); err != nil {
-		return fmt.Errorf("%s; not caching", err)
-	}
-
-	// 非常严格地控制磁盘空间的大小
-	if (d.cacheSize + valueSize) > d.CacheSizeMax {
-		panic(fmt.Sprintf("failed to make room for value (%d/%d)", valueSize, d.CacheSizeMax))
-	}
-
-	// 添加新的文件
-	d.cache[key] = val
-	d.cacheSize += valueSize
+	d.cache.Set(key, val)
 	return nil
 }
 
@@ -443,19 +596,10 @@ func (d *Diskv) cacheWithoutLock(key string, val []byte) error {
 }
 
 //
-// 从cache中删除指定的key, 已经对应的cache size信息
+// 从cache中删除指定的key
 //
 func (d *Diskv) bustCacheWithLock(key string) {
-
-	if val, ok := d.cache[key]; ok {
-		d.uncacheWithLock(key, uint64(len(val)))
-	}
-}
-
-// 从HashMap中删除key，不删除磁盘上的文案
-func (d *Diskv) uncacheWithLock(key string, sz uint64) {
-	d.cacheSize -= sz
-	delete(d.cache, key)
+	d.cache.Delete(key)
 }
 
 //
@@ -491,34 +635,109 @@ func (d *Diskv) pruneDirsWithLock(key string) error {
 }
 
 //
-// 确保存在足够的内存空间
+// 将key移动到LRU的最前面; size不小于0时更新文件的大小(新的文件会被加入LRU)
 //
-func (d *Diskv) ensureCacheSpaceWithLock(valueSize uint64) error {
+func (d *Diskv) touch(key string, size int64) {
+	if d.DiskSizeMax <= 0 {
+		return
+	}
+
+	d.lruMu.Lock()
+	defer d.lruMu.Unlock()
 
-	// 防止出现过大的文件
-	if valueSize > d.CacheSizeMax {
-		return fmt.Errorf("value size (%d bytes) too large for cache (%d bytes)", valueSize, d.CacheSizeMax)
+	if elem, ok := d.entries[key]; ok {
+		d.lru.MoveToFront(elem)
+		if size >= 0 {
+			e := elem.Value.(*diskEntry)
+			d.diskSize = d.diskSize - e.size + uint64(size)
+			e.size = uint64(size)
+		}
+	} else if size >= 0 {
+		d.entries[key] = d.lru.PushFront(&diskEntry{key: key, size: uint64(size)})
+		d.diskSize += uint64(size)
 	}
+}
 
-	// 确保有足够的空间
-	safe := func() bool {
-		return (d.cacheSize + valueSize) <= d.CacheSizeMax
+// 从LRU中删除key
+func (d *Diskv) untrack(key string) {
+	d.lruMu.Lock()
+	defer d.lruMu.Unlock()
+
+	if elem, ok := d.entries[key]; ok {
+		d.diskSize -= elem.Value.(*diskEntry).size
+		d.lru.Remove(elem)
+		delete(d.entries, key)
 	}
+}
 
-	// 遍历cache, 删除其中的key(如果服务重启?)
-	for key, val := range d.cache {
-		if safe() {
-			break
+//
+// 删除最久没有访问的文件, 直到磁盘的总大小不超过DiskSizeMax; keep(刚写入的文件)不会被删除
+//
+func (d *Diskv) evictWithLock(keep string) {
+	for {
+		d.lruMu.Lock()
+		elem := d.lru.Back()
+		for elem != nil && elem.Value.(*diskEntry).key == keep {
+			elem = elem.Prev()
+		}
+		if d.diskSize <= d.DiskSizeMax || elem == nil {
+			d.lruMu.Unlock()
+			return
+		}
+		e := elem.Value.(*diskEntry)
+		d.diskSize -= e.size
+		d.lru.Remove(elem)
+		delete(d.entries, e.key)
+		d.lruMu.Unlock()
+
+		d.bustCacheWithLock(e.key)
+		if err := os.Remove(d.completeFilename(e.key)); err == nil {
+			d.pruneDirsWithLock(e.key)
 		}
-
-		d.uncacheWithLock(key, uint64(len(val)))
 	}
+}
+
+//
+// 扫描BasePath下的所有文件, 按照mtime(最近访问的时间)重建LRU
+//
+func (d *Diskv) scanWithLock() {
+	var files []os.FileInfo
+	filepath.Walk(d.BasePath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// 目录不存在等错误, 忽略
+			return nil
+		}
+		if !info.IsDir() && d.completeFilename(info.Name()) == path {
+			files = append(files, info)
+		}
+		return nil
+	})
+
+	// 最旧的文件在最后
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
 
-	if !safe() {
-		panic(fmt.Sprintf("%d bytes still won't fit in the cache! (max %d bytes)", valueSize, d.CacheSizeMax))
+	d.lruMu.Lock()
+	defer d.lruMu.Unlock()
+	for _, fi := range files {
+		size := uint64(fi.Size())
+		d.entries[fi.Name()] = d.lru.PushBack(&diskEntry{key: fi.Name(), size: size})
+		d.diskSize += size
 	}
+}
 
-	return nil
+// 删除BasePath下所有的临时文件, 只能在启动时调用(此时没有正在进行的NewWriter)
+func (d *Diskv) removeTempFiles() {
+	infos, err := ioutil.ReadDir(d.BasePath)
+	if err != nil {
+		return
+	}
+	for _, info := range infos {
+		if !info.IsDir() && strings.HasPrefix(info.Name(), TempPrefix) {
+			os.Remove(filepath.Join(d.BasePath, info.Name()))
+		}
+	}
 }
 
 // nopWriteCloser wraps an io.Writer and provides a no-op Close method to
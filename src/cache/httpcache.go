@@ -3,10 +3,12 @@ package cache
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -56,6 +58,21 @@ func DataCacheKeyForURL(req *url.URL) string {
 //
 func CachedResponse(c Cache, req *http.Request) (resp *http.Response, err error) {
 
+	// 支持流式读取时, 直接从磁盘读取body, 不将整个文件读入内存
+	if sc, ok := c.(StreamCache); ok {
+		rc, _, ok := sc.GetReader(CacheKey(req))
+		if !ok {
+			return
+		}
+		resp, err = http.ReadResponse(bufio.NewReader(rc), req)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		resp.Body = &onEOFReader{rc: resp.Body, fn: func() { rc.Close() }}
+		return resp, nil
+	}
+
 	// req, err := NewRequest(r, p.DefaultBaseURL)
 	cachedVal, ok := c.Get(CacheKey(req))
 	if !ok {
@@ -66,46 +83,57 @@ func CachedResponse(c Cache, req *http.Request) (resp *http.Response, err error)
 	return http.ReadResponse(bufio.NewReader(b), req)
 }
 
-// MemoryCache is an implemtation of Cache that stores responses in an in-memory map.
-type MemoryCache struct {
-	mu    sync.RWMutex
-	items map[string][]byte
-}
-
-// Get returns the []byte representation of the response and true if present, false if not
-func (c *MemoryCache) Get(key string) (resp []byte, ok bool) {
-	c.mu.RLock()
-	resp, ok = c.items[key]
-	c.mu.RUnlock()
-	return resp, ok
+//
+// 将resp的headers写入缓存, 然后在读取body时写入body; 只有完整读取body之后才会保存
+//
+func streamToCache(sc StreamCache, key string, resp *http.Response) bool {
+	header, err := httputil.DumpResponse(resp, false)
+	if err != nil {
+		return false
+	}
+	w, err := sc.SetWriter(key, int64(len(header))+resp.ContentLength)
+	if err != nil {
+		log.ErrorErrorf(err, "Cache SetWriter failed: %s", key)
+		return false
+	}
+	if _, err := w.Write(header); err != nil {
+		w.Close()
+		return false
+	}
+	resp.Body = &teeReadCloser{rc: resp.Body, w: w}
+	return true
 }
 
-// Set saves response resp to the cache with key
-func (c *MemoryCache) Exists(key string) bool {
-	c.mu.RLock()
-	_, ok := c.items[key]
-	c.mu.RUnlock()
-	return ok
+// teeReadCloser writes everything read from rc to w, and closes w on EOF or close
+type teeReadCloser struct {
+	rc     io.ReadCloser
+	w      io.WriteCloser
+	closed bool
 }
 
-// Set saves response resp to the cache with key
-func (c *MemoryCache) Set(key string, resp []byte) {
-	c.mu.Lock()
-	c.items[key] = resp
-	c.mu.Unlock()
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.rc.Read(p)
+	if n > 0 && !t.closed {
+		if _, werr := t.w.Write(p[:n]); werr != nil {
+			t.closeWriter()
+		}
+	}
+	if err == io.EOF {
+		t.closeWriter()
+	}
+	return n, err
 }
 
-// Delete removes key from the cache
-func (c *MemoryCache) Delete(key string) {
-	c.mu.Lock()
-	delete(c.items, key)
-	c.mu.Unlock()
+func (t *teeReadCloser) Close() error {
+	t.closeWriter()
+	return t.rc.Close()
 }
 
-// NewMemoryCache returns a new Cache that will store items in an in-memory map
-func NewMemoryCache() *MemoryCache {
-	c := &MemoryCache{items: map[string][]byte{}}
-	return c
+func (t *teeReadCloser) closeWriter() {
+	if !t.closed {
+		t.closed = true
+		t.w.Close()
+	}
 }
 
 // onEOFReader executes a function on reader EOF or close
@@ -147,9 +175,20 @@ type Transport struct {
 	// If true, responses returned from the cache will be given an extra header, X-From-Cache
 	MarkCachedResponses bool
 
+	// 记录每个原始图片对应的缓存key, 可以为nil
+	Index *VariantIndex
+
+	// stale-while-revalidate: 过期时间在这个窗口之内的缓存直接返回, 同时在后台重新验证
+	// response的Cache-Control中的stale-while-revalidate优先; 0表示只使用response中的设置
+	StaleWhileRevalidate time.Duration
+
 	// Mapping of original request => cloned
 	mu     sync.RWMutex
 	modReq map[*http.Request]*http.Request
+
+	// 正在后台重新验证的缓存key
+	revalidating map[string]bool
+	wg           sync.WaitGroup
 }
 
 // NewTransport returns a new Transport with the
@@ -233,6 +272,14 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 				return cachedResp, nil
 			}
 
+			// 在stale-while-revalidate的窗口之内, 直接返回缓存, 在后台重新验证
+			if freshness == stale && req.Method == "GET" &&
+				canStaleWhileRevalidate(cachedResp.Header, req.Header, t.StaleWhileRevalidate) {
+				t.revalidateInBackground(req, cacheKey)
+				cachedResp.Header.Set("Warning", `110 - "Response is Stale"`)
+				return cachedResp, nil
+			}
+
 			// 需要验证
 			if freshness == stale {
 				// 构建一个新的Request(支持etag, last-modified)
@@ -302,6 +349,8 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 
 		} else {
 			log.Printf("Transport Update Cache: %s", cacheKey)
+			// 不再使用的缓存数据
+			cachedResp.Body.Close()
 			if err != nil || resp.StatusCode != http.StatusOK {
 				t.Cache.Delete(cacheKey)
 			}
@@ -341,9 +390,14 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 		}
 
 		// 如何序列化数据？
-		respBytes, err := httputil.DumpResponse(resp, true)
-		if err == nil {
+		if sc, ok := t.Cache.(StreamCache); ok && resp.ContentLength >= 0 && len(resp.TransferEncoding) == 0 {
+			// 在读取body的同时写入缓存
+			if streamToCache(sc, cacheKey, resp) {
+				t.Index.Add(req.URL, cacheKey)
+			}
+		} else if respBytes, err := httputil.DumpResponse(resp, true); err == nil {
 			t.Cache.Set(cacheKey, respBytes)
+			t.Index.Add(req.URL, cacheKey)
 		}
 	} else {
 		t.Cache.Delete(cacheKey)
@@ -351,6 +405,52 @@ func (t *Transport) RoundTrip(req *http.Request) (resp *http.Response, err error
 	return resp, nil
 }
 
+//
+// 在后台重新请求key, 同一个key同时只有一个请求
+// 请求中的Cache-Control: max-age=0保证不会再次走stale-while-revalidate, 而是同步的验证并更新缓存
+//
+func (t *Transport) revalidateInBackground(req *http.Request, key string) {
+	t.mu.Lock()
+	if t.revalidating[key] {
+		t.mu.Unlock()
+		return
+	}
+	if t.revalidating == nil {
+		t.revalidating = make(map[string]bool)
+	}
+	t.revalidating[key] = true
+	t.mu.Unlock()
+
+	// 原始请求结束之后, 后台的请求不能被取消
+	req2 := cloneRequest(req).WithContext(context.Background())
+	req2.Header.Set("Cache-Control", "max-age=0")
+
+	t.wg.Add(1)
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			delete(t.revalidating, key)
+			t.mu.Unlock()
+			t.wg.Done()
+		}()
+
+		resp, err := t.RoundTrip(req2)
+		if err != nil {
+			log.ErrorErrorf(err, "Transport background revalidate failed: %s", key)
+			return
+		}
+		// 读取完整的body之后才会写入缓存
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		log.Printf("Transport background revalidated: %s, status: %d", key, resp.StatusCode)
+	}()
+}
+
+// Wait blocks until all the background revalidations are done.
+func (t *Transport) Wait() {
+	t.wg.Wait()
+}
+
 // CancelRequest calls CancelRequest on the underlaying transport if implemented or
 // throw a warning otherwise.
 func (t *Transport) CancelRequest(req *http.Request) {
@@ -433,27 +533,8 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 	}
 	currentAge := clock.since(date)
 
-	var lifetime time.Duration
 	var zeroDuration time.Duration // 默认长度就为0
-
-	// If a response includes both an Expires header and a max-age directive,
-	// the max-age directive overrides the Expires header, even if the Expires header is more restrictive.
-	if maxAge, ok := respCacheControl["max-age"]; ok {
-		lifetime, err = time.ParseDuration(maxAge + "s")
-		if err != nil {
-			lifetime = zeroDuration
-		}
-	} else {
-		expiresHeader := respHeaders.Get("Expires")
-		if expiresHeader != "" {
-			expires, err := time.Parse(time.RFC1123, expiresHeader)
-			if err != nil {
-				lifetime = zeroDuration
-			} else {
-				lifetime = expires.Sub(date)
-			}
-		}
-	}
+	lifetime := responseLifetime(respHeaders, respCacheControl, date)
 
 	// 这个不用考虑
 	if maxAge, ok := reqCacheControl["max-age"]; ok {
@@ -499,6 +580,60 @@ func getFreshness(respHeaders, reqHeaders http.Header) (freshness int) {
 	return stale
 }
 
+// responseLifetime returns the freshness lifetime given by the response's
+// max-age or Expires.
+func responseLifetime(respHeaders http.Header, respCacheControl cacheControl, date time.Time) (lifetime time.Duration) {
+	// If a response includes both an Expires header and a max-age directive,
+	// the max-age directive overrides the Expires header, even if the Expires header is more restrictive.
+	if maxAge, ok := respCacheControl["max-age"]; ok {
+		lifetime, _ = time.ParseDuration(maxAge + "s")
+	} else if expiresHeader := respHeaders.Get("Expires"); expiresHeader != "" {
+		if expires, err := time.Parse(time.RFC1123, expiresHeader); err == nil {
+			lifetime = expires.Sub(date)
+		}
+	}
+	return lifetime
+}
+
+//
+// stale-while-revalidate(https://tools.ietf.org/html/rfc5861):
+// 过期的时间没有超过窗口时, 可以先返回缓存; response中的设置优先于window
+// 需要验证的response(no-cache, must-revalidate), 以及request中要求验证时不适用
+//
+func canStaleWhileRevalidate(respHeaders, reqHeaders http.Header, window time.Duration) bool {
+	respCacheControl := parseCacheControl(respHeaders)
+	reqCacheControl := parseCacheControl(reqHeaders)
+
+	for _, directive := range []string{"no-cache", "must-revalidate", "proxy-revalidate"} {
+		if _, ok := respCacheControl[directive]; ok {
+			return false
+		}
+	}
+	for _, directive := range []string{"no-cache", "max-age", "min-fresh"} {
+		if _, ok := reqCacheControl[directive]; ok {
+			return false
+		}
+	}
+
+	if value, ok := respCacheControl["stale-while-revalidate"]; ok {
+		seconds, err := time.ParseDuration(value + "s")
+		if err != nil {
+			return false
+		}
+		window = seconds
+	}
+	if window <= 0 {
+		return false
+	}
+
+	date, err := Date(respHeaders)
+	if err != nil {
+		return false
+	}
+	staleness := clock.since(date) - responseLifetime(respHeaders, respCacheControl, date)
+	return staleness < window
+}
+
 // Returns true if either the request or the response includes the stale-if-error
 // cache control extension: https://tools.ietf.org/html/rfc5861
 func canStaleOnError(respHeaders, reqHeaders http.Header) bool {
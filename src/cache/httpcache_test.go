@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -1210,4 +1212,208 @@ func TestStaleIfErrorResponseLifetime(t *testing.T) {
 	if err != tmock.err {
 		t.Fatalf("got err %v, want %v", err, tmock.err)
 	}
-}
\ No newline at end of file
+}
+
+// swrTransport 每次返回新的response, body为请求的次数; gate不为nil时等待gate被关闭
+type swrTransport struct {
+	mu           sync.Mutex
+	count        int
+	cacheControl string
+	gate         chan struct{}
+}
+
+func (t *swrTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.gate != nil {
+		<-t.gate
+	}
+	t.mu.Lock()
+	t.count++
+	body := fmt.Sprintf("v%d", t.count)
+	t.mu.Unlock()
+	return &http.Response{
+		Status:     http.StatusText(http.StatusOK),
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Date":          []string{time.Now().Format(time.RFC1123)},
+			"Cache-Control": []string{t.cacheControl},
+		},
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
+		Request:       req,
+	}, nil
+}
+
+func (t *swrTransport) requests() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.count
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	resetTest()
+	defer resetTest()
+
+	origin := &swrTransport{cacheControl: "max-age=10"}
+	tp := NewMemoryCacheTransport()
+	tp.Transport = origin
+	tp.StaleWhileRevalidate = 100 * time.Second
+
+	get := func() (*http.Response, string) {
+		r, _ := http.NewRequest("GET", "http://somewhere.com/", nil)
+		resp, err := tp.RoundTrip(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(body)
+	}
+
+	get()
+
+	// 在窗口之内: 直接返回过期的缓存, 在后台更新
+	clock = &fakeClock{elapsed: 50 * time.Second}
+	resp, body := get()
+	if body != "v1" || resp.Header.Get(XFromCache) != "1" || len(resp.Header.Get("Warning")) == 0 {
+		t.Fatalf("stale response returned %q, headers %v", body, resp.Header)
+	}
+	tp.Wait()
+	if origin.requests() != 2 {
+		t.Fatalf("origin requested %d times, want 2", origin.requests())
+	}
+	if _, body = get(); body != "v2" {
+		t.Fatalf("revalidated response returned %q, want v2", body)
+	}
+	tp.Wait()
+
+	// 超过窗口: 同步请求
+	clock = &fakeClock{elapsed: 200 * time.Second}
+	resp, body = get()
+	if resp.Header.Get(XFromCache) != "" || body != "v4" {
+		t.Fatalf("response beyond the window returned %q, headers %v", body, resp.Header)
+	}
+
+	// 同一个key只有一个后台请求
+	clock = &fakeClock{elapsed: 50 * time.Second}
+	origin.gate = make(chan struct{})
+	for i := 0; i < 5; i++ {
+		get()
+	}
+	close(origin.gate)
+	tp.Wait()
+	if origin.requests() != 5 {
+		t.Fatalf("origin requested %d times, want 5", origin.requests())
+	}
+}
+
+func TestCanStaleWhileRevalidate(t *testing.T) {
+	resetTest()
+	defer resetTest()
+	clock = &fakeClock{elapsed: 50 * time.Second}
+	date := time.Now().Format(time.RFC1123)
+
+	tests := []struct {
+		resp, req string
+		window    time.Duration
+		want      bool
+	}{
+		{"max-age=10", "", 0, false},
+		{"max-age=10", "", 100 * time.Second, true},
+		{"max-age=10", "", 30 * time.Second, false},
+		{"max-age=10, stale-while-revalidate=100", "", 0, true},
+		{"max-age=10, stale-while-revalidate=30", "", 100 * time.Second, false},
+		{"max-age=10, must-revalidate", "", 100 * time.Second, false},
+		{"no-cache", "", 100 * time.Second, false},
+		{"max-age=10", "max-age=0", 100 * time.Second, false},
+		{"max-age=10", "no-cache", 100 * time.Second, false},
+	}
+	for _, tt := range tests {
+		respHeaders := http.Header{"Date": {date}, "Cache-Control": {tt.resp}}
+		reqHeaders := http.Header{}
+		if len(tt.req) > 0 {
+			reqHeaders.Set("Cache-Control", tt.req)
+		}
+		if got := canStaleWhileRevalidate(respHeaders, reqHeaders, tt.window); got != tt.want {
+			t.Errorf("canStaleWhileRevalidate(%q, %q, %v) returned %v, want %v", tt.resp, tt.req, tt.window, got, tt.want)
+		}
+	}
+}
+
+// streamCache 是StreamCache在内存中的实现, 记录流式读写的次数
+type streamCache struct {
+	*MemoryCache
+	readers int
+	writers int
+}
+
+func (c *streamCache) GetReader(key string) (io.ReadCloser, int64, bool) {
+	data, ok := c.Get(key)
+	if !ok {
+		return nil, 0, false
+	}
+	c.readers++
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), true
+}
+
+func (c *streamCache) SetWriter(key string, size int64) (io.WriteCloser, error) {
+	c.writers++
+	return &bufferedWriter{c: c.MemoryCache, key: key, size: size}, nil
+}
+
+func TestStreamCache(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789"), 1000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=3600")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	c := &streamCache{MemoryCache: NewMemoryCache()}
+	client := http.Client{Transport: NewTransport(c)}
+
+	get := func(n int) *http.Response {
+		resp, err := client.Get(server.URL + "/stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, int64(n)))
+		resp.Body.Close()
+		if !bytes.Equal(data, body[:len(data)]) {
+			t.Fatalf("got unexpected body of %d bytes", len(data))
+		}
+		return resp
+	}
+
+	// 没有读取完整的body时不缓存
+	get(100)
+	if c.writers != 1 || c.Exists(CacheKey(httptest.NewRequest("GET", server.URL+"/stream", nil))) {
+		t.Fatalf("incomplete response was cached, writers: %d", c.writers)
+	}
+
+	if resp := get(len(body)); resp.Header.Get(XFromCache) != "" {
+		t.Fatal("first complete response is from cache")
+	}
+	if resp := get(len(body)); resp.Header.Get(XFromCache) != "1" || c.readers != 1 {
+		t.Fatalf("response was not streamed from cache, readers: %d", c.readers)
+	}
+}
+
+func TestBufferedWriter(t *testing.T) {
+	c := NewMemoryCache()
+
+	w := &bufferedWriter{c: c, key: "a", size: 3}
+	w.Write([]byte("ab"))
+	if err := w.Close(); err == nil || c.Exists("a") {
+		t.Fatal("incomplete write was committed")
+	}
+
+	w = &bufferedWriter{c: c, key: "a", size: 3}
+	w.Write([]byte("abc"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close returned unexpected error: %v", err)
+	}
+	if data, ok := c.Get("a"); !ok || string(data) != "abc" {
+		t.Fatalf("Get(a) returned %q, %v", data, ok)
+	}
+}
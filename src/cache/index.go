@@ -0,0 +1,179 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"net/url"
+	"sync"
+)
+
+// 每个原始图片最多记录的缓存key的数量(进程内的索引), 超过之后的key不再记录
+const MaxIndexKeys = 256
+
+// 进程内的索引最多记录的原始图片的数量, 超过之后按照LRU淘汰
+const MaxIndexSets = 100000
+
+//
+// 记录每个原始图片对应的所有缓存key(原始数据, 各种尺寸/格式/版本的variants), 用于purge
+// 索引保存在SetStore中, key为 IndexCacheKeyForURL(url), 成员为缓存key:
+//   Cache中有可写的redis层时使用redis的集合(SADD), 多个实例共享, 不会互相覆盖
+//   否则使用进程内的集合, 不会被Cache的LRU淘汰; 重启之后为空
+//   (有磁盘缓存时可以通过Proxy.SetIndexStore换成磁盘上的索引, 重启之后仍然有效)
+//
+// 注意: Purge只删除当前实例的Cache(本地的memory, disk以及共享的redis);
+// 其他实例的本地缓存需要分别purge, 例如: tool_image_purge -addr host1:port,host2:port
+// 因此共享的索引(Shared)在Purge时不删除, 否则后面的实例找不到需要删除的key; 由redis的TTL过期
+//
+type VariantIndex struct {
+	Cache  Cache
+	Store  SetStore
+	Shared bool // Store由多个实例共享
+}
+
+func NewVariantIndex(c Cache) *VariantIndex {
+	if store := sharedStore(c); store != nil {
+		return &VariantIndex{Cache: c, Store: store, Shared: true}
+	}
+	return &VariantIndex{Cache: c, Store: newMemorySetStore(MaxIndexSets, MaxIndexKeys)}
+}
+
+func sharedStore(c Cache) SetStore {
+	switch s := c.(type) {
+	case *TieredCache:
+		return s.SetStore()
+	case SetStore:
+		return s
+	}
+	return nil
+}
+
+//
+// 原始图片的索引key: 忽略fragment(options)和query(ts等), 同一个图片的所有版本共享一个索引
+// idx2: 集合格式, 和之前换行分隔的字符串(idx:)区分
+//
+func IndexCacheKeyForURL(u *url.URL) string {
+	origin := *u
+	origin.Fragment = ""
+	origin.RawQuery = ""
+	return fmt.Sprintf("idx2:%s", origin.String())
+}
+
+//
+// 原始图片不存在时的负缓存key: 和索引一样忽略fragment和query, 通过ts判断是否需要重新请求
+//
+func NegativeCacheKeyForURL(u *url.URL) string {
+	origin := *u
+	origin.Fragment = ""
+	origin.RawQuery = ""
+	return fmt.Sprintf("neg:%s", origin.String())
+}
+
+// Add records key as a cache entry derived from the image at u.
+func (x *VariantIndex) Add(u *url.URL, key string) {
+	if x == nil {
+		return
+	}
+	x.Store.SAdd(IndexCacheKeyForURL(u), key)
+}
+
+// Keys returns all cache keys recorded for the image at u.
+func (x *VariantIndex) Keys(u *url.URL) []string {
+	if x == nil {
+		return nil
+	}
+	return x.Store.SMembers(IndexCacheKeyForURL(u))
+}
+
+//
+// 删除图片u对应的所有缓存, 以及本地的索引; 返回被删除的缓存key
+//
+func (x *VariantIndex) Purge(u *url.URL) []string {
+	if x == nil {
+		return nil
+	}
+
+	indexKey := IndexCacheKeyForURL(u)
+	keys := x.Store.SMembers(indexKey)
+	for _, key := range keys {
+		x.Cache.Delete(key)
+	}
+	if !x.Shared {
+		x.Store.Delete(indexKey)
+	}
+	return keys
+}
+
+//
+// 进程内的SetStore: 不会被Cache淘汰, 成员按照添加的顺序返回;
+// 最多maxSets个集合(按照LRU淘汰), 每个集合最多max个成员
+//
+type memorySetStore struct {
+	mu      sync.Mutex
+	maxSets int
+	max     int
+	ll      *list.List // Front为最近添加的集合
+	sets    map[string]*list.Element
+}
+
+type memorySet struct {
+	key     string
+	members []string
+}
+
+func newMemorySetStore(maxSets int, max int) *memorySetStore {
+	return &memorySetStore{
+		maxSets: maxSets,
+		max:     max,
+		ll:      list.New(),
+		sets:    make(map[string]*list.Element),
+	}
+}
+
+func (s *memorySetStore) SAdd(key string, member string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.sets[key]
+	if !ok {
+		e = s.ll.PushFront(&memorySet{key: key})
+		s.sets[key] = e
+		for s.ll.Len() > s.maxSets {
+			oldest := s.ll.Back()
+			s.ll.Remove(oldest)
+			delete(s.sets, oldest.Value.(*memorySet).key)
+		}
+	} else {
+		s.ll.MoveToFront(e)
+	}
+
+	set := e.Value.(*memorySet)
+	for _, m := range set.members {
+		if m == member {
+			return
+		}
+	}
+	if len(set.members) >= s.max {
+		log.Printf("Variant index full, skip: %s, key: %s", key, member)
+		return
+	}
+	set.members = append(set.members, member)
+}
+
+func (s *memorySetStore) SMembers(key string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.sets[key]; ok {
+		return append([]string(nil), e.Value.(*memorySet).members...)
+	}
+	return nil
+}
+
+func (s *memorySetStore) Delete(key string) {
+	s.mu.Lock()
+	if e, ok := s.sets[key]; ok {
+		s.ll.Remove(e)
+		delete(s.sets, key)
+	}
+	s.mu.Unlock()
+}
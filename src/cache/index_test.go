@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestVariantIndex(t *testing.T) {
+	c := NewMemoryCache()
+	x := NewVariantIndex(c)
+
+	u, _ := url.Parse("http://awss3/production/a.jpeg#100x100")
+	v, _ := url.Parse("http://awss3/production/a.jpeg?ts=1#200x200,fwebp")
+	other, _ := url.Parse("http://awss3/production/b.jpeg")
+
+	for _, key := range []string{"k1", "k2", "k1"} {
+		c.Set(key, []byte(key))
+		x.Add(u, key)
+	}
+	c.Set("k3", []byte("k3"))
+	x.Add(v, "k3")
+	c.Set("k4", []byte("k4"))
+	x.Add(other, "k4")
+
+	want := []string{"k1", "k2", "k3"}
+	if got := x.Keys(u); !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys(%v) returned %v, want %v", u, got, want)
+	}
+
+	if got := x.Purge(v); !reflect.DeepEqual(got, want) {
+		t.Errorf("Purge(%v) returned %v, want %v", v, got, want)
+	}
+	for _, key := range append(want, IndexCacheKeyForURL(u)) {
+		if c.Exists(key) {
+			t.Errorf("Purge(%v) did not delete %s", v, key)
+		}
+	}
+	if !c.Exists("k4") {
+		t.Errorf("Purge(%v) deleted unrelated key k4", v)
+	}
+	if got := x.Keys(u); len(got) != 0 {
+		t.Errorf("Keys(%v) after purge returned %v, want empty", u, got)
+	}
+
+	// nil的索引不做任何事情
+	var nilIndex *VariantIndex
+	nilIndex.Add(u, "k1")
+	if got := nilIndex.Purge(u); got != nil {
+		t.Errorf("nil Purge returned %v, want nil", got)
+	}
+}
+
+func TestNegativeCacheKeyForURL(t *testing.T) {
+	u, _ := url.Parse("http://awss3/production/a.jpeg?ts=12#100x100")
+	if got, want := NegativeCacheKeyForURL(u), "neg:http://awss3/production/a.jpeg"; got != want {
+		t.Errorf("NegativeCacheKeyForURL(%v) returned %q, want %q", u, got, want)
+	}
+}
+
+func TestVariantIndex_Store(t *testing.T) {
+	u, _ := url.Parse("http://awss3/production/a.jpeg#100x100")
+
+	// 索引不在Cache中, 不会被LRU淘汰
+	c := NewMemoryCacheWithSize(1)
+	x := NewVariantIndex(c)
+	x.Add(u, "k1")
+	c.Set("large", make([]byte, 1024))
+	if got := x.Keys(u); !reflect.DeepEqual(got, []string{"k1"}) {
+		t.Errorf("Keys(%v) returned %v, want [k1]", u, got)
+	}
+
+	// 每个图片最多记录MaxIndexKeys个key
+	for i := 0; i < MaxIndexKeys+10; i++ {
+		x.Add(u, fmt.Sprintf("k%d", i))
+	}
+	if got := len(x.Keys(u)); got != MaxIndexKeys {
+		t.Errorf("Keys(%v) returned %d keys, want %d", u, got, MaxIndexKeys)
+	}
+
+	// 多层缓存中没有支持集合的层时, 同样使用进程内的索引
+	if x := NewVariantIndex(NewTieredCache(Tier{Cache: c})); x.Shared {
+		t.Errorf("NewVariantIndex used a shared store")
+	} else if _, ok := x.Store.(*memorySetStore); !ok {
+		t.Errorf("NewVariantIndex did not use the memory set store")
+	}
+
+	// 最多记录maxSets个图片, 按照LRU淘汰
+	s := newMemorySetStore(2, MaxIndexKeys)
+	s.SAdd("a", "k1")
+	s.SAdd("b", "k2")
+	s.SAdd("a", "k3")
+	s.SAdd("c", "k4")
+	if got := s.SMembers("b"); len(got) != 0 {
+		t.Errorf("SMembers(b) returned %v, want evicted", got)
+	}
+	if got := s.SMembers("a"); !reflect.DeepEqual(got, []string{"k1", "k3"}) {
+		t.Errorf("SMembers(a) returned %v, want [k1 k3]", got)
+	}
+	if got := len(s.sets); got != 2 {
+		t.Errorf("memory set store has %d sets, want 2", got)
+	}
+}
+
+// 共享的索引在Purge时不删除, 其他实例purge时仍然需要
+func TestVariantIndex_Shared(t *testing.T) {
+	u, _ := url.Parse("http://awss3/production/a.jpeg#100x100")
+	store := newMemorySetStore(MaxIndexSets, MaxIndexKeys)
+
+	var indexes []*VariantIndex
+	for i := 0; i < 2; i++ {
+		c := NewMemoryCache()
+		c.Set("k1", []byte("k1"))
+		indexes = append(indexes, &VariantIndex{Cache: c, Store: store, Shared: true})
+	}
+	indexes[0].Add(u, "k1")
+
+	for i, x := range indexes {
+		if got := x.Purge(u); !reflect.DeepEqual(got, []string{"k1"}) {
+			t.Errorf("%d. Purge(%v) returned %v, want [k1]", i, u, got)
+		}
+		if x.Cache.Exists("k1") {
+			t.Errorf("%d. Purge(%v) did not delete k1", i, u)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+//
+// MemoryCache is an implementation of Cache that stores responses in memory.
+// MaxSize为0时不限制大小; 否则按照LRU淘汰数据, 超过MaxSize的数据直接忽略
+//
+type MemoryCache struct {
+	MaxSize uint64 // bytes
+
+	mu    sync.Mutex
+	ll    *list.List // Front为最近访问的数据
+	items map[string]*list.Element
+	size  uint64
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	skipped   uint64
+	expired   uint64
+}
+
+type memoryEntry struct {
+	key     string
+	value   []byte
+	expires time.Time // 为0表示不过期
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+type MemoryCacheStats struct {
+	Items     int    `json:"items"`
+	Size      uint64 `json:"size"`
+	MaxSize   uint64 `json:"max_size"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Skipped   uint64 `json:"skipped"` // 超过MaxSize而没有缓存的数据
+	Expired   uint64 `json:"expired"`
+}
+
+// Get returns the []byte representation of the response and true if present, false if not
+func (c *MemoryCache) Get(key string) (resp []byte, ok bool) {
+	resp, _, ok = c.GetWithExpiry(key)
+	return resp, ok
+}
+
+// GetWithExpiry is like Get, but also returns when key expires
+func (c *MemoryCache) GetWithExpiry(key string) ([]byte, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		e := elem.Value.(*memoryEntry)
+		if !e.expired(time.Now()) {
+			c.hits++
+			c.ll.MoveToFront(elem)
+			return e.value, e.expires, true
+		}
+		c.removeWithLock(elem)
+		c.expired++
+	}
+	c.misses++
+	return nil, time.Time{}, false
+}
+
+// Exists returns true if key is present, without counting or promoting it
+func (c *MemoryCache) Exists(key string) bool {
+	c.mu.Lock()
+	elem, ok := c.items[key]
+	ok = ok && !elem.Value.(*memoryEntry).expired(time.Now())
+	c.mu.Unlock()
+	return ok
+}
+
+// Set saves response resp to the cache with key
+func (c *MemoryCache) Set(key string, resp []byte) {
+	c.SetTTL(key, resp, 0)
+}
+
+// SetTTL saves response resp to the cache with key, expiring after ttl
+func (c *MemoryCache) SetTTL(key string, resp []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 删除旧的数据
+	if elem, ok := c.items[key]; ok {
+		c.removeWithLock(elem)
+	}
+
+	size := uint64(len(resp))
+	if c.MaxSize > 0 && size > c.MaxSize {
+		c.skipped++
+		return
+	}
+
+	e := &memoryEntry{key: key, value: resp}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	c.items[key] = c.ll.PushFront(e)
+	c.size += size
+
+	for c.MaxSize > 0 && c.size > c.MaxSize {
+		c.removeWithLock(c.ll.Back())
+		c.evictions++
+	}
+}
+
+// Delete removes key from the cache
+func (c *MemoryCache) Delete(key string) {
+	c.mu.Lock()
+	if elem, ok := c.items[key]; ok {
+		c.removeWithLock(elem)
+	}
+	c.mu.Unlock()
+}
+
+// Stats returns the current size and counters of the cache
+func (c *MemoryCache) Stats() MemoryCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return MemoryCacheStats{
+		Items:     c.ll.Len(),
+		Size:      c.size,
+		MaxSize:   c.MaxSize,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Skipped:   c.skipped,
+		Expired:   c.expired,
+	}
+}
+
+func (c *MemoryCache) removeWithLock(elem *list.Element) {
+	e := elem.Value.(*memoryEntry)
+	c.ll.Remove(elem)
+	delete(c.items, e.key)
+	c.size -= uint64(len(e.value))
+}
+
+// NewMemoryCache returns a new Cache that will store items in an unbounded in-memory map
+func NewMemoryCache() *MemoryCache {
+	return NewMemoryCacheWithSize(0)
+}
+
+// NewMemoryCacheWithSize returns a new LRU Cache holding at most maxSize bytes
+func NewMemoryCacheWithSize(maxSize uint64) *MemoryCache {
+	return &MemoryCache{
+		MaxSize: maxSize,
+		ll:      list.New(),
+		items:   map[string]*list.Element{},
+	}
+}
@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMemoryCache(t *testing.T) {
+	c := NewMemoryCacheWithSize(25)
+	val := bytes.Repeat([]byte("x"), 10)
+
+	c.Set("a", val)
+	c.Set("b", val)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("could not retrieve a")
+	}
+
+	// b最久没有访问, 被淘汰
+	c.Set("c", val)
+	if c.Exists("b") || !c.Exists("a") || !c.Exists("c") {
+		t.Fatal("least recently used key b was not evicted")
+	}
+
+	// 超过MaxSize的数据不缓存, 并且删除旧的数据
+	c.Set("a", bytes.Repeat([]byte("x"), 30))
+	if c.Exists("a") {
+		t.Fatal("oversized value was cached")
+	}
+
+	// 覆盖之后更新大小
+	c.Set("c", val[:5])
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("retrieved evicted key b")
+	}
+
+	c.Delete("c")
+	want := MemoryCacheStats{Items: 0, Size: 0, MaxSize: 25, Hits: 1, Misses: 1, Evictions: 1, Skipped: 1}
+	if got := c.Stats(); got != want {
+		t.Errorf("Stats() returned %+v, want %+v", got, want)
+	}
+
+	// 不限制大小
+	c = NewMemoryCache()
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, bytes.Repeat(val, 1000))
+	}
+	if got := c.Stats(); got.Items != 3 || got.Evictions != 0 {
+		t.Errorf("unbounded Stats() returned %+v", got)
+	}
+}
+
+func TestMemoryCacheTTL(t *testing.T) {
+	c := NewMemoryCache()
+	c.SetTTL("a", []byte("a"), time.Hour)
+	c.SetTTL("b", []byte("b"), time.Nanosecond)
+	c.Set("c", []byte("c"))
+	time.Sleep(time.Millisecond)
+
+	if _, expires, ok := c.GetWithExpiry("a"); !ok || time.Until(expires) <= 0 {
+		t.Fatalf("GetWithExpiry(a) returned %v, %v", expires, ok)
+	}
+	if _, expires, ok := c.GetWithExpiry("c"); !ok || !expires.IsZero() {
+		t.Fatalf("GetWithExpiry(c) returned %v, %v", expires, ok)
+	}
+
+	// 过期的数据当做没有命中, 并且被删除
+	if c.Exists("b") {
+		t.Fatal("Exists returned expired key b")
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Fatal("retrieved expired key b")
+	}
+	if got := c.Stats(); got.Items != 2 || got.Expired != 1 || got.Misses != 1 {
+		t.Errorf("Stats() returned %+v", got)
+	}
+}
@@ -0,0 +1,471 @@
+package rediscache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// 基于Redis协议的网络缓存, 多个improxy实例共享; 只实现了cache.Cache, cache.SetStore需要的命令:
+//   GET, SET(PX), PTTL, DEL, EXISTS, SADD, SMEMBERS, PEXPIRE, 以及连接时的AUTH, SELECT
+//
+type Options struct {
+	Addr         string
+	Password     string
+	DB           int
+	Prefix       string        // key的前缀
+	TTL          time.Duration // 0表示不过期
+	MaxValueSize int           // 超过的数据不缓存, 0表示不限制
+	MaxIdle      int           // 连接池中空闲连接的最大数量
+	MaxActive    int           // 同时使用的连接的最大数量, 超过时最多等待Timeout
+	Timeout      time.Duration // 连接, 读写的超时时间
+}
+
+const (
+	defaultPrefix    = "improxy:"
+	defaultMaxIdle   = 16
+	defaultMaxActive = 64
+	defaultTimeout   = time.Second
+
+	// 连接失败之后, 在这段时间内不再连接, 直接当作没有命中; 连续失败时加倍
+	minDialBackoff = time.Second
+	maxDialBackoff = 30 * time.Second
+)
+
+var (
+	errPoolExhausted = errors.New("redis: connection pool exhausted")
+	errUnavailable   = errors.New("redis: unavailable, backing off")
+)
+
+type Cache struct {
+	opts   Options
+	pool   chan *conn
+	active chan struct{} // 正在使用的连接
+	dial   func(network, address string, timeout time.Duration) (net.Conn, error)
+
+	// 连接失败之后的退避: 服务不可用时, 每个请求不需要再等待DialTimeout
+	mu       sync.Mutex
+	failures int
+	retryAt  time.Time
+}
+
+func New(o Options) *Cache {
+	if o.MaxIdle <= 0 {
+		o.MaxIdle = defaultMaxIdle
+	}
+	if o.MaxActive <= 0 {
+		o.MaxActive = defaultMaxActive
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = defaultTimeout
+	}
+	return &Cache{
+		opts:   o,
+		pool:   make(chan *conn, o.MaxIdle),
+		active: make(chan struct{}, o.MaxActive),
+		dial:   net.DialTimeout,
+	}
+}
+
+//
+// redis://[:password@]host:port[/db][?prefix=improxy:&ttl=720h&maxsize=1048576&pool=16&maxactive=64&timeout=1s]
+//
+func ParseURL(rawurl string) (Options, error) {
+	o := Options{Prefix: defaultPrefix}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return o, err
+	}
+	if u.Scheme != "redis" || len(u.Host) == 0 {
+		return o, fmt.Errorf("invalid redis url: %s", rawurl)
+	}
+
+	o.Addr = u.Host
+	if _, _, err := net.SplitHostPort(o.Addr); err != nil {
+		o.Addr = net.JoinHostPort(o.Addr, "6379")
+	}
+	if u.User != nil {
+		o.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); len(db) > 0 {
+		if o.DB, err = strconv.Atoi(db); err != nil {
+			return o, fmt.Errorf("invalid redis db: %s", db)
+		}
+	}
+
+	q := u.Query()
+	if _, ok := q["prefix"]; ok {
+		o.Prefix = q.Get("prefix")
+	}
+	if v := q.Get("ttl"); len(v) > 0 {
+		if o.TTL, err = time.ParseDuration(v); err != nil {
+			return o, err
+		}
+	}
+	if v := q.Get("maxsize"); len(v) > 0 {
+		if o.MaxValueSize, err = strconv.Atoi(v); err != nil {
+			return o, err
+		}
+	}
+	if v := q.Get("pool"); len(v) > 0 {
+		if o.MaxIdle, err = strconv.Atoi(v); err != nil {
+			return o, err
+		}
+	}
+	if v := q.Get("maxactive"); len(v) > 0 {
+		if o.MaxActive, err = strconv.Atoi(v); err != nil {
+			return o, err
+		}
+	}
+	if v := q.Get("timeout"); len(v) > 0 {
+		if o.Timeout, err = time.ParseDuration(v); err != nil {
+			return o, err
+		}
+	}
+	return o, nil
+}
+
+// Get returns the response corresponding to key if present
+func (c *Cache) Get(key string) ([]byte, bool) {
+	reply, err := c.do("GET", c.opts.Prefix+key)
+	if err != nil {
+		c.logError(err, "GET", key)
+		return nil, false
+	}
+	data, ok := reply.([]byte)
+	return data, ok
+}
+
+//
+// 命中之后再通过PTTL读取剩余的过期时间; PTTL失败时当做不过期
+//
+func (c *Cache) GetWithExpiry(key string) ([]byte, time.Time, bool) {
+	data, ok := c.Get(key)
+	if !ok {
+		return nil, time.Time{}, false
+	}
+	reply, err := c.do("PTTL", c.opts.Prefix+key)
+	if err != nil {
+		c.logError(err, "PTTL", key)
+		return data, time.Time{}, true
+	}
+	// -1: 不过期, -2: 在GET之后刚好过期或者被删除
+	ms, _ := reply.(int64)
+	switch {
+	case ms == -2:
+		return nil, time.Time{}, false
+	case ms < 0:
+		return data, time.Time{}, true
+	}
+	return data, time.Now().Add(time.Duration(ms) * time.Millisecond), true
+}
+
+// Set saves a response to the cache as key
+func (c *Cache) Set(key string, data []byte) {
+	c.SetTTL(key, data, 0)
+}
+
+//
+// ttl和Options.TTL都设置时, 使用较小的一个
+//
+func (c *Cache) SetTTL(key string, data []byte, ttl time.Duration) {
+	// 过大的数据不缓存, 同时删除旧的数据
+	if c.opts.MaxValueSize > 0 && len(data) > c.opts.MaxValueSize {
+		c.Delete(key)
+		return
+	}
+
+	if c.opts.TTL > 0 && (ttl <= 0 || c.opts.TTL < ttl) {
+		ttl = c.opts.TTL
+	}
+	var err error
+	if ttl > 0 {
+		// PX至少为1ms
+		ms := int64((ttl + time.Millisecond - 1) / time.Millisecond)
+		_, err = c.do("SET", c.opts.Prefix+key, data, "PX", strconv.FormatInt(ms, 10))
+	} else {
+		_, err = c.do("SET", c.opts.Prefix+key, data)
+	}
+	if err != nil {
+		c.logError(err, "SET", key)
+	}
+}
+
+func (c *Cache) Delete(key string) {
+	if _, err := c.do("DEL", c.opts.Prefix+key); err != nil {
+		c.logError(err, "DEL", key)
+	}
+}
+
+func (c *Cache) Exists(key string) bool {
+	reply, err := c.do("EXISTS", c.opts.Prefix+key)
+	if err != nil {
+		c.logError(err, "EXISTS", key)
+		return false
+	}
+	n, _ := reply.(int64)
+	return n > 0
+}
+
+//
+// 集合和其他的key一样使用Options.TTL, 每次SADD之后重新设置
+//
+func (c *Cache) SAdd(key string, member string) {
+	if _, err := c.do("SADD", c.opts.Prefix+key, member); err != nil {
+		c.logError(err, "SADD", key)
+		return
+	}
+	if c.opts.TTL > 0 {
+		ms := int64((c.opts.TTL + time.Millisecond - 1) / time.Millisecond)
+		if _, err := c.do("PEXPIRE", c.opts.Prefix+key, strconv.FormatInt(ms, 10)); err != nil {
+			c.logError(err, "PEXPIRE", key)
+		}
+	}
+}
+
+func (c *Cache) SMembers(key string) []string {
+	reply, err := c.do("SMEMBERS", c.opts.Prefix+key)
+	if err != nil {
+		c.logError(err, "SMEMBERS", key)
+		return nil
+	}
+	items, _ := reply.([]interface{})
+	var members []string
+	for _, item := range items {
+		if member, ok := item.([]byte); ok {
+			members = append(members, string(member))
+		}
+	}
+	return members
+}
+
+//
+// 执行一个命令; 网络错误时关闭连接, 否则将连接放回连接池
+// 同时使用的连接超过MaxActive时, 最多等待Timeout
+//
+func (c *Cache) do(args ...interface{}) (interface{}, error) {
+	select {
+	case c.active <- struct{}{}:
+	default:
+		timer := time.NewTimer(c.opts.Timeout)
+		select {
+		case c.active <- struct{}{}:
+			timer.Stop()
+		case <-timer.C:
+			return nil, errPoolExhausted
+		}
+	}
+	defer func() { <-c.active }()
+
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := cn.do(c.opts.Timeout, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return reply, err
+}
+
+func (c *Cache) get() (*conn, error) {
+	select {
+	case cn := <-c.pool:
+		return cn, nil
+	default:
+	}
+
+	c.mu.Lock()
+	backingOff := time.Now().Before(c.retryAt)
+	c.mu.Unlock()
+	if backingOff {
+		return nil, errUnavailable
+	}
+
+	cn, err := c.connect()
+	c.dialed(err)
+	return cn, err
+}
+
+func (c *Cache) connect() (*conn, error) {
+	nc, err := c.dial("tcp", c.opts.Addr, c.opts.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+
+	if len(c.opts.Password) > 0 {
+		if _, err := cn.do(c.opts.Timeout, "AUTH", c.opts.Password); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	if c.opts.DB > 0 {
+		if _, err := cn.do(c.opts.Timeout, "SELECT", strconv.Itoa(c.opts.DB)); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+//
+// 记录连接的结果: 失败时在backoff之内不再连接, 连续失败时backoff加倍, 最多maxDialBackoff
+//
+func (c *Cache) dialed(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err == nil {
+		if c.failures > 0 {
+			log.Printf("Redis reconnected: %s", c.opts.Addr)
+		}
+		c.failures, c.retryAt = 0, time.Time{}
+		return
+	}
+
+	backoff := maxDialBackoff
+	if c.failures < 5 {
+		backoff = minDialBackoff << uint(c.failures)
+	}
+	c.failures++
+	c.retryAt = time.Now().Add(backoff)
+	log.ErrorErrorf(err, "Redis connect failed: %s, retry in %v", c.opts.Addr, backoff)
+}
+
+func (c *Cache) put(cn *conn) {
+	select {
+	case c.pool <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+// 退避期间的错误已经在连接失败时记录过, 不再重复记录
+func (c *Cache) logError(err error, cmd, key string) {
+	if err != errUnavailable {
+		log.ErrorErrorf(err, "Redis %s failed: %s", cmd, key)
+	}
+}
+
+// Redis返回的错误(-ERR ...), 连接仍然可用
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+var errProtocol = errors.New("redis: invalid reply")
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+func (cn *conn) do(timeout time.Duration, args ...interface{}) (interface{}, error) {
+	cn.SetDeadline(time.Now().Add(timeout))
+
+	fmt.Fprintf(cn.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var b []byte
+		switch v := arg.(type) {
+		case string:
+			b = []byte(v)
+		case []byte:
+			b = v
+		}
+		fmt.Fprintf(cn.w, "$%d\r\n", len(b))
+		cn.w.Write(b)
+		cn.w.WriteString("\r\n")
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+	return cn.readReply()
+}
+
+func (cn *conn) readLine() (string, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", errProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+//
+// 解析reply: 字符串返回string, 整数返回int64, bulk string返回[]byte(不存在时为nil), 数组返回[]interface{}
+//
+func (cn *conn) readReply() (interface{}, error) {
+	line, err := cn.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errProtocol
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		// 元素中的错误(例如: EXEC)需要读完剩余的元素, 否则连接放回连接池之后会读到之前的reply
+		var replyErr error
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = cn.readReply(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+				if replyErr == nil {
+					replyErr = err
+				}
+			}
+		}
+		if replyErr != nil {
+			return nil, replyErr
+		}
+		return items, nil
+	}
+	return nil, errProtocol
+}
@@ -0,0 +1,376 @@
+package rediscache
+
+import (
+	"bufio"
+	"cache"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis 实现了Redis协议中GET, SET, DEL, EXISTS, SADD, SMEMBERS, PEXPIRE, AUTH, SELECT等命令
+type fakeRedis struct {
+	net.Listener
+	mu       sync.Mutex
+	data     map[string][]byte
+	sets     map[string][]string
+	ttl      map[string]string
+	conns    int
+	password string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	s := &fakeRedis{Listener: l, data: map[string][]byte{}, sets: map[string][]string{}, ttl: map[string]string{}, password: password}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := len(s.password) == 0
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([][]byte, n)
+		for i := range args {
+			line, _ = r.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			args[i] = make([]byte, size+2)
+			io.ReadFull(r, args[i])
+			args[i] = args[i][:size]
+		}
+
+		s.mu.Lock()
+		key := ""
+		if len(args) > 1 {
+			key = string(args[1])
+		}
+		cmd := strings.ToUpper(string(args[0]))
+		switch {
+		case cmd == "AUTH":
+			authed = key == s.password
+			if authed {
+				fmt.Fprintf(c, "+OK\r\n")
+			} else {
+				fmt.Fprintf(c, "-ERR invalid password\r\n")
+			}
+		case !authed:
+			fmt.Fprintf(c, "-NOAUTH Authentication required\r\n")
+		case cmd == "SELECT":
+			fmt.Fprintf(c, "+OK\r\n")
+		case cmd == "GET":
+			if v, ok := s.data[key]; ok {
+				fmt.Fprintf(c, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				fmt.Fprintf(c, "$-1\r\n")
+			}
+		case cmd == "SET":
+			s.data[key] = args[2]
+			if len(args) == 5 {
+				s.ttl[key] = string(args[4])
+			}
+			fmt.Fprintf(c, "+OK\r\n")
+		case cmd == "DEL":
+			_, ok := s.data[key]
+			if _, set := s.sets[key]; set {
+				ok = true
+			}
+			delete(s.data, key)
+			delete(s.sets, key)
+			if ok {
+				fmt.Fprintf(c, ":1\r\n")
+			} else {
+				fmt.Fprintf(c, ":0\r\n")
+			}
+		case cmd == "PTTL":
+			if _, ok := s.data[key]; !ok {
+				fmt.Fprintf(c, ":-2\r\n")
+			} else if ttl, ok := s.ttl[key]; ok {
+				fmt.Fprintf(c, ":%s\r\n", ttl)
+			} else {
+				fmt.Fprintf(c, ":-1\r\n")
+			}
+		case cmd == "EXISTS":
+			if _, ok := s.data[key]; ok {
+				fmt.Fprintf(c, ":1\r\n")
+			} else {
+				fmt.Fprintf(c, ":0\r\n")
+			}
+		case cmd == "SADD":
+			added := 1
+			for _, member := range s.sets[key] {
+				if member == string(args[2]) {
+					added = 0
+				}
+			}
+			if added > 0 {
+				s.sets[key] = append(s.sets[key], string(args[2]))
+			}
+			fmt.Fprintf(c, ":%d\r\n", added)
+		case cmd == "SMEMBERS":
+			fmt.Fprintf(c, "*%d\r\n", len(s.sets[key]))
+			for _, member := range s.sets[key] {
+				fmt.Fprintf(c, "$%d\r\n%s\r\n", len(member), member)
+			}
+		case cmd == "PEXPIRE":
+			s.ttl[key] = string(args[2])
+			fmt.Fprintf(c, ":1\r\n")
+		default:
+			fmt.Fprintf(c, "-ERR unknown command\r\n")
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	s := newFakeRedis(t, "secret")
+	defer s.Close()
+
+	opts, err := ParseURL(fmt.Sprintf("redis://:secret@%s/1?ttl=1h&maxsize=10", s.Addr()))
+	if err != nil {
+		t.Fatalf("ParseURL: %v", err)
+	}
+	c := New(opts)
+
+	if _, ok := c.Get("a"); ok || c.Exists("a") {
+		t.Fatal("retrieved key before adding it")
+	}
+
+	c.Set("a", []byte("value"))
+	if data, ok := c.Get("a"); !ok || string(data) != "value" {
+		t.Fatalf("Get(a) returned %q, %v", data, ok)
+	}
+	if !c.Exists("a") {
+		t.Fatal("Exists(a) returned false")
+	}
+	s.mu.Lock()
+	ttl := s.ttl["improxy:a"]
+	s.mu.Unlock()
+	if got := ttl; got != "3600000" {
+		t.Errorf("Set(a) used ttl %q, want 3600000", got)
+	}
+
+	// 单独设置的ttl比Options.TTL小时, 使用单独设置的ttl
+	c.SetTTL("c", []byte("c"), time.Minute)
+	data, expires, ok := c.GetWithExpiry("c")
+	if !ok || string(data) != "c" {
+		t.Fatalf("GetWithExpiry(c) returned %q, %v", data, ok)
+	}
+	if d := time.Until(expires); d <= 0 || d > time.Minute {
+		t.Errorf("GetWithExpiry(c) expires in %v, want <= 1m", d)
+	}
+	c.SetTTL("c", []byte("c"), 2*time.Hour)
+	s.mu.Lock()
+	ttl = s.ttl["improxy:c"]
+	s.mu.Unlock()
+	if ttl != "3600000" {
+		t.Errorf("SetTTL(c, 2h) used ttl %q, want 3600000", ttl)
+	}
+
+	// 空的数据也是有效的
+	c.Set("empty", []byte{})
+	if data, ok := c.Get("empty"); !ok || len(data) != 0 {
+		t.Fatalf("Get(empty) returned %q, %v", data, ok)
+	}
+
+	// 过大的数据不缓存
+	c.Set("a", []byte("a value larger than maxsize"))
+	if c.Exists("a") {
+		t.Fatal("oversized value was cached")
+	}
+
+	c.Set("b", []byte("b"))
+	c.Delete("b")
+	if c.Exists("b") {
+		t.Fatal("deleted key still present")
+	}
+
+	// 顺序执行的命令复用同一个连接
+	s.mu.Lock()
+	conns := s.conns
+	s.mu.Unlock()
+	if conns != 1 {
+		t.Errorf("used %d connections, want 1", conns)
+	}
+
+	// 服务不可用时当作没有命中
+	s.Close()
+	c = New(Options{Addr: s.Addr().String(), Timeout: 100 * time.Millisecond})
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("retrieved key from closed server")
+	}
+	c.Set("a", []byte("a"))
+}
+
+func TestRedisCache_Set(t *testing.T) {
+	s := newFakeRedis(t, "")
+	defer s.Close()
+
+	c := New(Options{Addr: s.Addr().String(), Prefix: defaultPrefix, TTL: time.Hour})
+	var store cache.SetStore = c
+
+	for _, member := range []string{"k1", "k2", "k1"} {
+		store.SAdd("idx", member)
+	}
+	if got, want := store.SMembers("idx"), []string{"k1", "k2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SMembers(idx) returned %q, want %q", got, want)
+	}
+	s.mu.Lock()
+	ttl := s.ttl["improxy:idx"]
+	s.mu.Unlock()
+	if ttl != "3600000" {
+		t.Errorf("SAdd(idx) used ttl %q, want 3600000", ttl)
+	}
+
+	store.Delete("idx")
+	if got := store.SMembers("idx"); len(got) != 0 {
+		t.Errorf("SMembers(idx) after Delete returned %q", got)
+	}
+
+	// 多个实例共享同一个redis时, 索引不会互相覆盖
+	newIndex := func() *cache.VariantIndex {
+		remote := New(Options{Addr: s.Addr().String(), Prefix: defaultPrefix})
+		return cache.NewVariantIndex(cache.NewTieredCache(cache.Tier{Cache: cache.NewMemoryCache()}, cache.Tier{Cache: remote}))
+	}
+	x1, x2 := newIndex(), newIndex()
+	if !x1.Shared {
+		t.Errorf("NewVariantIndex with a redis tier is not shared")
+	}
+	u, _ := url.Parse("http://awss3/a.jpeg#100x100")
+	x1.Add(u, "k1")
+	x2.Add(u, "k2")
+	if got, want := x1.Keys(u), []string{"k1", "k2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys(%v) returned %q, want %q", u, got, want)
+	}
+}
+
+// 数组中的错误元素之后的数据也被读完, 连接可以继续使用
+func TestReadReply_NestedError(t *testing.T) {
+	cn := &conn{r: bufio.NewReader(strings.NewReader("*3\r\n$2\r\nk1\r\n-ERR nested\r\n:5\r\n+OK\r\n"))}
+	if _, err := cn.readReply(); err != redisError("ERR nested") {
+		t.Errorf("readReply() returned error %v, want ERR nested", err)
+	}
+	if reply, err := cn.readReply(); reply != "OK" || err != nil {
+		t.Errorf("readReply() after nested error returned %v, %v, want OK", reply, err)
+	}
+}
+
+func TestRedisCache_Backoff(t *testing.T) {
+	s := newFakeRedis(t, "")
+	addr := s.Addr().String()
+	s.Close()
+
+	c := New(Options{Addr: addr, Timeout: 100 * time.Millisecond})
+	dials := 0
+	dial := c.dial
+	c.dial = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dials++
+		return dial(network, address, timeout)
+	}
+
+	// 连接失败之后, 退避期间不再连接
+	for i := 0; i < 3; i++ {
+		if _, ok := c.Get("a"); ok {
+			t.Fatal("retrieved key from closed server")
+		}
+	}
+	if dials != 1 {
+		t.Errorf("dialed %d times, want 1", dials)
+	}
+
+	// 退避结束之后重新连接, 成功之后恢复正常
+	s = newFakeRedis(t, "")
+	defer s.Close()
+	c.opts.Addr = s.Addr().String()
+	c.mu.Lock()
+	c.retryAt = time.Now()
+	c.mu.Unlock()
+	c.Set("a", []byte("a"))
+	if data, ok := c.Get("a"); !ok || string(data) != "a" {
+		t.Fatalf("Get(a) after backoff returned %q, %v", data, ok)
+	}
+	if c.failures != 0 || dials != 2 {
+		t.Errorf("failures: %d, dials: %d, want 0 failures and 2 dials", c.failures, dials)
+	}
+}
+
+func TestRedisCache_MaxActive(t *testing.T) {
+	s := newFakeRedis(t, "")
+	defer s.Close()
+
+	c := New(Options{Addr: s.Addr().String(), MaxActive: 1, Timeout: 50 * time.Millisecond})
+
+	// 所有的连接都在使用时, 等待Timeout之后放弃, 不会建立新的连接
+	c.active <- struct{}{}
+	start := time.Now()
+	if _, err := c.do("GET", "a"); err != errPoolExhausted {
+		t.Errorf("do returned error %v, want %v", err, errPoolExhausted)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("do returned after %v, want to wait for the timeout", d)
+	}
+	<-c.active
+
+	c.Set("a", []byte("a"))
+	if _, ok := c.Get("a"); !ok {
+		t.Error("Get(a) failed after a connection was released")
+	}
+	s.mu.Lock()
+	conns := s.conns
+	s.mu.Unlock()
+	if conns != 1 {
+		t.Errorf("used %d connections, want 1", conns)
+	}
+}
+
+func TestParseURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want Options
+	}{
+		{"redis://localhost", Options{Addr: "localhost:6379", Prefix: defaultPrefix}},
+		{"redis://:pw@10.0.0.1:6380/2?prefix=im:&ttl=24h&maxsize=1024&pool=4&maxactive=8&timeout=2s",
+			Options{Addr: "10.0.0.1:6380", Password: "pw", DB: 2, Prefix: "im:", TTL: 24 * time.Hour,
+				MaxValueSize: 1024, MaxIdle: 4, MaxActive: 8, Timeout: 2 * time.Second}},
+	}
+	for _, tt := range tests {
+		got, err := ParseURL(tt.url)
+		if err != nil {
+			t.Errorf("ParseURL(%q) returned unexpected error: %v", tt.url, err)
+		} else if got != tt.want {
+			t.Errorf("ParseURL(%q) returned %+v, want %+v", tt.url, got, tt.want)
+		}
+	}
+
+	for _, url := range []string{"http://localhost", "redis://", "redis://localhost/x", "redis://localhost?ttl=x"} {
+		if _, err := ParseURL(url); err == nil {
+			t.Errorf("ParseURL(%q) did not return error", url)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+//
+// 每一层缓存的写入策略
+//
+type WritePolicy int
+
+const (
+	WriteAlways  WritePolicy = iota // Set以及从下层promote时都写入
+	WritePromote                    // 只在从下层读取到数据时写入(read-through)
+	WriteNever                      // 只读, 例如: 共享的远程缓存
+)
+
+var writePolicyNames = map[string]WritePolicy{
+	"always":  WriteAlways,
+	"promote": WritePromote,
+	"never":   WriteNever,
+}
+
+func ParseWritePolicy(s string) (WritePolicy, error) {
+	if p, ok := writePolicyNames[s]; ok {
+		return p, nil
+	}
+	return WriteAlways, fmt.Errorf("invalid write policy: %s", s)
+}
+
+type Tier struct {
+	Cache Cache
+	Write WritePolicy
+}
+
+//
+// 多层缓存: memory -> disk -> remote
+// Get按顺序读取, 命中之后将数据promote到上层; Set按照各层的WritePolicy写入; Delete删除所有层的数据
+//
+type TieredCache struct {
+	Tiers []Tier
+}
+
+func NewTieredCache(tiers ...Tier) *TieredCache {
+	return &TieredCache{Tiers: tiers}
+}
+
+func (c *TieredCache) Get(key string) ([]byte, bool) {
+	data, _, ok := c.GetWithExpiry(key)
+	return data, ok
+}
+
+//
+// promote时保留剩余的过期时间, 避免上层的数据比下层活得更久
+//
+func (c *TieredCache) GetWithExpiry(key string) ([]byte, time.Time, bool) {
+	for i, tier := range c.Tiers {
+		data, expires, ok := getWithExpiry(tier.Cache, key)
+		if !ok {
+			continue
+		}
+		c.promote(i, key, data, expires)
+		return data, expires, true
+	}
+	return nil, time.Time{}, false
+}
+
+func (c *TieredCache) Set(key string, data []byte) {
+	c.SetTTL(key, data, 0)
+}
+
+func (c *TieredCache) SetTTL(key string, data []byte, ttl time.Duration) {
+	for _, tier := range c.Tiers {
+		if tier.Write == WriteAlways {
+			SetWithTTL(tier.Cache, key, data, ttl)
+		}
+	}
+}
+
+func (c *TieredCache) Delete(key string) {
+	for _, tier := range c.Tiers {
+		if tier.Write != WriteNever {
+			tier.Cache.Delete(key)
+		}
+	}
+}
+
+func (c *TieredCache) Exists(key string) bool {
+	for _, tier := range c.Tiers {
+		if tier.Cache.Exists(key) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// 只有在不需要promote到上层时, 才直接从下层流式读取
+//
+func (c *TieredCache) GetReader(key string) (io.ReadCloser, int64, bool) {
+	for i, tier := range c.Tiers {
+		sc, ok := tier.Cache.(StreamCache)
+		if !ok || c.promotes(i) {
+			if data, expires, ok := getWithExpiry(tier.Cache, key); ok {
+				c.promote(i, key, data, expires)
+				return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), true
+			}
+			continue
+		}
+		if rc, size, ok := sc.GetReader(key); ok {
+			return rc, size, true
+		}
+	}
+	return nil, 0, false
+}
+
+//
+// 只有一层需要写入并且支持流式写入时才直接写入, 否则缓冲之后通过Set写入所有层
+//
+func (c *TieredCache) SetWriter(key string, size int64) (io.WriteCloser, error) {
+	var writable []Tier
+	for _, tier := range c.Tiers {
+		if tier.Write == WriteAlways {
+			writable = append(writable, tier)
+		}
+	}
+	if len(writable) == 1 {
+		if sc, ok := writable[0].Cache.(StreamCache); ok {
+			return sc.SetWriter(key, size)
+		}
+	}
+	return &bufferedWriter{c: c, key: key, size: size}, nil
+}
+
+//
+// 第一个可以写入并且支持集合操作的层(例如: 共享的redis), 没有时返回nil
+//
+func (c *TieredCache) SetStore() SetStore {
+	for _, tier := range c.Tiers {
+		if store, ok := tier.Cache.(SetStore); ok && tier.Write != WriteNever {
+			return store
+		}
+	}
+	return nil
+}
+
+// 读取第i层时, 是否需要写入上层
+func (c *TieredCache) promotes(i int) bool {
+	for j := 0; j < i; j++ {
+		if c.Tiers[j].Write != WriteNever {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *TieredCache) promote(i int, key string, data []byte, expires time.Time) {
+	var ttl time.Duration
+	if !expires.IsZero() {
+		if ttl = time.Until(expires); ttl <= 0 {
+			return
+		}
+	}
+	for j := 0; j < i; j++ {
+		if c.Tiers[j].Write != WriteNever {
+			SetWithTTL(c.Tiers[j].Cache, key, data, ttl)
+		}
+	}
+}
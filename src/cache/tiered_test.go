@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTieredCache(t *testing.T) {
+	memory, disk, remote := NewMemoryCache(), NewMemoryCache(), NewMemoryCache()
+	c := NewTieredCache(
+		Tier{Cache: memory, Write: WritePromote},
+		Tier{Cache: disk, Write: WriteAlways},
+		Tier{Cache: remote, Write: WriteNever},
+	)
+
+	c.Set("a", []byte("a"))
+	if memory.Exists("a") || !disk.Exists("a") || remote.Exists("a") {
+		t.Fatal("Set did not follow the write policies")
+	}
+
+	// 命中disk之后promote到memory
+	if data, ok := c.Get("a"); !ok || string(data) != "a" {
+		t.Fatalf("Get(a) returned %q, %v", data, ok)
+	}
+	if !memory.Exists("a") {
+		t.Fatal("Get(a) did not promote to memory")
+	}
+
+	// 命中remote之后promote到memory和disk, 但是不写remote
+	remote.Set("b", []byte("b"))
+	if data, ok := c.Get("b"); !ok || string(data) != "b" {
+		t.Fatalf("Get(b) returned %q, %v", data, ok)
+	}
+	if !memory.Exists("b") || !disk.Exists("b") {
+		t.Fatal("Get(b) did not promote to memory and disk")
+	}
+
+	if _, ok := c.Get("c"); ok || c.Exists("c") {
+		t.Fatal("retrieved missing key c")
+	}
+
+	// 只读的remote不删除
+	c.Delete("b")
+	if memory.Exists("b") || disk.Exists("b") || !remote.Exists("b") || !c.Exists("b") {
+		t.Fatal("Delete did not follow the write policies")
+	}
+}
+
+func TestTieredCacheTTL(t *testing.T) {
+	memory, disk := NewMemoryCache(), NewMemoryCache()
+	c := NewTieredCache(
+		Tier{Cache: memory, Write: WritePromote},
+		Tier{Cache: disk, Write: WriteAlways},
+	)
+
+	SetWithTTL(c, "a", []byte("a"), time.Hour)
+	_, want, ok := disk.GetWithExpiry("a")
+	if !ok || want.IsZero() {
+		t.Fatalf("SetWithTTL did not pass ttl to disk: %v, %v", want, ok)
+	}
+
+	// promote时保留下层的过期时间
+	c.Get("a")
+	if _, got, ok := memory.GetWithExpiry("a"); !ok || got.Sub(want) > time.Second || got.Before(want) {
+		t.Fatalf("promoted a expires at %v, want %v", got, want)
+	}
+
+	// 下层的数据过期之后, 上层也不再返回
+	SetWithTTL(c, "b", []byte("b"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, ok := c.Get("b"); ok || memory.Exists("b") {
+		t.Fatal("retrieved expired key b")
+	}
+}
+
+func TestParseWritePolicy(t *testing.T) {
+	for s, want := range map[string]WritePolicy{"always": WriteAlways, "promote": WritePromote, "never": WriteNever} {
+		if got, err := ParseWritePolicy(s); err != nil || got != want {
+			t.Errorf("ParseWritePolicy(%q) returned %v, %v, want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseWritePolicy("sometimes"); err == nil {
+		t.Errorf("ParseWritePolicy(sometimes) did not return error")
+	}
+}
@@ -1,9 +1,14 @@
 package main
 
 import (
+	"bufio"
 	"cache"
 	"cache/diskcache"
 	"cache/diskv"
+	"cache/rediscache"
+	"config"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
@@ -13,9 +18,11 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 )
 
 var (
@@ -25,14 +32,32 @@ var (
 
 // 设置各种参数的Flag
 var (
-	addr      = flag.String("addr", "localhost:8080", "TCP address to listen on")
-	whitelist = flag.String("whitelist", "", "comma separated list of allowed remote hosts")
-	referrers = flag.String("referrers", "", "comma separated list of allowed referring hosts")
-	logFile   = flag.String("logfile", "", "logFile path")
-	cacheDir  = flag.String("cache", "", "location to cache images")
-	timeout   = flag.Duration("timeout", 0, "time limit for requests served by this proxy")
-	signurl   = flag.String("signurl", "", "print version information")
-	version   = flag.Bool("version", false, "print version information")
+	awsConf     = flag.String("awsconf", "conf/aws.ini", "aws and signing settings in the aws.ini format, skipped when the default file is missing")
+	configPath  = flag.String("config", "", "JSON config file covering all the settings below, reloaded on SIGHUP; flags given on the command line take precedence")
+	addr        = flag.String("addr", "localhost:8080", "TCP address to listen on")
+	whitelist   = flag.String("whitelist", "", "comma separated list of allowed remote hosts")
+	referrers   = flag.String("referrers", "", "comma separated list of allowed referring hosts")
+	logFile     = flag.String("logfile", "", "logFile path")
+	cacheSpec   = flag.String("cache", "", "comma separated cache tiers, e.g. memory:512,/data/tmp_improxy/cache")
+	cacheMax    = flag.Uint64("cachemax", 0, "max megabytes of the disk cache, 0 means unlimited")
+	hotCache    = flag.Uint64("hotcache", 1024, "megabytes of the in-memory cache of the disk cache when there is no memory tier")
+	maxAge      = flag.Duration("maxage", 30*24*time.Hour, "Cache-Control max-age of the images sent to the clients")
+	quality     = flag.Int("quality", 80, "default compression quality of resized jpegs and webps")
+	pathPrefix  = flag.String("pathprefix", "tools/im/", "path prefix agreed with cloudfront")
+	timeout     = flag.Duration("timeout", 0, "time limit for requests served by this proxy")
+	originTTL   = flag.Duration("originttl", 0, "age after which cached original images are revalidated against S3, 0 means never")
+	negativeTTL = flag.Duration("negativettl", 0, "time missing or undecodable original images are remembered, 0 disables negative caching")
+	swr         = flag.Duration("swr", 0, "stale-while-revalidate window: serve expired responses this long while refreshing them in the background")
+	upscale     = flag.Float64("maxupscale", 2, "max factor images may be enlarged by with the up option")
+	drain       = flag.Duration("drain", 30*time.Second, "time in-flight requests are given to finish on SIGTERM before they are abandoned")
+	drainDelay  = flag.Duration("draindelay", 10*time.Second, "time to keep serving with a failing /health-check on SIGTERM, so the load balancer stops sending requests; at least one health-check interval")
+	readyCanary = flag.String("readycanary", "", "original image key /ready-check HEADs on S3, empty skips the check")
+	readyFree   = flag.Uint64("readyminfree", 1024, "megabytes of free disk space the cache directory needs for /ready-check to pass")
+	readyMax    = flag.Int("readymaxtransforms", 0, "concurrent transforms at which /ready-check reports saturation, 0 means 4 * NumCPU")
+	presets     = flag.String("presets", "", "named presets file, reloaded on SIGHUP")
+	presetsOnly = flag.Bool("presetsonly", false, "only allow preset options")
+	signurl     = flag.String("signurl", "", "print version information")
+	version     = flag.Bool("version", false, "print version information")
 )
 
 func main() {
@@ -43,6 +68,27 @@ func main() {
 		return
 	}
 
+	if err := loadConfig(); err != nil {
+		log.ErrorErrorf(err, "Improxy load config failed")
+		os.Exit(1)
+	}
+
+	// 缓存维护: improxy cache {stats|prune|verify} ...
+	if flag.Arg(0) == "cache" {
+		os.Exit(cacheCommand(flag.Args()[1:]))
+	}
+
+	// 缓存维护不需要S3和签名的配置; 预热和服务都需要
+	if err := config.Validate(); err != nil {
+		log.ErrorErrorf(err, "Improxy invalid config")
+		os.Exit(1)
+	}
+
+	// 缓存预热: improxy warm -keys keys.txt -o 200x200 -o p:avatar_small
+	if flag.Arg(0) == "warm" {
+		os.Exit(warmCommand(flag.Args()[1:]))
+	}
+
 	localCache, err := parseCache()
 	if err != nil {
 		log.ErrorError(err, "Improxy parse cache failed")
@@ -62,20 +108,12 @@ func main() {
 	log.SetLevel(log.LEVEL_INFO)
 	log.SetFlags(log.Flags() | log.Lshortfile)
 
-	awsUrl, _ := url.Parse("http://awss3")
 	var wg sync.WaitGroup
-	proxy := imageproxy.NewProxy(nil, localCache, &wg)
-	proxy.DefaultBaseURL = awsUrl
-
-	if *whitelist != "" {
-		proxy.Whitelist = strings.Split(*whitelist, ",")
-	}
-	if *referrers != "" {
-		proxy.Referrers = strings.Split(*referrers, ",")
+	proxy, err := newProxy(localCache, &wg)
+	if err != nil {
+		return
 	}
 
-	proxy.Timeout = *timeout
-
 	// 创建Http Server, 以及Proxy
 	server := &http.Server{
 		Addr:    *addr,
@@ -85,7 +123,7 @@ func main() {
 	log.Printf(">>>>> Improxy (version %s) listening on %s\n", VERSION, server.Addr)
 
 	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	go func() {
 		// 对外提供服务
@@ -93,32 +131,338 @@ func main() {
 	}()
 
 	sig := <-sigchan
+	for sig == syscall.SIGHUP {
+		// SIGHUP: 重新加载presets, 以及配置文件中可以在线修改的部分
+		if proxy.Presets != nil && len(proxy.Presets.Path) > 0 {
+			if err := proxy.Presets.Reload(); err != nil {
+				log.ErrorErrorf(err, "Improxy reload presets failed")
+			}
+		}
+		if err := reloadConfig(proxy); err != nil {
+			log.ErrorErrorf(err, "Improxy reload config failed, keep the current settings")
+		}
+		sig = <-sigchan
+	}
 
 	log.Printf("<<<<< Improxy Caught signal %v: terminating\n", sig)
-	// 不在接受新的请求
 
-	server.Close()
+	// health-check失败, 等待负载均衡摘除之后不在接受新的请求
+	proxy.StartDraining()
+	if *drainDelay > 0 {
+		time.Sleep(*drainDelay)
+	}
 
-	wg.Wait()
+	// 等待正在处理的请求结束, 最多等待 -drain
+	ctx, cancel := context.WithTimeout(context.Background(), *drain)
+	defer cancel()
+	err = server.Shutdown(ctx)
+	if err == nil {
+		err = proxy.WaitIdle(ctx)
+	}
+	if err != nil {
+		abandoned := proxy.InFlight()
+		log.Printf("<<<<< Improxy drain deadline %v exceeded, abandoning %d requests\n", *drain, len(abandoned))
+		for _, req := range abandoned {
+			log.Printf("<<<<< Abandoned: %s %s, elapsed: %.1fs\n", req.Method, req.URL, req.Elapsed.Seconds())
+		}
+		server.Close()
+		os.Exit(1)
+	}
 	log.Printf("<<<<< Improxy terminated\n")
 }
 
 
+//
+// 根据flags创建Proxy, 对外服务和warm共用
+//
+func newProxy(localCache cache.Cache, wg *sync.WaitGroup) (*imageproxy.Proxy, error) {
+	awsUrl, _ := url.Parse("http://awss3")
+	proxy := imageproxy.NewProxy(nil, localCache, wg)
+	proxy.DefaultBaseURL = awsUrl
+
+	// 没有共享的redis索引时, 索引保存在磁盘缓存的目录下, 重启之后仍然可以purge之前缓存的文件
+	if dir := cacheDirFromSpecs(); len(dir) > 0 && !proxy.Index.Shared {
+		dir, _ = filepath.Abs(dir)
+		proxy.SetIndexStore(diskcache.NewIndexStore(filepath.Join(dir, ".index")))
+	}
+
+	if *whitelist != "" {
+		proxy.Whitelist = strings.Split(*whitelist, ",")
+	}
+	if *referrers != "" {
+		proxy.Referrers = strings.Split(*referrers, ",")
+	}
+
+	// 渲染之后的图片保存到单独的bucket
+	if len(config.AWSDerivedBucket) > 0 {
+		log.Printf("Improxy, variant store: s3://%s", config.AWSDerivedBucket)
+		proxy.SetVariantStore(imageproxy.NewS3VariantStore(config.AWSDerivedBucket))
+	}
+
+	proxy.Timeout = *timeout
+	proxy.ReadyOptions = imageproxy.ReadyOptions{
+		CanaryKey:     *readyCanary,
+		CacheDir:      cacheDirFromSpecs(),
+		MinFreeBytes:  *readyFree * 1024 * 1024,
+		MaxTransforms: *readyMax,
+	}
+	proxy.SetOriginTTL(*originTTL)
+	proxy.SetStaleWhileRevalidate(*swr)
+	proxy.SetNegativeTTL(*negativeTTL)
+	imageproxy.MaxUpscale = *upscale
+
+	if *presets != "" {
+		var err error
+		proxy.Presets, err = imageproxy.NewPresets(*presets)
+		if err != nil {
+			log.ErrorErrorf(err, "Improxy load presets failed: %s", *presets)
+			return nil, err
+		}
+		proxy.Presets.Only = *presetsOnly
+	} else if configFile != nil {
+		// 配置文件中的presets, 没有时也创建, 以便reload时增加
+		var err error
+		proxy.Presets, err = imageproxy.NewPresetsFromMap(configFile.Presets, *presetsOnly)
+		if err != nil {
+			log.ErrorErrorf(err, "Improxy load presets failed: %s", *configPath)
+			return nil, err
+		}
+	}
+	return proxy, nil
+}
+
+// 通过 -config 读取的配置, reload时用来判断哪些配置被修改
+var configFile *config.File
+
+//
+// 按照顺序加载配置, 后面的覆盖前面的:
+//   1. -awsconf 指定的aws.ini
+//   2. -config 指定的配置文件: 命令行中没有指定的flag使用配置文件中的值
+//   3. IMPROXY_* 环境变量
+// 然后设置和flag无关的全局配置
+//
+func loadConfig() error {
+	explicit := explicitFlags()
+	if _, err := os.Stat(*awsConf); err == nil || explicit["awsconf"] {
+		if err := config.LoadConfig(*awsConf); err != nil {
+			return err
+		}
+	}
+
+	if *configPath != "" {
+		f, err := config.ReadFile(*configPath)
+		if err != nil {
+			return err
+		}
+		for name, value := range configFlags(f) {
+			if !explicit[name] {
+				if err := flag.Set(name, value); err != nil {
+					return fmt.Errorf("config %s: %s: %v", *configPath, name, err)
+				}
+			}
+		}
+		f.Apply()
+		configFile = f
+	}
+
+	if err := config.LoadEnv(); err != nil {
+		return err
+	}
+
+	if *quality < 1 || *quality > 100 {
+		return fmt.Errorf("quality %d must be in [1, 100]", *quality)
+	}
+	if *pathPrefix == "" || strings.HasPrefix(*pathPrefix, "/") || !strings.HasSuffix(*pathPrefix, "/") {
+		return fmt.Errorf("pathprefix %q must be like \"tools/im/\"", *pathPrefix)
+	}
+	imageproxy.DefaultQuality = *quality
+	imageproxy.SetPathPrefix(*pathPrefix)
+	imageproxy.SetCacheMaxAge(*maxAge)
+	return nil
+}
+
+//
+// SIGHUP: 重新读取配置文件, 在线修改access, presets, cache_control, sign;
+// 命令行中指定的flag依然优先; 其他的修改需要重启
+//
+func reloadConfig(proxy *imageproxy.Proxy) error {
+	if configFile == nil {
+		return nil
+	}
+	f, err := config.ReadFile(*configPath)
+	if err != nil {
+		return err
+	}
+
+	explicit := explicitFlags()
+	if proxy.Presets != nil && !explicit["presets"] {
+		only := f.PresetsOnly
+		if explicit["presetsonly"] {
+			only = *presetsOnly
+		}
+		if err := proxy.Presets.Update(f.Presets, only); err != nil {
+			return err
+		}
+	}
+
+	whitelist, referrers := proxy.Whitelist, proxy.Referrers
+	if !explicit["whitelist"] {
+		whitelist = f.Access.Whitelist
+	}
+	if !explicit["referrers"] {
+		referrers = f.Access.Referrers
+	}
+	proxy.SetAccessLists(whitelist, referrers)
+
+	if !explicit["maxage"] {
+		imageproxy.SetCacheMaxAge(time.Duration(f.CacheControl.MaxAge))
+	}
+	f.ApplySign()
+	// 环境变量依然优先
+	if err := config.LoadSignEnv(); err != nil {
+		return err
+	}
+
+	if configFile.RestartRequired(f) {
+		log.Printf("Improxy config %s: only access, presets, cache_control and sign are reloaded, restart to apply the other changes", *configPath)
+	}
+	configFile = f
+	log.Printf("Improxy config reloaded: %s", *configPath)
+	return nil
+}
+
+// 命令行中指定的flag
+func explicitFlags() map[string]bool {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	return explicit
+}
+
+//
+// 配置文件中和flag对应的配置
+//
+func configFlags(f *config.File) map[string]string {
+	return map[string]string{
+		"addr":               f.Server.Addr,
+		"logfile":            f.Server.LogFile,
+		"timeout":            time.Duration(f.Server.Timeout).String(),
+		"drain":              time.Duration(f.Server.Drain).String(),
+		"draindelay":         time.Duration(f.Server.DrainDelay).String(),
+		"pathprefix":         f.Server.PathPrefix,
+		"whitelist":          strings.Join(f.Access.Whitelist, ","),
+		"referrers":          strings.Join(f.Access.Referrers, ","),
+		"cache":              strings.Join(f.Cache.Tiers, ","),
+		"cachemax":           strconv.FormatUint(f.Cache.MaxMB, 10),
+		"hotcache":           strconv.FormatUint(f.Cache.HotMB, 10),
+		"originttl":          time.Duration(f.Cache.OriginTTL).String(),
+		"negativettl":        time.Duration(f.Cache.NegativeTTL).String(),
+		"swr":                time.Duration(f.Cache.StaleWhileRevalidate).String(),
+		"maxage":             time.Duration(f.CacheControl.MaxAge).String(),
+		"quality":            strconv.Itoa(f.Transform.DefaultQuality),
+		"maxupscale":         strconv.FormatFloat(f.Transform.MaxUpscale, 'g', -1, 64),
+		"presetsonly":        strconv.FormatBool(f.PresetsOnly),
+		"readycanary":        f.Ready.CanaryKey,
+		"readyminfree":       strconv.FormatUint(f.Ready.MinFreeMB, 10),
+		"readymaxtransforms": strconv.Itoa(f.Ready.MaxTransforms),
+	}
+}
 
 // parseCache parses the cache-related flags and returns the specified Cache implementation.
+//
+// -cache 为逗号分隔的多层缓存, 按照顺序读取, 命中之后promote到上层:
+//   memory[:MB]  内存中的LRU缓存, 默认256M
+//   redis://...  Redis缓存, 多个实例共享, 参数见rediscache.ParseURL
+//   {dir}        磁盘缓存
+// 每一层可以通过 #always, #promote, #never 指定写入策略, 默认为always
+// 例如: -cache memory:512,/data/tmp_improxy/cache,redis://10.0.0.1:6379/0?ttl=720h
+//
 func parseCache() (cache.Cache, error) {
-	// 直接使用磁盘cache
-	if len(*cacheDir) > 0 {
-		return diskCache(*cacheDir), nil
-	} else {
+	specs := cacheSpecs()
+	if len(specs) == 0 {
 		return nil, nil
 	}
+
+	// 有内存层时, 磁盘缓存不再需要自己的内存缓存
+	hotSize := *hotCache * 1024 * 1024 // 磁盘缓存的内存缓存, 默认1G
+	for _, spec := range specs {
+		if isMemorySpec(spec) {
+			hotSize = 0
+		}
+	}
+
+	var tiers []cache.Tier
+	for _, spec := range specs {
+		tier := cache.Tier{Write: cache.WriteAlways}
+		if i := strings.LastIndex(spec, "#"); i >= 0 {
+			policy, err := cache.ParseWritePolicy(spec[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			spec, tier.Write = spec[:i], policy
+		}
+
+		if isMemorySpec(spec) {
+			size := uint64(256)
+			if i := strings.Index(spec, ":"); i >= 0 {
+				var err error
+				if size, err = strconv.ParseUint(spec[i+1:], 10, 64); err != nil {
+					return nil, fmt.Errorf("invalid memory cache size: %s", spec)
+				}
+			}
+			log.Printf("Improxy, memory cache: %dM", size)
+			tier.Cache = cache.NewMemoryCacheWithSize(size * 1024 * 1024)
+		} else if strings.HasPrefix(spec, "redis://") {
+			opts, err := rediscache.ParseURL(spec)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Improxy, redis cache: %s/%d", opts.Addr, opts.DB)
+			tier.Cache = rediscache.New(opts)
+		} else {
+			tier.Cache = diskCache(spec, hotSize)
+		}
+		tiers = append(tiers, tier)
+	}
+
+	if len(tiers) == 1 && tiers[0].Write == cache.WriteAlways {
+		return tiers[0].Cache, nil
+	}
+	return cache.NewTieredCache(tiers...), nil
+}
+
+func cacheSpecs() []string {
+	var specs []string
+	for _, spec := range strings.Split(*cacheSpec, ",") {
+		if spec = strings.TrimSpace(spec); len(spec) > 0 {
+			specs = append(specs, spec)
+		}
+	}
+	return specs
+}
+
+func isMemorySpec(spec string) bool {
+	return spec == "memory" || strings.HasPrefix(spec, "memory:") || strings.HasPrefix(spec, "memory#")
+}
+
+// 第一个磁盘缓存的目录
+func cacheDirFromSpecs() string {
+	for _, spec := range cacheSpecs() {
+		if i := strings.LastIndex(spec, "#"); i >= 0 {
+			spec = spec[:i]
+		}
+		if !isMemorySpec(spec) && !strings.HasPrefix(spec, "redis://") {
+			return spec
+		}
+	}
+	return ""
 }
 
 //
 // 设置DiskCache
 //
-func diskCache(path string) *diskcache.Cache {
+func diskCache(path string, hotSize uint64) *diskcache.Cache {
 	path, _ = filepath.Abs(path)
 	log.Printf("Improxy, disk cache: %s", path)
 
@@ -126,12 +470,229 @@ func diskCache(path string) *diskcache.Cache {
 	// 文件名如何获取呢?
 	// key --> md5 --> tranform: path --> path / md5
 	//
+	// 超过cachemax之后按照LRU删除文件; 启动时会扫描目录
 	d := diskv.New(diskv.Options{
 		BasePath:     path,
-		CacheSizeMax: 1024 * 1024 * 1024, // 默认磁盘缓存: 1G
+		CacheSizeMax: hotSize,
+		DiskSizeMax:  *cacheMax * 1024 * 1024,
 		Transform: func(s string) []string {
 			return []string{s[0:2], s[2:4]}
 		},
 	})
 	return diskcache.NewWithDiskv(d)
 }
+
+//
+// 缓存目录的维护, 结果以JSON格式输出
+//   improxy cache stats  [-dir dir]
+//   improxy cache prune  [-dir dir] [-age 240h] [-idle 72h] [-size 51200] [-dryrun]
+//     prune同时删除崩溃时遗留的临时文件(.tmp-*)
+//   improxy cache verify [-dir dir] [-delete]
+//
+func cacheCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s cache {stats|prune|verify} [flags]\n", os.Args[0])
+		return 2
+	}
+
+	fs := flag.NewFlagSet("cache "+args[0], flag.ExitOnError)
+	dir := fs.String("dir", cacheDirFromSpecs(), "cache dir, defaults to the disk tier of -cache")
+	maxAge := fs.Duration("age", 0, "prune: delete files modified earlier than this")
+	maxIdle := fs.Duration("idle", 0, "prune: delete files not accessed within this")
+	targetSize := fs.Int64("size", 0, "prune: delete least recently accessed files until the cache is under this many megabytes")
+	dryRun := fs.Bool("dryrun", false, "prune: only report the files to delete")
+	remove := fs.Bool("delete", false, "verify: delete corrupt files")
+	fs.Parse(args[1:])
+
+	if len(*dir) == 0 {
+		fmt.Fprintf(os.Stderr, "cache dir is required\n")
+		return 2
+	}
+	path, _ := filepath.Abs(*dir)
+
+	// Ctrl-C时停止扫描
+	cancel := make(chan struct{})
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigchan
+		close(cancel)
+	}()
+
+	var result interface{}
+	var err error
+	switch args[0] {
+	case "stats":
+		result, err = diskcache.DirStats(path, time.Now(), cancel)
+	case "prune":
+		policy := diskcache.PrunePolicy{
+			MaxAge:     *maxAge,
+			MaxIdle:    *maxIdle,
+			TargetSize: *targetSize * 1024 * 1024,
+			DryRun:     *dryRun,
+		}
+		if policy.MaxAge <= 0 && policy.MaxIdle <= 0 && policy.TargetSize <= 0 {
+			fmt.Fprintf(os.Stderr, "one of -age, -idle or -size is required\n")
+			return 2
+		}
+		result, err = diskcache.Prune(path, policy, time.Now(), cancel)
+	case "verify":
+		result, err = diskcache.Verify(path, imageproxy.VerifyCacheEntry, *remove, cancel)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown cache command: %s\n", args[0])
+		return 2
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(result)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cache %s failed: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// 可以重复指定的flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+//
+// 缓存预热, 通过和线上请求相同的流程渲染图片并写入-cache指定的缓存; 结果以JSON格式输出
+//   improxy [-cache ...] [-presets ...] warm [-keys file] [-o options]... [-allpresets] [-webp] [-c 8] [-v]
+// keys每行一个, 空行和以#开头的行被忽略; -keys为"-"时从stdin读取
+//
+func warmCommand(args []string) int {
+	var options stringList
+	fs := flag.NewFlagSet("warm", flag.ExitOnError)
+	keysFile := fs.String("keys", "-", "file with one image key per line, - for stdin")
+	fs.Var(&options, "o", "options or preset (p:name) to render, may be repeated")
+	allPresets := fs.Bool("allpresets", false, "render every preset of -presets")
+	webp := fs.Bool("webp", false, "also render the variants served to clients supporting webp")
+	concurrency := fs.Int("c", 8, "number of concurrent renders")
+	verbose := fs.Bool("v", false, "print every result and the proxy logs")
+	fs.Parse(args)
+
+	// 只有内存缓存时, 预热的结果在退出之后就丢失了
+	persistent := false
+	for _, spec := range cacheSpecs() {
+		if !isMemorySpec(strings.SplitN(spec, "#", 2)[0]) {
+			persistent = true
+		}
+	}
+	if !persistent {
+		fmt.Fprintf(os.Stderr, "a disk or redis tier in -cache is required\n")
+		return 2
+	}
+
+	if !*verbose && len(*logFile) == 0 {
+		log.SetLevel(log.LEVEL_ERROR)
+	}
+	localCache, err := parseCache()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "parse cache failed: %v\n", err)
+		return 2
+	}
+	proxy, err := newProxy(localCache, &sync.WaitGroup{})
+	if err != nil {
+		return 2
+	}
+	// 预热时不丢弃variant, 等待之前的保存完成
+	proxy.SetVariantBlocking(true)
+
+	if *allPresets {
+		for _, name := range proxy.Presets.Names() {
+			options = append(options, "p:"+name)
+		}
+	}
+	if len(options) == 0 {
+		fmt.Fprintf(os.Stderr, "at least one -o or -allpresets is required\n")
+		return 2
+	}
+
+	in := os.Stdin
+	if *keysFile != "-" {
+		if in, err = os.Open(*keysFile); err != nil {
+			fmt.Fprintf(os.Stderr, "open keys failed: %v\n", err)
+			return 2
+		}
+		defer in.Close()
+	}
+
+	// Ctrl-C时停止预热, 已经开始的请求会完成
+	cancel := make(chan struct{})
+	sigchan := make(chan os.Signal, 1)
+	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigchan
+		close(cancel)
+	}()
+
+	keys := make(chan string)
+	go func() {
+		defer close(keys)
+		scanner := bufio.NewScanner(in)
+		for scanner.Scan() {
+			key := strings.TrimSpace(scanner.Text())
+			if len(key) == 0 || strings.HasPrefix(key, "#") {
+				continue
+			}
+			select {
+			case keys <- key:
+			case <-cancel:
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintf(os.Stderr, "read keys failed: %v\n", err)
+		}
+	}()
+
+	// 每5秒输出一次进度
+	var done, failed int64
+	lastReport := time.Now()
+	progress := func(result *imageproxy.WarmResult) {
+		done++
+		if len(result.Error) > 0 {
+			failed++
+		}
+		if *verbose || len(result.Error) > 0 {
+			line, _ := json.Marshal(result)
+			fmt.Fprintf(os.Stderr, "%s\n", line)
+		}
+		if now := time.Now(); now.Sub(lastReport) >= 5*time.Second {
+			lastReport = now
+			fmt.Fprintf(os.Stderr, "warm: %d done, %d failed\n", done, failed)
+		}
+	}
+
+	report := proxy.Warm(keys, imageproxy.WarmOptions{
+		Options:     options,
+		Webp:        *webp,
+		Concurrency: *concurrency,
+		Progress:    progress,
+	}, cancel)
+
+	// 退出之前等待后台保存的variant
+	proxy.WaitIdle(context.Background())
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(report)
+
+	if report.Failed > 0 || report.Cancelled {
+		return 1
+	}
+	return 0
+}
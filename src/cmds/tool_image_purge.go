@@ -0,0 +1,77 @@
+package main
+
+import (
+	"config"
+	"encoding/json"
+	"flag"
+	"fmt"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"imageproxy"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//
+// 删除图片在improxy中的所有缓存(原始数据以及所有的variants)
+// 用法: tool_image_purge -addr localhost:8088 production/improxy/6a/82e2c962fb727886aa6d7cce7107d7.jpeg ...
+// 每个实例只删除自己的本地缓存, 多个实例时需要全部列出: -addr 10.0.0.1:8088,10.0.0.2:8088
+//
+var (
+	purgeAddr = flag.String("addr", "localhost:8080", "comma separated improxy addresses, every instance is purged")
+	awsConf   = flag.String("awsconf", "conf/aws.ini", "signing settings in the aws.ini format; IMPROXY_SIMPLE_KEY and IMPROXY_MAGIC_NUM override it")
+)
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-addr host:port[,host:port]] key...\n", os.Args[0])
+		os.Exit(2)
+	}
+
+	// 签名的key; 默认的配置文件不存在时只使用环境变量
+	explicit := false
+	flag.Visit(func(f *flag.Flag) { explicit = explicit || f.Name == "awsconf" })
+	if _, err := os.Stat(*awsConf); err == nil || explicit {
+		if err := config.LoadConfig(*awsConf); err != nil {
+			log.ErrorErrorf(err, "Load config failed")
+			os.Exit(1)
+		}
+	}
+	if err := config.LoadEnv(); err != nil {
+		log.ErrorErrorf(err, "Load config failed")
+		os.Exit(1)
+	}
+	if key, _ := config.SignKeys(); len(key) == 0 {
+		log.Errorf("Load config failed: simple_key is empty")
+		os.Exit(1)
+	}
+
+	failed := 0
+	for _, addr := range strings.Split(*purgeAddr, ",") {
+		addr = strings.TrimSpace(addr)
+		for _, key := range flag.Args() {
+			url := fmt.Sprintf("http://%s%s", addr, imageproxy.PurgeURL(key))
+			resp, err := http.Post(url, "", nil)
+			if err != nil {
+				log.ErrorErrorf(err, "Purge failed: %s, addr: %s", key, addr)
+				failed++
+				continue
+			}
+
+			var result imageproxy.PurgeResult
+			err = json.NewDecoder(resp.Body).Decode(&result)
+			resp.Body.Close()
+			if err != nil || !result.Succeed {
+				log.Errorf("Purge failed: %s, addr: %s, status: %d, msg: %s", key, addr, resp.StatusCode, result.Message)
+				failed++
+				continue
+			}
+			log.Printf("Purged: %s, addr: %s, keys: %d, variants: %d", key, addr, len(result.Keys), len(result.Variants))
+		}
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
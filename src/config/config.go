@@ -1,50 +1,160 @@
 package config
 
 import (
-	"github.com/wfxiang08/cyutils/utils"
+	"fmt"
 	cy_config "github.com/wfxiang08/cyutils/utils/config"
-	"log"
 	"os"
-	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 )
 
+//
+// 配置需要通过LoadConfig或者LoadEnv显式的加载; 没有加载时都为空
+//
 var (
 	AwsAccessKeyId     string
 	AwsSecretAccessKey string
 	AWSBuckets         string
+	AWSDerivedBucket   string // 渲染之后的图片的持久化存储, 为空表示不持久化
 	AwsRegion          string
-	SimpleKey          []byte
-	MagicNum           int64
+	FaviconPath        string // /favicon.ico 的文件, 为空时返回404
+
+	// 签名的key, 可以在线修改, 通过SignKeys/SetSignKeys访问
+	keysMu    sync.RWMutex
+	simpleKey []byte
+	magicNum  int64
 )
 
-func init() {
-	config := cy_config.NewCfg(GetConfPath("conf/aws.ini"))
-	config.Load()
-	AwsAccessKeyId, _ = config.ReadString("aws_access_key_id", "")
-	AwsSecretAccessKey, _ = config.ReadString("aws_secret_access_key", "")
-	AWSBuckets, _ = config.ReadString("aws_buckets", "")
-	AwsRegion, _ = config.ReadString("aws_region", "")
+// 环境变量的前缀, 例如: IMPROXY_AWS_BUCKETS
+const envPrefix = "IMPROXY_"
+
+//
+// 读取配置文件:
+//   *.json 统一的配置文件, 见ReadFile
+//   其他   conf/aws.ini 格式, 每行一个 key=value
+// 文件中没有出现的配置保持不变; 配置文件所在目录下的favicon.ico作为默认的favicon
+//
+func LoadConfig(path string) error {
+	if strings.HasSuffix(path, ".json") {
+		f, err := ReadFile(path)
+		if err != nil {
+			return err
+		}
+		f.Apply()
+	} else if err := loadIni(path); err != nil {
+		return err
+	}
+
+	if len(FaviconPath) == 0 {
+		favicon := filepath.Join(filepath.Dir(path), "favicon.ico")
+		if _, err := os.Stat(favicon); err == nil {
+			FaviconPath = favicon
+		}
+	}
+	return nil
+}
 
-	simpleKey, _ := config.ReadString("simple_key", "")
-	SimpleKey = []byte(simpleKey)
+func loadIni(path string) error {
+	cfg := cy_config.NewCfg(path)
+	if err := cfg.Load(); err != nil {
+		return fmt.Errorf("config %s: %v", path, err)
+	}
 
-	magicNum, _ := config.ReadInt("magic_num", 0)
-	MagicNum = int64(magicNum)
+	for key, dst := range map[string]*string{
+		"aws_access_key_id":     &AwsAccessKeyId,
+		"aws_secret_access_key": &AwsSecretAccessKey,
+		"aws_buckets":           &AWSBuckets,
+		"aws_derived_bucket":    &AWSDerivedBucket,
+		"aws_region":            &AwsRegion,
+	} {
+		if value, err := cfg.ReadString(key, ""); err == nil {
+			*dst = value
+		}
+	}
 
+	key, magic := SignKeys()
+	if value, err := cfg.ReadString("simple_key", ""); err == nil {
+		key = []byte(value)
+	}
+	if value, err := cfg.ReadString("magic_num", ""); err == nil {
+		if magic, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("config %s: invalid magic_num %q", path, value)
+		}
+	}
+	SetSignKeys(key, magic)
+	return nil
 }
 
-// 通过相关路径获取项目的资源时，在testcase和运行binary时的表现不太一样，各自的pwd有点点差别
-func GetConfPath(filePath string) string {
-	pwd, _ := os.Getwd()
-	i := 0
-	for !utils.FileExist(path.Join(pwd, filePath)) {
-		pwd = path.Dir(pwd)
-		i++
-		// 找不到配置文件，就报错
-		if i >= 3 {
-			log.Panicf("ConfigPath not found: %s", filePath)
+//
+// 从环境变量中读取配置, 覆盖之前加载的配置:
+//   IMPROXY_AWS_ACCESS_KEY_ID, IMPROXY_AWS_SECRET_ACCESS_KEY, IMPROXY_AWS_BUCKETS,
+//   IMPROXY_AWS_DERIVED_BUCKET, IMPROXY_AWS_REGION, IMPROXY_SIMPLE_KEY, IMPROXY_MAGIC_NUM,
+//   IMPROXY_FAVICON
+// 没有设置的环境变量保持之前的配置; 只能在启动时调用, reload时使用LoadSignEnv
+//
+func LoadEnv() error {
+	for name, dst := range map[string]*string{
+		"AWS_ACCESS_KEY_ID":     &AwsAccessKeyId,
+		"AWS_SECRET_ACCESS_KEY": &AwsSecretAccessKey,
+		"AWS_BUCKETS":           &AWSBuckets,
+		"AWS_DERIVED_BUCKET":    &AWSDerivedBucket,
+		"AWS_REGION":            &AwsRegion,
+		"FAVICON":               &FaviconPath,
+	} {
+		if value, ok := os.LookupEnv(envPrefix + name); ok {
+			*dst = value
 		}
 	}
-	return path.Join(pwd, filePath)
 
+	return LoadSignEnv()
+}
+
+//
+// 从环境变量中读取签名的配置: IMPROXY_SIMPLE_KEY, IMPROXY_MAGIC_NUM
+// 配置文件reload之后需要再次调用, 保证环境变量优先; 其他的配置在服务时没有加锁, 不能修改
+//
+func LoadSignEnv() error {
+	key, magic := SignKeys()
+	if value, ok := os.LookupEnv(envPrefix + "SIMPLE_KEY"); ok {
+		key = []byte(value)
+	}
+	if value, ok := os.LookupEnv(envPrefix + "MAGIC_NUM"); ok {
+		var err error
+		if magic, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("invalid %sMAGIC_NUM %q", envPrefix, value)
+		}
+	}
+	SetSignKeys(key, magic)
+	return nil
+}
+
+//
+// 检查必需的配置, 在所有的配置加载完成之后调用:
+//   simple_key 为空时任何人都可以伪造签名
+//   aws_buckets 为空时无法读取原始图片
+//
+func Validate() error {
+	if key, _ := SignKeys(); len(key) == 0 {
+		return fmt.Errorf("simple_key is empty, set it in the config or %sSIMPLE_KEY", envPrefix)
+	}
+	if len(AWSBuckets) == 0 {
+		return fmt.Errorf("aws_buckets is empty, set it in the config or %sAWS_BUCKETS", envPrefix)
+	}
+	return nil
+}
+
+// SignKeys returns the key and the magic number used to sign urls.
+func SignKeys() ([]byte, int64) {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+	return simpleKey, magicNum
+}
+
+// SetSignKeys replaces the key and the magic number used to sign urls.
+func SetSignKeys(key []byte, magic int64) {
+	keysMu.Lock()
+	simpleKey, magicNum = key, magic
+	keysMu.Unlock()
 }
@@ -0,0 +1,151 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 保存全局的配置, 测试结束之后恢复
+func saveConfig() func() {
+	aws := []string{AwsAccessKeyId, AwsSecretAccessKey, AWSBuckets, AWSDerivedBucket, AwsRegion, FaviconPath}
+	key, magic := SignKeys()
+	return func() {
+		AwsAccessKeyId, AwsSecretAccessKey, AWSBuckets, AWSDerivedBucket, AwsRegion, FaviconPath =
+			aws[0], aws[1], aws[2], aws[3], aws[4], aws[5]
+		SetSignKeys(key, magic)
+	}
+}
+
+func TestLoadConfig_Ini(t *testing.T) {
+	defer saveConfig()()
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "aws.ini")
+	ioutil.WriteFile(path, []byte("# comment\naws_buckets=bucket\naws_region=us-west-2\nsimple_key=key\nmagic_num=42\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "favicon.ico"), []byte("ico"), 0644)
+
+	AwsAccessKeyId, FaviconPath = "kept", ""
+	if err := LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+	if AWSBuckets != "bucket" || AwsRegion != "us-west-2" || AwsAccessKeyId != "kept" {
+		t.Errorf("LoadConfig set buckets %q, region %q, access key %q", AWSBuckets, AwsRegion, AwsAccessKeyId)
+	}
+	if key, magic := SignKeys(); string(key) != "key" || magic != 42 {
+		t.Errorf("SignKeys() = %q, %d, want key, 42", key, magic)
+	}
+	if want := filepath.Join(dir, "favicon.ico"); FaviconPath != want {
+		t.Errorf("FaviconPath = %q, want %q", FaviconPath, want)
+	}
+
+	// 错误返回error, 而不是panic
+	if err := LoadConfig(filepath.Join(dir, "missing.ini")); err == nil {
+		t.Errorf("LoadConfig of a missing file did not return an error")
+	}
+	ioutil.WriteFile(path, []byte("magic_num=abc\n"), 0644)
+	if err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "magic_num") {
+		t.Errorf("LoadConfig returned error %v, want invalid magic_num", err)
+	}
+	ioutil.WriteFile(path, []byte("aws_buckets\n"), 0644)
+	if err := LoadConfig(path); err == nil {
+		t.Errorf("LoadConfig of an invalid file did not return an error")
+	}
+}
+
+func TestLoadConfig_JSON(t *testing.T) {
+	defer saveConfig()()
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "improxy.json")
+	ioutil.WriteFile(path, []byte(`{"aws": {"buckets": "json-bucket"}, "server": {"favicon": "icons/favicon.ico"}}`), 0644)
+	if err := LoadConfig(path); err != nil {
+		t.Fatalf("LoadConfig returned error: %v", err)
+	}
+	if AWSBuckets != "json-bucket" {
+		t.Errorf("AWSBuckets = %q, want json-bucket", AWSBuckets)
+	}
+	if want := filepath.Join(dir, "icons/favicon.ico"); FaviconPath != want {
+		t.Errorf("FaviconPath = %q, want %q", FaviconPath, want)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	defer saveConfig()()
+
+	env := map[string]string{
+		"IMPROXY_AWS_BUCKETS": "env-bucket",
+		"IMPROXY_SIMPLE_KEY":  "env-key",
+		"IMPROXY_MAGIC_NUM":   "7",
+		"IMPROXY_FAVICON":     "/tmp/favicon.ico",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	AwsRegion = "kept"
+	if err := LoadEnv(); err != nil {
+		t.Fatalf("LoadEnv returned error: %v", err)
+	}
+	if AWSBuckets != "env-bucket" || AwsRegion != "kept" || FaviconPath != "/tmp/favicon.ico" {
+		t.Errorf("LoadEnv set buckets %q, region %q, favicon %q", AWSBuckets, AwsRegion, FaviconPath)
+	}
+	if key, magic := SignKeys(); string(key) != "env-key" || magic != 7 {
+		t.Errorf("SignKeys() = %q, %d, want env-key, 7", key, magic)
+	}
+
+	// 空的环境变量同样覆盖之前的配置
+	os.Setenv("IMPROXY_AWS_BUCKETS", "")
+	if err := LoadEnv(); err != nil || AWSBuckets != "" {
+		t.Errorf("LoadEnv with empty IMPROXY_AWS_BUCKETS set buckets %q, error %v", AWSBuckets, err)
+	}
+
+	// reload时只修改签名的配置
+	os.Setenv("IMPROXY_AWS_BUCKETS", "reloaded-bucket")
+	os.Setenv("IMPROXY_SIMPLE_KEY", "reloaded-key")
+	if err := LoadSignEnv(); err != nil || AWSBuckets != "" {
+		t.Errorf("LoadSignEnv set buckets %q, error %v", AWSBuckets, err)
+	}
+	if key, _ := SignKeys(); string(key) != "reloaded-key" {
+		t.Errorf("LoadSignEnv set key %q, want reloaded-key", key)
+	}
+
+	os.Setenv("IMPROXY_MAGIC_NUM", "seven")
+	if err := LoadEnv(); err == nil {
+		t.Errorf("LoadEnv with invalid IMPROXY_MAGIC_NUM did not return an error")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	defer saveConfig()()
+
+	SetSignKeys([]byte("key"), 1)
+	AWSBuckets = "bucket"
+	if err := Validate(); err != nil {
+		t.Errorf("Validate returned error: %v", err)
+	}
+
+	AWSBuckets = ""
+	if err := Validate(); err == nil || !strings.Contains(err.Error(), "aws_buckets") {
+		t.Errorf("Validate returned error %v, want empty aws_buckets", err)
+	}
+
+	// 没有签名的key时不能启动, 否则任何人都可以伪造签名
+	SetSignKeys(nil, 1)
+	if err := Validate(); err == nil || !strings.Contains(err.Error(), "simple_key") {
+		t.Errorf("Validate returned error %v, want empty simple_key", err)
+	}
+}
@@ -0,0 +1,245 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//
+// 统一的配置文件(JSON), 例如: conf/improxy.template.json
+// 没有出现的字段使用DefaultFile中的默认值; 未知的字段视为错误, 避免拼写错误被忽略
+//
+type File struct {
+	Server       ServerConfig       `json:"server"`
+	AWS          AWSConfig          `json:"aws"`
+	Sign         SignConfig         `json:"sign"`
+	Cache        CacheConfig        `json:"cache"`
+	CacheControl CacheControlConfig `json:"cache_control"`
+	Transform    TransformConfig    `json:"transform"`
+	Access       AccessConfig       `json:"access"`
+	Presets      map[string]string  `json:"presets"` // 命名的options, 同presets文件
+	PresetsOnly  bool               `json:"presets_only"`
+	Ready        ReadyConfig        `json:"ready"`
+
+	dir string // 配置文件所在的目录, 相对路径以此为准
+}
+
+type ServerConfig struct {
+	Addr       string   `json:"addr"`
+	LogFile    string   `json:"logfile"`
+	Timeout    Duration `json:"timeout"`
+	Drain      Duration `json:"drain"`
+	DrainDelay Duration `json:"drain_delay"`
+	PathPrefix string   `json:"path_prefix"` // 和cloudfront的回源策略对接时约定的pattern, 例如: tools/im/
+	Favicon    string   `json:"favicon"`     // 相对于配置文件所在的目录
+}
+
+type AWSConfig struct {
+	AccessKeyId     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	Buckets         string `json:"buckets"`
+	DerivedBucket   string `json:"derived_bucket"`
+	Region          string `json:"region"`
+}
+
+type SignConfig struct {
+	SimpleKey string `json:"simple_key"`
+	MagicNum  int64  `json:"magic_num"`
+}
+
+type CacheConfig struct {
+	Tiers                []string `json:"tiers"`  // 同 -cache
+	MaxMB                uint64   `json:"max_mb"` // 磁盘缓存的大小, 0表示不限制
+	HotMB                uint64   `json:"hot_mb"` // 没有内存层时, 磁盘缓存自带的内存缓存的大小
+	OriginTTL            Duration `json:"origin_ttl"`
+	NegativeTTL          Duration `json:"negative_ttl"`
+	StaleWhileRevalidate Duration `json:"stale_while_revalidate"`
+}
+
+type CacheControlConfig struct {
+	MaxAge Duration `json:"max_age"` // 返回给客户端的Cache-Control: max-age
+}
+
+type TransformConfig struct {
+	DefaultQuality int     `json:"default_quality"`
+	MaxUpscale     float64 `json:"max_upscale"`
+}
+
+type AccessConfig struct {
+	Whitelist []string `json:"whitelist"`
+	Referrers []string `json:"referrers"`
+}
+
+type ReadyConfig struct {
+	CanaryKey     string `json:"canary_key"`
+	MinFreeMB     uint64 `json:"min_free_mb"`
+	MaxTransforms int    `json:"max_transforms"`
+}
+
+//
+// 配置文件中的时间, 格式同time.ParseDuration, 例如: "720h", "30s"
+//
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %s", data)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// DefaultFile returns the settings used for the fields missing in a config file.
+func DefaultFile() *File {
+	return &File{
+		Server: ServerConfig{
+			Addr:       "localhost:8080",
+			Drain:      Duration(30 * time.Second),
+			DrainDelay: Duration(10 * time.Second), // 至少为负载均衡的一个health-check间隔
+			PathPrefix: "tools/im/",
+		},
+		Cache: CacheConfig{
+			HotMB: 1024,
+		},
+		CacheControl: CacheControlConfig{
+			MaxAge: Duration(30 * 24 * time.Hour),
+		},
+		Transform: TransformConfig{
+			DefaultQuality: 80,
+			MaxUpscale:     2,
+		},
+		Ready: ReadyConfig{
+			MinFreeMB: 1024,
+		},
+	}
+}
+
+// ReadFile reads and validates the config file at path.
+func ReadFile(path string) (*File, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ParseFile(data)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %v", path, err)
+	}
+	f.dir = filepath.Dir(path)
+	return f, nil
+}
+
+// ParseFile parses and validates the content of a config file.
+func ParseFile(data []byte) (*File, error) {
+	f := DefaultFile()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(f); err != nil {
+		return nil, err
+	}
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Validate checks the values which can't be caught by the JSON decoder.
+func (f *File) Validate() error {
+	prefix := f.Server.PathPrefix
+	if len(prefix) == 0 || strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("server.path_prefix %q must be like \"tools/im/\"", prefix)
+	}
+	durations := map[string]Duration{
+		"server.timeout":               f.Server.Timeout,
+		"server.drain":                 f.Server.Drain,
+		"server.drain_delay":           f.Server.DrainDelay,
+		"cache.origin_ttl":             f.Cache.OriginTTL,
+		"cache.negative_ttl":           f.Cache.NegativeTTL,
+		"cache.stale_while_revalidate": f.Cache.StaleWhileRevalidate,
+		"cache_control.max_age":        f.CacheControl.MaxAge,
+	}
+	for name, d := range durations {
+		if d < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	if q := f.Transform.DefaultQuality; q < 1 || q > 100 {
+		return fmt.Errorf("transform.default_quality %d must be in [1, 100]", q)
+	}
+	if f.Transform.MaxUpscale < 1 {
+		return errors.New("transform.max_upscale must be at least 1")
+	}
+	if f.Ready.MaxTransforms < 0 {
+		return errors.New("ready.max_transforms must not be negative")
+	}
+	for _, tier := range f.Cache.Tiers {
+		if strings.Contains(tier, ",") {
+			return fmt.Errorf("cache.tiers: %q must be one tier per entry", tier)
+		}
+	}
+	return nil
+}
+
+// RestartRequired reports whether other has changes which can't be applied by a reload.
+// 可以通过SIGHUP在线修改的配置: access, presets, presets_only, cache_control, sign
+func (f *File) RestartRequired(other *File) bool {
+	a, b := *f, *other
+	a.Access, b.Access = AccessConfig{}, AccessConfig{}
+	a.Presets, b.Presets = nil, nil
+	a.PresetsOnly, b.PresetsOnly = false, false
+	a.CacheControl, b.CacheControl = CacheControlConfig{}, CacheControlConfig{}
+	a.Sign, b.Sign = SignConfig{}, SignConfig{}
+
+	left, _ := json.Marshal(&a)
+	right, _ := json.Marshal(&b)
+	return !bytes.Equal(left, right)
+}
+
+// Apply sets the AWS settings, the favicon and the signing keys; empty values
+// keep those loaded before.
+func (f *File) Apply() {
+	setIfNotEmpty(&AwsAccessKeyId, f.AWS.AccessKeyId)
+	setIfNotEmpty(&AwsSecretAccessKey, f.AWS.SecretAccessKey)
+	setIfNotEmpty(&AWSBuckets, f.AWS.Buckets)
+	setIfNotEmpty(&AWSDerivedBucket, f.AWS.DerivedBucket)
+	setIfNotEmpty(&AwsRegion, f.AWS.Region)
+	if favicon := f.Server.Favicon; len(favicon) > 0 {
+		if !filepath.IsAbs(favicon) {
+			favicon = filepath.Join(f.dir, favicon)
+		}
+		FaviconPath = favicon
+	}
+	f.ApplySign()
+}
+
+// ApplySign sets the signing keys; called on reload.
+func (f *File) ApplySign() {
+	key, magic := SignKeys()
+	if len(f.Sign.SimpleKey) > 0 {
+		key = []byte(f.Sign.SimpleKey)
+	}
+	if f.Sign.MagicNum != 0 {
+		magic = f.Sign.MagicNum
+	}
+	SetSignKeys(key, magic)
+}
+
+func setIfNotEmpty(dst *string, value string) {
+	if len(value) > 0 {
+		*dst = value
+	}
+}
@@ -0,0 +1,92 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFile_Template(t *testing.T) {
+	f, err := ReadFile("../conf/improxy.template.json")
+	if err != nil {
+		t.Fatalf("ReadFile returned error: %v", err)
+	}
+	if got, want := f.Cache.Tiers, []string{"memory:512", "/data/tmp_improxy/cache"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cache.tiers = %q, want %q", got, want)
+	}
+	if got := time.Duration(f.CacheControl.MaxAge); got != 720*time.Hour {
+		t.Errorf("cache_control.max_age = %v, want 720h", got)
+	}
+	if got := f.Presets["avatar_small"]; got != "200x200,q80" {
+		t.Errorf("presets.avatar_small = %q", got)
+	}
+}
+
+func TestParseFile_Defaults(t *testing.T) {
+	f, err := ParseFile([]byte(`{"server": {"addr": ":9090"}}`))
+	if err != nil {
+		t.Fatalf("ParseFile returned error: %v", err)
+	}
+	want := DefaultFile()
+	want.Server.Addr = ":9090"
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("ParseFile returned %+v, want %+v", f, want)
+	}
+}
+
+func TestParseFile_Invalid(t *testing.T) {
+	tests := []struct {
+		data string
+		err  string
+	}{
+		{`{"server": {"adr": ":9090"}}`, "unknown field"},
+		{`{"server": {"timeout": 30}}`, "duration"},
+		{`{"server": {"timeout": "30 seconds"}}`, "duration"},
+		{`{"server": {"drain": "-1s"}}`, "server.drain"},
+		{`{"server": {"path_prefix": "/tools/im/"}}`, "path_prefix"},
+		{`{"transform": {"default_quality": 101}}`, "default_quality"},
+		{`{"transform": {"max_upscale": 0.5}}`, "max_upscale"},
+		{`{"cache": {"tiers": ["memory,/data"]}}`, "cache.tiers"},
+		{`{"ready": {"max_transforms": -1}}`, "max_transforms"},
+	}
+	for _, tt := range tests {
+		_, err := ParseFile([]byte(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("ParseFile(%s) returned error %v, want %q", tt.data, err, tt.err)
+		}
+	}
+}
+
+func TestFile_RestartRequired(t *testing.T) {
+	old := DefaultFile()
+
+	live := DefaultFile()
+	live.Access.Whitelist = []string{"a.test"}
+	live.Presets = map[string]string{"small": "100x"}
+	live.PresetsOnly = true
+	live.CacheControl.MaxAge = Duration(time.Hour)
+	live.Sign.SimpleKey = "new"
+	if old.RestartRequired(live) {
+		t.Errorf("RestartRequired() = true for live settings")
+	}
+
+	restart := DefaultFile()
+	restart.Cache.Tiers = []string{"memory"}
+	if !old.RestartRequired(restart) {
+		t.Errorf("RestartRequired() = false for cache tiers")
+	}
+}
+
+func TestFile_ApplySign(t *testing.T) {
+	key, magic := SignKeys()
+	defer SetSignKeys(key, magic)
+
+	SetSignKeys([]byte("old"), 1)
+	f := DefaultFile()
+	f.Sign.SimpleKey = "new"
+	f.ApplySign()
+	if key, magic := SignKeys(); string(key) != "new" || magic != 1 {
+		t.Errorf("SignKeys() = %q, %d, want new, 1", key, magic)
+	}
+}
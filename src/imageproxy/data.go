@@ -18,6 +18,7 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/wfxiang08/cyutils/utils/errors"
+	"math"
 	"media_utils"
 	"net/http"
 	"net/url"
@@ -35,9 +36,26 @@ const (
 	optFormatPrefix = "f"
 	optSizeDelimiter = "x"
 	optSizeDelimiter2 = "*"
+	optDPRPrefix = "dpr"
+	optUpscale = "up"
+	optLQIP = "lqip"
+)
+
+var (
+	// tools/im/ 是和cloudfront的回源策略对接时约定的pattern, 可以通过SetPathPrefix修改
 	kCloudFrontPattern = "tools/im/"
 )
 
+// SetPathPrefix changes the path prefix agreed with cloudfront, "tools/im/" by
+// default, together with the paths of the tools under it. Call it before
+// serving requests.
+func SetPathPrefix(prefix string) {
+	kCloudFrontPattern = prefix
+	kStatsPath = "/" + prefix + "_stats"
+	kUploadPath = "/" + prefix + "_upload"
+	PURGE_PATH_PREFIX = "/" + prefix + "_purge/"
+}
+
 // URL错误
 type URLError struct {
 	Message string
@@ -68,6 +86,15 @@ type Options struct {
 	FlipHorizontal bool
 	Quality        int    // Quality of output image
 	Format         string // 强制定制格式
+
+	                      // Device pixel ratio, 绝对像素值的Width/Height会乘以DPR
+	DPR            float64
+
+	                      // 允许放大图片, 放大倍数受MaxUpscale限制
+	Upscale        bool
+
+	                      // 返回一个很小的图片的data URI, 用于渐进式加载
+	LQIP           bool
 }
 
 func (o Options) String() string {
@@ -76,6 +103,12 @@ func (o Options) String() string {
 	if o.Fit {
 		fmt.Fprintf(buf, ",%s", optFit)
 	}
+	if o.DPR != 0 {
+		fmt.Fprintf(buf, ",%s%v", optDPRPrefix, o.DPR)
+	}
+	if o.Upscale {
+		fmt.Fprintf(buf, ",%s", optUpscale)
+	}
 	if o.Rotate != 0 {
 		fmt.Fprintf(buf, ",%s%d", string(optRotatePrefix), o.Rotate)
 	}
@@ -92,6 +125,9 @@ func (o Options) String() string {
 	if len(o.Format) > 0 {
 		fmt.Fprintf(buf, ",%s%s", optFormatPrefix, o.Format)
 	}
+	if o.LQIP {
+		fmt.Fprintf(buf, ",%s", optLQIP)
+	}
 	result := buf.String()
 	if result == "0x0" {
 		return ""
@@ -147,11 +183,27 @@ func (o Options) transform() bool {
 // The "fv" option will flip the image vertically. The "fh" option will flip
 // the image horizontally. Images are flipped after being rotated.
 //
+// Device Pixel Ratio and Upscaling
+//
+// The "dpr{ratio}" option multiplies absolute width and height values by the
+// given ratio, so clients can request "100x100,dpr2" instead of computing
+// 200x200 themselves. Percentage values are not affected. Ratios larger than
+// MaxDPR are clamped to it; invalid ratios (NaN, Inf, <= 0) are ignored.
+//
+// By default an image is never enlarged beyond its original size. The "up"
+// option allows upscaling, up to MaxUpscale times the original dimensions.
+//
 // Quality
 //
 // The "q{qualityPercentage}" option can be used to specify the quality of the
 // output file (JPEG only)
 //
+// Placeholders
+//
+// The "fblurhash" option returns the BlurHash string of the image instead of
+// the image itself. The "lqip" option returns a data URI of a tiny (20 pixels)
+// version of the image, encoded in the requested format (jpeg by default).
+//
 // Examples
 //
 // 	0x0       - no resizing
@@ -164,6 +216,8 @@ func (o Options) transform() bool {
 // 	100,r90   - 100 pixels square, rotated 90 degrees
 // 	100,fv,fh - 100 pixels square, flipped horizontal and vertical
 // 	200x,q80  - 200 pixels wide, proportional height, 80% quality
+// 	100,dpr2  - 200 pixels square, cropping as needed
+// 	400x,up   - 400 pixels wide, enlarging the original if needed
 func ParseOptions(str string, useWebp bool) Options {
 	var options Options
 
@@ -177,6 +231,14 @@ func ParseOptions(str string, useWebp bool) Options {
 			options.FlipVertical = true
 		case opt == optFlipHorizontal:
 			options.FlipHorizontal = true
+		case opt == optUpscale:
+			options.Upscale = true
+		case opt == optLQIP:
+			options.LQIP = true
+
+		case strings.HasPrefix(opt, optDPRPrefix):
+			value := strings.TrimPrefix(opt, optDPRPrefix)
+			options.DPR = parseDPR(value)
 
 		case strings.HasPrefix(opt, optRotatePrefix):
 			value := strings.TrimPrefix(opt, optRotatePrefix)
@@ -220,12 +282,25 @@ func ParseOptions(str string, useWebp bool) Options {
 	return options
 }
 
+// parseDPR 解析dpr, 无效的值(NaN, Inf, <= 0)返回0表示没有指定, 超过MaxDPR时使用MaxDPR
+func parseDPR(value string) float64 {
+	dpr, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(dpr) || math.IsInf(dpr, 0) || dpr <= 0 {
+		return 0
+	}
+	if dpr > MaxDPR {
+		return MaxDPR
+	}
+	return dpr
+}
+
 // Request is an imageproxy request which includes a remote URL of an image to
 // proxy, and an optional set of transformations to perform.
 type Request struct {
 	URL      *url.URL      // URL of the image to proxy
 	Options  Options       // Image transformation to perform
 	Original *http.Request // The original HTTP request
+	Info     bool          // 返回原始图片的meta信息, 而不是图片本身
 }
 
 // String returns the request URL as a string, with r.Options encoded in the
@@ -234,11 +309,18 @@ func (r Request) String() string {
 	u := *r.URL
 
 	// 在这里: Fragment被复用起来了
-	u.Fragment = r.Options.String()
+	if r.Info {
+		u.Fragment = optInfo
+	} else {
+		u.Fragment = r.Options.String()
+	}
 	return u.String()
 }
 
-func NewRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
+// NewRequest parses an http.Request into an imageproxy Request. Preset
+// references ("p:{name}") in the options are resolved using presets, which may
+// be nil.
+func NewRequest(r *http.Request, baseURL *url.URL, presets *Presets) (*Request, error) {
 
 	var err error
 	req := &Request{Original: r}
@@ -278,7 +360,8 @@ func NewRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
 
 	useWebp := HasWebpSupport(r)
 
-	if err != nil || !req.URL.IsAbs() {
+	// p:avatar_small/... 也会被解析为绝对URL(scheme为p)
+	if err != nil || !req.URL.IsAbs() || strings.HasPrefix(path, optPresetPrefix) {
 		// first segment should be options
 		parts := strings.SplitN(path, "/", 2)
 		if len(parts) != 2 {
@@ -291,7 +374,17 @@ func NewRequest(r *http.Request, baseURL *url.URL) (*Request, error) {
 			return nil, URLError{fmt.Sprintf("unable to parse remote URL: %v", err), r.URL}
 		}
 
-		req.Options = ParseOptions(parts[0], useWebp)
+		if parts[0] == optInfo {
+			// /tools/im/_info/{key}
+			req.Info = true
+		} else {
+			// 展开preset
+			options, err := presets.Expand(parts[0])
+			if err != nil {
+				return nil, URLError{err.Error(), r.URL}
+			}
+			req.Options = ParseOptions(options, useWebp)
+		}
 	} else {
 		// 如果支持webp, 则特殊考虑
 		if useWebp {
@@ -11,7 +11,7 @@ import (
 
 var emptyOptions = Options{}
 
-// Width, Height, Fit, Rotate, FlipVertical, FlipHorizontal, Quality, Format
+// Width, Height, Fit, Rotate, FlipVertical, FlipHorizontal, Quality, Format, DPR, Upscale, LQIP
 // go test imageproxy -v -run "TestOptionsToString"
 func TestOptionsToString(t *testing.T) {
 	fmt.Printf("TestOptionsToString\n")
@@ -24,13 +24,25 @@ func TestOptionsToString(t *testing.T) {
 			"",
 		},
 		{
-			Options{1, 2, true, 90, true, true, 80, ""},
+			Options{1, 2, true, 90, true, true, 80, "", 0, false, false},
 			"1x2,fit,r90,fv,fh,q80",
 		},
 		{
-			Options{0.15, 1.3, false, 45, false, false, 95, ""},
+			Options{0.15, 1.3, false, 45, false, false, 95, "", 0, false, false},
 			"0.15x1.3,r45,q95",
 		},
+		{
+			Options{100, 100, true, 0, false, false, 0, "", 2, true, false},
+			"100x100,fit,dpr2,up",
+		},
+		{
+			Options{100, 0, false, 0, false, false, 0, "", 1.5, false, false},
+			"100x0,dpr1.5",
+		},
+		{
+			Options{0, 0, false, 0, false, false, 0, "webp", 0, false, true},
+			"0x0,fwebp,lqip",
+		},
 	}
 
 	for i, tt := range tests {
@@ -97,6 +109,18 @@ func TestParseOptions(t *testing.T) {
 		{"r90", Options{Rotate: 90}},
 		{"fv", Options{FlipVertical: true}},
 		{"fh", Options{FlipHorizontal: true}},
+		{"up", Options{Upscale: true}},
+		{"dpr2", Options{DPR: 2}},
+		{"dpr1.5", Options{DPR: 1.5}},
+		{"dprx", emptyOptions},
+		{"dprNaN", emptyOptions},
+		{"dpr+Inf", emptyOptions},
+		{"dpr0", emptyOptions},
+		{"dpr-2", emptyOptions},
+		{"dpr10", Options{DPR: 4}},
+		{"dpr1e300", Options{DPR: 4}},
+		{"lqip", Options{LQIP: true}},
+		{"fblurhash", Options{Format: "blurhash"}},
 
 		// duplicate flags (last one wins)
 		{"1x2,3x4", Options{Width: 3, Height: 4}},
@@ -109,10 +133,11 @@ func TestParseOptions(t *testing.T) {
 		{"FOO,1,BAR,r90,BAZ", Options{Width: 1, Height: 1, Rotate: 90}},
 
 		// all flags, in different orders
-		{"q70,1x2,fit,r90,fv,fh", Options{1, 2, true, 90, true, true, 70, ""}},
+		{"q70,1x2,fit,r90,fv,fh", Options{1, 2, true, 90, true, true, 70, "", 0, false, false}},
+		{"100x50,dpr3,up", Options{Width: 100, Height: 50, DPR: 3, Upscale: true}},
 
-		// // Width, Height, Fit, Rotate, FlipVertical, FlipHorizontal, Quality, Format
-		{"r90,fh,q90,1x2,fv,fit", Options{1, 2, true, 90, true, true, 90, ""}},
+		// // Width, Height, Fit, Rotate, FlipVertical, FlipHorizontal, Quality, Format, DPR, Upscale, LQIP
+		{"r90,fh,q90,1x2,fv,fit", Options{1, 2, true, 90, true, true, 90, "", 0, false, false}},
 	}
 
 	for _, tt := range tests {
@@ -181,7 +206,7 @@ func TestNewRequest(t *testing.T) {
 			continue
 		}
 
-		r, err := NewRequest(req, awsUrl)
+		r, err := NewRequest(req, awsUrl, nil)
 		if tt.ExpectError {
 			if err == nil {
 				t.Errorf("NewRequest(%v) did not return expected error", req)
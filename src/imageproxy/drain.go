@@ -0,0 +1,106 @@
+package imageproxy
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// 正在处理的请求, 退出时超过drain的期限的请求会被放弃, 需要记录下来
+//
+type InFlightRequest struct {
+	Method  string        `json:"method"`
+	URL     string        `json:"url"`
+	Elapsed time.Duration `json:"elapsed"`
+}
+
+type inflightRequest struct {
+	method string
+	url    string
+	start  time.Time
+}
+
+type inflightRequests struct {
+	sync.Mutex
+	next     uint64
+	requests map[uint64]inflightRequest
+}
+
+//
+// 记录请求r, 返回的函数在请求结束时调用
+//
+func (s *inflightRequests) track(r *http.Request) func() {
+	s.Lock()
+	if s.requests == nil {
+		s.requests = make(map[uint64]inflightRequest)
+	}
+	s.next++
+	id := s.next
+	s.requests[id] = inflightRequest{method: r.Method, url: r.URL.String(), start: time.Now()}
+	s.Unlock()
+
+	return func() {
+		s.Lock()
+		delete(s.requests, id)
+		s.Unlock()
+	}
+}
+
+func (s *inflightRequests) list() []InFlightRequest {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	result := make([]InFlightRequest, 0, len(s.requests))
+	for _, req := range s.requests {
+		result = append(result, InFlightRequest{Method: req.method, URL: req.url, Elapsed: now.Sub(req.start)})
+	}
+	// 时间最长的排在前面
+	sort.Slice(result, func(i, j int) bool { return result[i].Elapsed > result[j].Elapsed })
+	return result
+}
+
+// StartDraining marks the proxy as shutting down: /health-check fails from now
+// on so that the load balancer stops sending new requests.
+func (p *Proxy) StartDraining() {
+	atomic.StoreInt32(&p.draining, 1)
+}
+
+// Draining reports whether StartDraining has been called.
+func (p *Proxy) Draining() bool {
+	return atomic.LoadInt32(&p.draining) == 1
+}
+
+// InFlight returns the requests currently being served, longest running first.
+func (p *Proxy) InFlight() []InFlightRequest {
+	return p.inflight.list()
+}
+
+// WaitIdle blocks until all the requests, background revalidations and
+// variant uploads are done, or ctx is done.
+func (p *Proxy) WaitIdle(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		if p.Wg != nil {
+			p.Wg.Wait()
+		}
+		if p.cacheTransport != nil {
+			p.cacheTransport.Wait()
+		}
+		if p.transformer != nil {
+			p.transformer.Wait()
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,79 @@
+package imageproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProxy_HealthCheckDraining(t *testing.T) {
+	p := NewProxy(nil, nil, &sync.WaitGroup{})
+
+	check := func() int {
+		req := httptest.NewRequest("GET", "/health-check", nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+		return resp.Code
+	}
+
+	if got := check(); got != http.StatusOK {
+		t.Errorf("health-check returned %d, want %d", got, http.StatusOK)
+	}
+	p.StartDraining()
+	if !p.Draining() {
+		t.Errorf("Draining() = false after StartDraining")
+	}
+	if got := check(); got != http.StatusServiceUnavailable {
+		t.Errorf("health-check returned %d while draining, want %d", got, http.StatusServiceUnavailable)
+	}
+}
+
+func TestProxy_InFlight(t *testing.T) {
+	p := NewProxy(nil, nil, &sync.WaitGroup{})
+
+	first := p.inflight.track(httptest.NewRequest("GET", "/tools/im/100/a.png", nil))
+	time.Sleep(time.Millisecond)
+	second := p.inflight.track(httptest.NewRequest("HEAD", "/tools/im/200/b.png", nil))
+
+	requests := p.InFlight()
+	if len(requests) != 2 {
+		t.Fatalf("InFlight() returned %d requests, want 2", len(requests))
+	}
+	if requests[0].URL != "/tools/im/100/a.png" || requests[1].Method != "HEAD" {
+		t.Errorf("InFlight() = %+v, want longest running first", requests)
+	}
+
+	first()
+	second()
+	if requests := p.InFlight(); len(requests) != 0 {
+		t.Errorf("InFlight() = %+v after requests finished", requests)
+	}
+}
+
+func TestProxy_WaitIdle(t *testing.T) {
+	wg := &sync.WaitGroup{}
+	p := NewProxy(nil, nil, wg)
+
+	if err := p.WaitIdle(context.Background()); err != nil {
+		t.Errorf("WaitIdle() returned error when idle: %v", err)
+	}
+
+	// 请求没有结束, 超过期限
+	wg.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := p.WaitIdle(ctx); err != context.DeadlineExceeded {
+		t.Errorf("WaitIdle() returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// 请求在期限之内结束
+	time.AfterFunc(10*time.Millisecond, wg.Done)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.WaitIdle(ctx); err != nil {
+		t.Errorf("WaitIdle() returned error: %v", err)
+	}
+}
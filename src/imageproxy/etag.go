@@ -0,0 +1,74 @@
+package imageproxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+//
+// 输出内容的ETag: 基于输出的数据计算(strong), 不同尺寸/格式的图片拥有不同的ETag
+// 原始图片的ETag(来自S3或者源站)不能直接用于处理之后的图片
+//
+func outputETag(body []byte) string {
+	return `"` + fileMD5(body) + `"`
+}
+
+//
+// 将headers(格式同ImageWithMeta.Headers)中的ETag替换为etag
+//
+func replaceETag(headers []byte, etag string) []byte {
+	return replaceHeader(headers, "Etag", etag)
+}
+
+//
+// 解析If-None-Match中的entity-tag列表, 例如: "a", W/"b"
+// 格式错误时停止解析, 返回已经解析的部分
+//
+func parseETagList(header string) []string {
+	var etags []string
+	s := header
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if len(s) == 0 {
+			return etags
+		}
+		start := 0
+		if strings.HasPrefix(s, "W/") {
+			start = 2
+		}
+		if len(s) <= start || s[start] != '"' {
+			return etags
+		}
+		end := strings.IndexByte(s[start+1:], '"')
+		if end < 0 {
+			return etags
+		}
+		end += start + 2
+		etags = append(etags, s[:end])
+		s = s[end:]
+	}
+}
+
+//
+// weak comparison(RFC 7232 2.3.2): 忽略W/前缀, 比较opaque-tag
+//
+func etagWeakMatch(a, b string) bool {
+	a, b = strings.TrimPrefix(a, "W/"), strings.TrimPrefix(b, "W/")
+	return len(a) > 0 && a == b
+}
+
+//
+// If-None-Match是否匹配当前的ETag; "*" 匹配任意存在的资源
+//
+func ifNoneMatch(req *http.Request, etag string) bool {
+	header := strings.Join(req.Header["If-None-Match"], ",")
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range parseETagList(header) {
+		if etagWeakMatch(candidate, etag) {
+			return true
+		}
+	}
+	return false
+}
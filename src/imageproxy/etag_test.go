@@ -0,0 +1,63 @@
+package imageproxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseETagList(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{``, nil},
+		{`"a"`, []string{`"a"`}},
+		{`"a", W/"b" ,"c,d"`, []string{`"a"`, `W/"b"`, `"c,d"`}},
+		{`"a", b`, []string{`"a"`}},
+		{`"a`, nil},
+	}
+	for _, tt := range tests {
+		if got := parseETagList(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseETagList(%q) returned %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestReplaceETag(t *testing.T) {
+	headers := []byte("Last-Modified: Sat, 01 Jan 2000 00:00:00 GMT\nETag: \"origin\"\nCache-Control: max-age=10\n")
+	got := string(replaceETag(headers, `"v"`))
+	want := "Last-Modified: Sat, 01 Jan 2000 00:00:00 GMT\nCache-Control: max-age=10\nEtag: \"v\"\n"
+	if got != want {
+		t.Errorf("replaceETag returned %q, want %q", got, want)
+	}
+
+	if got := string(replaceETag(nil, `"v"`)); got != "Etag: \"v\"\n" {
+		t.Errorf("replaceETag(nil) returned %q", got)
+	}
+}
+
+func TestImageDataToHttpResponse_ETag(t *testing.T) {
+	// 同一个原图的不同尺寸, 继承了原图的ETag
+	headers := []byte("ETag: \"origin\"\n")
+	small, _ := ImageDataToHttpResponse(&ImageWithMeta{Headers: headers, Image: testPNG(10)}, "image/png", nil)
+	large, _ := ImageDataToHttpResponse(&ImageWithMeta{Headers: headers, Image: testPNG(20)}, "image/png", nil)
+
+	smallETag, largeETag := small.Header.Get("Etag"), large.Header.Get("Etag")
+	if smallETag == `"origin"` || largeETag == `"origin"` {
+		t.Errorf("resized output inherited origin etag: %q, %q", smallETag, largeETag)
+	}
+	if smallETag == largeETag {
+		t.Errorf("different outputs share etag %q", smallETag)
+	}
+	if want := outputETag(testPNG(10)); smallETag != want {
+		t.Errorf("etag = %q, want %q", smallETag, want)
+	}
+	if got := len(small.Header["Etag"]); got != 1 {
+		t.Errorf("got %d Etag headers, want 1", got)
+	}
+
+	info, _ := JSONDataToHttpResponse(map[string]int{"width": 10}, headers, nil)
+	if etag := info.Header.Get("Etag"); etag == `"origin"` || etag == smallETag {
+		t.Errorf("json etag = %q", etag)
+	}
+}
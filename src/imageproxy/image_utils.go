@@ -8,16 +8,41 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"io/ioutil"
+	"math"
 	"net/http"
 	"strings"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 const (
 	HTTP_HEADERS_BODY_SEP = "\r\n"
 )
 
+// 返回给客户端的Cache-Control: max-age, 默认1个月; 可以在线修改
+var cacheMaxAge = int64(30 * 24 * time.Hour)
+
+// SetCacheMaxAge sets the max-age of the images sent to the clients. It's
+// safe to call while serving requests.
+func SetCacheMaxAge(maxAge time.Duration) {
+	atomic.StoreInt64(&cacheMaxAge, int64(maxAge))
+}
+
+// CacheMaxAge returns the max-age of the images sent to the clients.
+func CacheMaxAge() time.Duration {
+	return time.Duration(atomic.LoadInt64(&cacheMaxAge))
+}
+
+func cacheControlHeader() string {
+	return fmt.Sprintf("max-age=%d", int64(CacheMaxAge()/time.Second))
+}
+
 //
 // 文件的MD5
 //
@@ -51,7 +76,7 @@ func FileContentType(format string) string {
 	// 默认的encoding
 	contentType := ""
 
-	// 支持: png, jpeg, gif, webp
+	// 支持: png, jpeg, gif, webp, 以及blurhash
 	switch format {
 	case media_utils.ImageFormatJpeg:
 		fallthrough
@@ -63,6 +88,8 @@ func FileContentType(format string) string {
 		contentType = media_utils.ContentTypePNG
 	case media_utils.ImageFormatWebp:
 		contentType = media_utils.ContentTypeWebp
+	case formatBlurHash:
+		contentType = media_utils.ContentTypeText
 	}
 
 	return contentType
@@ -74,35 +101,207 @@ func FileContentType(format string) string {
 type ImageWithMeta struct {
 	Headers []byte // 包含了各种缓存相关的headers, 例如: etag, last-modified, cache-control, expires 等
 	Image   []byte
+
+	Key         string    // 缓存的key, 用于检查数据是否被写到了错误的位置
+	Created     time.Time // 缓存的创建时间
+	ContentType string
 }
 
+// Header returns the value of the cache header name, or "" if it is not present
+func (this *ImageWithMeta) Header(name string) string {
+	for _, line := range strings.Split(string(this.Headers), "\n") {
+		if i := strings.Index(line, ":"); i > 0 && strings.EqualFold(strings.TrimSpace(line[:i]), name) {
+			return strings.TrimSpace(line[i+1:])
+		}
+	}
+	return ""
+}
+
+const (
+	imageWithMetaMagic   = "IMWM"
+	imageWithMetaVersion = 1
+)
+
+var (
+	ErrImageWithMetaTruncated = errors.New("image cache: truncated data")
+	ErrImageWithMetaChecksum  = errors.New("image cache: checksum mismatch")
+	ErrImageWithMetaVersion   = errors.New("image cache: unsupported version")
+)
+
+//
+// Cache中的Image缓存格式(v1), 整数都是big endian:
+//   magic("IMWM") version(uint8)
+//   key_length(uint16)           key
+//   created(int64, unix纳秒)
+//   content_type_length(uint8)   content_type
+//   header_length(uint32)        header_data
+//   image_length(uint32)         image_data
+//   crc32(uint32, IEEE, 之前所有的数据)
 //
-// Cache中的Image缓存格式：
-//   header_length(big_endian_unit16t)
-//   header_data
-//   image_data
+// 旧的格式(没有magic): header_length(uint16) header_data image_data
 //
 func (this *ImageWithMeta) Bytes() []byte {
 	buf := new(bytes.Buffer)
+	buf.WriteString(imageWithMetaMagic)
+	buf.WriteByte(imageWithMetaVersion)
+
+	key := this.Key
+	if len(key) > math.MaxUint16 {
+		key = key[:math.MaxUint16]
+	}
+	binary.Write(buf, binary.BigEndian, uint16(len(key)))
+	buf.WriteString(key)
+
+	binary.Write(buf, binary.BigEndian, this.Created.UnixNano())
 
-	lengthBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(lengthBytes, uint16(len(this.Headers)))
-	buf.Write(lengthBytes)
+	contentType := this.ContentType
+	if len(contentType) > math.MaxUint8 {
+		contentType = ""
+	}
+	buf.WriteByte(uint8(len(contentType)))
+	buf.WriteString(contentType)
+
+	binary.Write(buf, binary.BigEndian, uint32(len(this.Headers)))
 	buf.Write(this.Headers)
+	binary.Write(buf, binary.BigEndian, uint32(len(this.Image)))
 	buf.Write(this.Image)
+
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
 	return buf.Bytes()
 }
 
 //
-// 将ImageCache解析成为 headers和img
+// 将ImageCache解析成为 headers和img; 数据不完整或者校验失败时返回错误
 //
-func NewImageWithMetaFromCache(data []byte) *ImageWithMeta {
-	headLength := binary.BigEndian.Uint16(data[0:2])
+func NewImageWithMetaFromCache(data []byte) (*ImageWithMeta, error) {
+	if !bytes.HasPrefix(data, []byte(imageWithMetaMagic)) {
+		return parseLegacyImageWithMeta(data)
+	}
+
+	if len(data) < len(imageWithMetaMagic)+1+4 {
+		return nil, ErrImageWithMetaTruncated
+	}
+	if data[len(imageWithMetaMagic)] != imageWithMetaVersion {
+		return nil, ErrImageWithMetaVersion
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, ErrImageWithMetaChecksum
+	}
+
+	r := &byteReader{data: body[len(imageWithMetaMagic)+1:]}
+	result := &ImageWithMeta{}
+	result.Key = string(r.next(int(r.uint16())))
+	result.Created = time.Unix(0, int64(r.uint64()))
+	result.ContentType = string(r.next(int(r.uint8())))
+	result.Headers = r.next(int(r.uint32()))
+	result.Image = r.next(int(r.uint32()))
+	if r.err != nil || len(r.data) != 0 {
+		return nil, ErrImageWithMetaTruncated
+	}
+	return result, nil
+}
+
+func parseLegacyImageWithMeta(data []byte) (*ImageWithMeta, error) {
+	if len(data) < 2 {
+		return nil, ErrImageWithMetaTruncated
+	}
+	headLength := int(binary.BigEndian.Uint16(data[0:2]))
+	if 2+headLength > len(data) {
+		return nil, ErrImageWithMetaTruncated
+	}
 
 	return &ImageWithMeta{
 		Headers: data[2:(2 + headLength)],
 		Image:   data[(2 + headLength):],
+	}, nil
+}
+
+// 按顺序读取数据, 数据不够时设置err
+type byteReader struct {
+	data []byte
+	err  error
+}
+
+func (r *byteReader) next(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = ErrImageWithMetaTruncated
+		return nil
+	}
+	result := r.data[:n]
+	r.data = r.data[n:]
+	return result
+}
+
+func (r *byteReader) uint8() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
 	}
+	return 0
+}
+
+func (r *byteReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *byteReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *byteReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+//
+// 检查缓存中的数据是否完整, 缓存中有三类数据:
+//   1. cache.Transport缓存的http response(以"HTTP/"开头)
+//   2. VariantIndex的索引(文本)
+//   3. ImageWithMeta(原始图片)
+//
+func VerifyCacheEntry(data []byte) error {
+	if bytes.HasPrefix(data, []byte("HTTP/")) {
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), nil)
+		if err != nil {
+			return err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.ContentLength >= 0 && int64(len(body)) != resp.ContentLength {
+			return fmt.Errorf("body length %d, want %d", len(body), resp.ContentLength)
+		}
+		return nil
+	}
+
+	// ImageWithMeta以magic开头(旧的格式header长度一般小于256, 第一个字节为0); 文本则一定不包含0
+	isMeta := bytes.HasPrefix(data, []byte(imageWithMetaMagic))
+	if !isMeta && bytes.IndexByte(data, 0) < 0 && utf8.Valid(data) {
+		return nil
+	}
+
+	meta, err := NewImageWithMetaFromCache(data)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(meta.Headers)), "\n") {
+		if len(line) > 0 && !strings.Contains(line, ":") {
+			return fmt.Errorf("invalid header: %q", line)
+		}
+	}
+	if _, _, err := image.Decode(bytes.NewReader(meta.Image)); err != nil {
+		return fmt.Errorf("invalid image: %v", err)
+	}
+	return nil
 }
 
 //
@@ -118,7 +317,26 @@ func ParseHeadersFromResponse(res *http.Response) []byte {
 		}
 	}
 
-	fmt.Fprintf(buf, "Cache-Control: max-age=%d\n", 2592000) // 1个月的有效期
+	fmt.Fprintf(buf, "Cache-Control: %s\n", cacheControlHeader())
+	return buf.Bytes()
+}
+
+//
+// 将headers(格式同ImageWithMeta.Headers)中的key替换为value
+//
+func replaceHeader(headers []byte, key, value string) []byte {
+	buf := new(bytes.Buffer)
+	for _, line := range bytes.SplitAfter(headers, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if i := bytes.IndexByte(line, ':'); i > 0 &&
+			strings.EqualFold(strings.TrimSpace(string(line[:i])), key) {
+			continue
+		}
+		buf.Write(line)
+	}
+	fmt.Fprintf(buf, "%s: %s\n", key, value)
 	return buf.Bytes()
 }
 
@@ -133,8 +351,10 @@ func ImageDataToHttpResponse(imageWithMeta *ImageWithMeta, contentType string, r
 	fmt.Fprintf(buf, "%s %s OK\n", "HTTP/1.0", "200")
 	fmt.Fprintf(buf, "Content-Type: %s\n", contentType)
 	fmt.Fprintf(buf, "Date: %s\n", time.Now().Format(http.TimeFormat ))
-	fmt.Fprintf(buf, "Expires: %s\n", time.Now().AddDate(0, 1, 0).Format(http.TimeFormat)) // 1个月的有效期
-	buf.Write(imageWithMeta.Headers)
+	fmt.Fprintf(buf, "Expires: %s\n", time.Now().Add(CacheMaxAge()).Format(http.TimeFormat))
+	// 不同的尺寸/格式对应不同的数据, ETag由输出的数据决定; Cache-Control以当前的配置为准
+	headers := replaceHeader(imageWithMeta.Headers, "Cache-Control", cacheControlHeader())
+	buf.Write(replaceETag(headers, outputETag(imageWithMeta.Image)))
 	fmt.Fprintf(buf, "Content-Length: %d\n", len(imageWithMeta.Image))
 	fmt.Fprintf(buf, "Vary: Accept\n")
 
@@ -149,32 +369,51 @@ func ImageDataToHttpResponse(imageWithMeta *ImageWithMeta, contentType string, r
 
 //
 // 以JSON格式返回 v 中的数据
+// headers为缓存相关的headers(格式同ImageWithMeta.Headers), 为空时不允许缓存
 //
-func JSONDataToHttpResponse(v interface{}, req *http.Request) (*http.Response, error) {
+func JSONDataToHttpResponse(v interface{}, headers []byte, req *http.Request) (*http.Response, error) {
+
+	resultJson, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
 
 	jsonBuffer := new(bytes.Buffer)
 	fmt.Fprintf(jsonBuffer, "%s %s OK\n", "HTTP/1.0", "200")
 	fmt.Fprintf(jsonBuffer, "Content-Type:application/json\n")
 	fmt.Fprintf(jsonBuffer, "Date:%s\n", time.Now().Format(http.TimeFormat))
-	fmt.Fprintf(jsonBuffer, "Cache-Control:no-cache, no-store, must-revalidate\n")
+	if len(headers) > 0 {
+		headers = replaceHeader(headers, "Cache-Control", cacheControlHeader())
+		jsonBuffer.Write(replaceETag(headers, outputETag(resultJson)))
+	} else {
+		fmt.Fprintf(jsonBuffer, "Cache-Control:no-cache, no-store, must-revalidate\n")
+	}
+	fmt.Fprintf(jsonBuffer, "Content-Length: %d\n", len(resultJson))
 
 	// Http协议头结束
 	fmt.Fprintf(jsonBuffer, HTTP_HEADERS_BODY_SEP)
 
-	resultJson, _ := json.Marshal(v)
 	jsonBuffer.Write(resultJson)
 	return http.ReadResponse(bufio.NewReader(jsonBuffer), req)
 }
 
 //
-// 以JSON格式返回 v 中的数据
+// 图片不存在时返回404, 有效期为maxAge; maxAge <= 0时不允许缓存
 //
-func Http404Response(req *http.Request) (*http.Response, error) {
+func Http404Response(req *http.Request, maxAge time.Duration) (*http.Response, error) {
 
 	buf := new(bytes.Buffer)
-	fmt.Fprintf(buf, "%s %s OK\n", "HTTP/1.0", "404")
+	fmt.Fprintf(buf, "%s %s Not Found\n", "HTTP/1.0", "404")
 	fmt.Fprintf(buf, "Date:%s\n", time.Now().Format(http.TimeFormat))
-	fmt.Fprintf(buf, "Expires: %s\n", time.Now().Add(time.Hour).Format(http.TimeFormat)) // 1小时的有效期
-	fmt.Fprintf(buf, "Cache-Control: max-age=%d\n", 3600)
+	if maxAge > 0 {
+		fmt.Fprintf(buf, "Expires: %s\n", time.Now().Add(maxAge).Format(http.TimeFormat))
+		fmt.Fprintf(buf, "Cache-Control: max-age=%d\n", int64(maxAge/time.Second))
+	} else {
+		fmt.Fprintf(buf, "Cache-Control:no-cache, no-store, must-revalidate\n")
+	}
+	fmt.Fprintf(buf, "Content-Length: 0\n")
+
+	// Http协议头结束
+	fmt.Fprintf(buf, HTTP_HEADERS_BODY_SEP)
 	return http.ReadResponse(bufio.NewReader(buf), req)
 }
@@ -0,0 +1,124 @@
+package imageproxy
+
+import (
+	"bytes"
+	"image/png"
+	"net/http/httputil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// go test imageproxy -v -run "TestVerifyCacheEntry"
+func TestVerifyCacheEntry(t *testing.T) {
+	img := new(bytes.Buffer)
+	png.Encode(img, newImage(2, 2, red))
+
+	meta := (&ImageWithMeta{Headers: []byte("Etag: \"abc\"\nCache-Control: max-age=60\n"), Image: img.Bytes()}).Bytes()
+
+	resp, _ := ImageDataToHttpResponse(&ImageWithMeta{Image: img.Bytes()}, "image/png", nil)
+	dump, _ := httputil.DumpResponse(resp, true)
+
+	tests := []struct {
+		data    []byte
+		corrupt bool
+	}{
+		{meta, false},
+		{dump, false},
+		{[]byte("v2:http://awss3/a.jpeg\nhttp://awss3/a.jpeg_100x100"), false},
+
+		{meta[:5], true},
+		{meta[:10], true},
+		{meta[:len(meta)-10], true},
+		{(&ImageWithMeta{Headers: []byte("Etag"), Image: img.Bytes()}).Bytes(), true},
+		{dump[:len(dump)-10], true},
+		{[]byte{0, 0, 1, 2, 3}, true},
+	}
+	for i, tt := range tests {
+		if err := VerifyCacheEntry(tt.data); (err != nil) != tt.corrupt {
+			t.Errorf("%d. VerifyCacheEntry returned %v, want corrupt: %v", i, err, tt.corrupt)
+		}
+	}
+}
+
+// go test imageproxy -v -run "TestImageWithMeta"
+func TestImageWithMeta(t *testing.T) {
+	meta := &ImageWithMeta{
+		Headers:     []byte("Etag: \"abc\"\n"),
+		Image:       []byte("image data"),
+		Key:         "v2:http://awss3/a.jpeg",
+		Created:     time.Unix(1500000000, 123),
+		ContentType: "image/jpeg",
+	}
+	data := meta.Bytes()
+
+	got, err := NewImageWithMetaFromCache(data)
+	if err != nil {
+		t.Fatalf("NewImageWithMetaFromCache returned unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(got.Headers, meta.Headers) || !reflect.DeepEqual(got.Image, meta.Image) ||
+		got.Key != meta.Key || !got.Created.Equal(meta.Created) || got.ContentType != meta.ContentType {
+		t.Errorf("NewImageWithMetaFromCache returned %+v, want %+v", got, meta)
+	}
+
+	// 旧的格式
+	legacy := append([]byte{0, byte(len(meta.Headers))}, meta.Headers...)
+	legacy = append(legacy, meta.Image...)
+	if got, err := NewImageWithMetaFromCache(legacy); err != nil ||
+		string(got.Headers) != string(meta.Headers) || string(got.Image) != string(meta.Image) {
+		t.Errorf("NewImageWithMetaFromCache(legacy) returned %+v, %v", got, err)
+	}
+
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)/2] ^= 0xff
+	version := append([]byte{}, data...)
+	version[4] = 99
+
+	tests := []struct {
+		data []byte
+		err  error
+	}{
+		{nil, ErrImageWithMetaTruncated},
+		{[]byte{0}, ErrImageWithMetaTruncated},
+		{[]byte{0, 100, 1, 2}, ErrImageWithMetaTruncated},
+		{data[:6], ErrImageWithMetaTruncated},
+		{data[:12], ErrImageWithMetaChecksum},
+		{data[:len(data)-1], ErrImageWithMetaChecksum},
+		{corrupt, ErrImageWithMetaChecksum},
+		{version, ErrImageWithMetaVersion},
+	}
+	for i, tt := range tests {
+		if _, err := NewImageWithMetaFromCache(tt.data); err != tt.err {
+			t.Errorf("%d. NewImageWithMetaFromCache returned error %v, want %v", i, err, tt.err)
+		}
+	}
+}
+
+func TestReplaceHeader(t *testing.T) {
+	headers := []byte("cache-control: max-age=10\nETag: \"origin\"\n")
+	got := string(replaceHeader(headers, "Cache-Control", "max-age=60"))
+	want := "ETag: \"origin\"\nCache-Control: max-age=60\n"
+	if got != want {
+		t.Errorf("replaceHeader returned %q, want %q", got, want)
+	}
+
+	if got := string(replaceHeader(nil, "Cache-Control", "max-age=60")); got != "Cache-Control: max-age=60\n" {
+		t.Errorf("replaceHeader(nil) returned %q", got)
+	}
+}
+
+func TestImageDataToHttpResponse_CacheMaxAge(t *testing.T) {
+	defer SetCacheMaxAge(CacheMaxAge())
+
+	// 原始图片的Cache-Control以当前的配置为准
+	SetCacheMaxAge(time.Hour)
+	headers := []byte("Cache-Control: max-age=2592000\n")
+	resp, _ := ImageDataToHttpResponse(&ImageWithMeta{Headers: headers, Image: testPNG(1)}, "image/png", nil)
+	if got := resp.Header["Cache-Control"]; !reflect.DeepEqual(got, []string{"max-age=3600"}) {
+		t.Errorf("Cache-Control = %q, want max-age=3600", got)
+	}
+	expires, err := time.Parse(time.RFC1123, resp.Header.Get("Expires"))
+	if err != nil || expires.Sub(time.Now()) > time.Hour || expires.Sub(time.Now()) < 59*time.Minute {
+		t.Errorf("Expires = %q, want in 1 hour", resp.Header.Get("Expires"))
+	}
+}
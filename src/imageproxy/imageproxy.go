@@ -8,6 +8,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -28,13 +30,27 @@ type HttpProxyResult struct {
 
 // Proxy serves image requests.
 type Proxy struct {
-	Client         *http.Client // client used to fetch remote URLs
-	Cache          cache.Cache  // cache used to cache responses
-	Whitelist      []string
+	Client         *http.Client        // client used to fetch remote URLs
+	Cache          cache.Cache         // cache used to cache responses
+	Index          *cache.VariantIndex // 原始图片 --> 缓存key, 用于purge
+	Whitelist      []string // 修改时通过SetAccessLists
 	Referrers      []string
 	DefaultBaseURL *url.URL
+	Presets        *Presets // 命名的options, 可以为nil
 	Timeout        time.Duration
 	Wg             *sync.WaitGroup
+
+	UploadStore   ObjectStore // 上传图片的存储, nil时使用S3(config.AWSBuckets)
+	MaxUploadSize int64       // 上传图片的最大字节数, 0时使用默认值
+
+	ReadyOptions ReadyOptions // /ready-check的配置
+
+	transformer    *TransformingTransport
+	cacheTransport *cache.Transport
+
+	accessMu sync.RWMutex     // 保护Whitelist, Referrers
+	draining int32            // 1: 正在退出, health-check失败
+	inflight inflightRequests // 正在处理的请求
 }
 
 // NewProxy constructs a new proxy.  The provided http RoundTripper will be
@@ -50,6 +66,7 @@ func NewProxy(transport http.RoundTripper, cacheInstance cache.Cache, wg *sync.W
 
 	proxy := Proxy{
 		Cache: cacheInstance,
+		Index: cache.NewVariantIndex(cacheInstance),
 		Wg:    wg,
 	}
 
@@ -63,20 +80,88 @@ func NewProxy(transport http.RoundTripper, cacheInstance cache.Cache, wg *sync.W
 	//         cache.Transport 先做一层缓存处理
 	//           缓存没有命中，则TransformingTransport继续处理
 	//
-	client.Transport = &cache.Transport{
-		Transport:           &TransformingTransport{transport, client, cacheInstance},
+	proxy.transformer = &TransformingTransport{
+		Transport:   transport,
+		CacheClient: client,
+		Cache:       cacheInstance,
+		Index:       proxy.Index,
+	}
+	proxy.cacheTransport = &cache.Transport{
+		Transport:           proxy.transformer,
 		Cache:               cacheInstance,
 		MarkCachedResponses: true,
+		Index:               proxy.Index,
 	}
+	client.Transport = proxy.cacheTransport
 
 	proxy.Client = client
 
 	return &proxy
 }
 
+// SetVariantStore sets the durable store rendered variants are read from and written to.
+func (p *Proxy) SetVariantStore(store VariantStore) {
+	if p.transformer != nil {
+		p.transformer.Variants = store
+	}
+}
+
+// SetVariantBlocking makes saving rendered variants wait for the pending
+// uploads instead of dropping them when too many are pending, e.g. for warming.
+func (p *Proxy) SetVariantBlocking(blocking bool) {
+	if p.transformer != nil {
+		p.transformer.VariantBlocking = blocking
+	}
+}
+
+// SetIndexStore replaces the store of the variant index with a store local to
+// this instance, e.g. an index on disk which survives restarts.
+func (p *Proxy) SetIndexStore(store cache.SetStore) {
+	if p.Index != nil {
+		p.Index.Store = store
+		p.Index.Shared = false
+	}
+}
+
+// SetOriginTTL sets how long original images fetched from S3 stay in the cache
+// before they are fetched again. Zero means forever.
+func (p *Proxy) SetOriginTTL(ttl time.Duration) {
+	if p.transformer != nil {
+		p.transformer.OriginTTL = ttl
+	}
+}
+
+// SetStaleWhileRevalidate sets how long after expiring a cached response is
+// still served while it is refreshed in the background. Zero means only when
+// the response itself allows it with stale-while-revalidate.
+func (p *Proxy) SetStaleWhileRevalidate(window time.Duration) {
+	if p.cacheTransport != nil {
+		p.cacheTransport.StaleWhileRevalidate = window
+	}
+}
+
+// SetAccessLists replaces the allowed remote hosts and referring hosts. It's
+// safe to call while serving requests.
+func (p *Proxy) SetAccessLists(whitelist, referrers []string) {
+	p.accessMu.Lock()
+	p.Whitelist, p.Referrers = whitelist, referrers
+	p.accessMu.Unlock()
+}
+
+// SetNegativeTTL sets how long missing or undecodable originals are remembered
+// before S3 is asked again. Zero disables negative caching.
+func (p *Proxy) SetNegativeTTL(ttl time.Duration) {
+	if p.transformer != nil {
+		p.transformer.NegativeTTL = ttl
+	}
+}
+
 func (p *Proxy) getFavicon(w http.ResponseWriter) error {
-	faviconPath := config.GetConfPath("conf/favicon.ico")
-	data, err := ioutil.ReadFile(faviconPath)
+	// 没有配置favicon时返回404
+	if len(config.FaviconPath) == 0 {
+		return os.ErrNotExist
+	}
+	data, err := ioutil.ReadFile(config.FaviconPath)
 	if err == nil {
 		w.Header().Add("ETag", "a895c786bfaf8cb3f4c24926e3279615")
 		w.Header().Add("Date", time.Now().Format(time.RFC1123))
@@ -90,17 +175,44 @@ func (p *Proxy) getFavicon(w http.ResponseWriter) error {
 // ServeHTTP handles incoming requests.
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/favicon.ico" {
-		p.getFavicon(w)
-		return // ignore favicon requests
+		if err := p.getFavicon(w); err != nil {
+			http.NotFound(w, r)
+		}
+		return
 	}
 
 	if r.URL.Path == "/health-check" {
+		// 退出过程中: 让负载均衡不再转发新的请求
+		if p.Draining() {
+			http.Error(w, "DRAINING", http.StatusServiceUnavailable)
+			return
+		}
 		fmt.Fprint(w, "OK")
 		return
 	}
 
+	if r.URL.Path == kReadyPath {
+		p.serveReady(w, r)
+		return
+	}
+
+	if r.URL.Path == kStatsPath {
+		p.serveStats(w, r)
+		return
+	}
+
 	p.Wg.Add(1)
 	defer p.Wg.Done()
+	defer p.inflight.track(r)()
+
+	if r.URL.Path == kUploadPath {
+		p.serveUpload(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, PURGE_PATH_PREFIX) {
+		p.servePurge(w, r)
+		return
+	}
 
 	var h http.Handler = http.HandlerFunc(p.serveImage)
 	if p.Timeout > 0 {
@@ -120,7 +232,7 @@ func (p *Proxy) serveImage(w http.ResponseWriter, r *http.Request) {
 	start := Microseconds()
 
 	// 1. 解析Request
-	req, err := NewRequest(r, p.DefaultBaseURL)
+	req, err := NewRequest(r, p.DefaultBaseURL, p.Presets)
 
 	// 2. 如果格式不正确，直接报错
 	if err != nil {
@@ -166,7 +278,7 @@ func writeResponseToWriter(resp *http.Response, w http.ResponseWriter, r *http.R
 		cached := resp.Header.Get(cache.XFromCache)
 
 		log.Printf("Elapsed: %.1fms, Status: %d, cache: %v, URL: %s, sign: %v",
-			float64(Microseconds() - start) * 0.001, resp.StatusCode, cached == "1", r.URL.String(), signOK)
+			float64(Microseconds() - start) * 0.001, http.StatusNotModified, cached == "1", r.URL.String(), signOK)
 		return
 	}
 
@@ -176,15 +288,51 @@ func writeResponseToWriter(resp *http.Response, w http.ResponseWriter, r *http.R
 	w.Header().Add("Vary", "Accept")
 	// 方便Ajax读取修改图片
 	w.Header().Add("Access-Control-Allow-Origin", "*")
-	w.WriteHeader(resp.StatusCode)
+
+	// Range: 从完整的图片中截取一段返回
+	status := resp.StatusCode
+	var body io.Reader = resp.Body
+	if status == http.StatusOK && resp.ContentLength >= 0 {
+		w.Header().Set("Accept-Ranges", "bytes")
+
+		if rangeHeader := r.Header.Get("Range"); len(rangeHeader) > 0 && ifRangeMatches(r, resp) {
+			ra, ok, err := parseRange(rangeHeader, resp.ContentLength)
+			if err != nil {
+				drainUncached(resp)
+				w.Header().Del("Content-Length")
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", resp.ContentLength))
+				http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			if ok {
+				if _, err := io.CopyN(ioutil.Discard, resp.Body, ra.start); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				body = io.LimitReader(resp.Body, ra.length)
+				status = http.StatusPartialContent
+				w.Header().Set("Content-Range", ra.contentRange(resp.ContentLength))
+				w.Header().Set("Content-Length", strconv.FormatInt(ra.length, 10))
+			}
+		}
+	}
+	w.WriteHeader(status)
 
 	// 注意Http请求的格式
 	// 这里 serveImage 实际上就是一个Proxy
-	io.Copy(w, resp.Body)
+	// HEAD只返回headers, 缓存命中时不需要读取body
+	if r.Method == "HEAD" {
+		drainUncached(resp)
+	} else {
+		io.Copy(w, body)
+		if status == http.StatusPartialContent {
+			drainUncached(resp)
+		}
+	}
 
 	cached := resp.Header.Get(cache.XFromCache)
 	log.Printf("Elapsed: %.1fms, Status: %d, cache: %v, URL: %s, sign: %v",
-		float64(Microseconds() - start) * 0.001, resp.StatusCode, cached == "1", r.URL.String(), signOK)
+		float64(Microseconds() - start) * 0.001, status, cached == "1", r.URL.String(), signOK)
 }
 
 func copyHeader(w http.ResponseWriter, r *http.Response, header string) {
@@ -205,12 +353,16 @@ func (p *Proxy) allowed(r *Request) (error, bool) {
 		return fmt.Errorf(fmt.Sprintf("Invalid file format %s", r.Options.Format)), false
 	}
 
-	if len(p.Referrers) > 0 && !validReferrer(p.Referrers, r.Original) {
+	p.accessMu.RLock()
+	whitelist, referrers := p.Whitelist, p.Referrers
+	p.accessMu.RUnlock()
+
+	if len(referrers) > 0 && !validReferrer(referrers, r.Original) {
 		return fmt.Errorf("request does not contain an allowed referrer: %v", r), false
 	}
 
 	// 防止别人的域名直接引用我们的服务
-	if len(p.Whitelist) > 0 && !validHost(p.Whitelist, r.URL) {
+	if len(whitelist) > 0 && !validHost(whitelist, r.URL) {
 		return fmt.Errorf("request host not allowed: %v", r), false
 	}
 
@@ -282,27 +434,28 @@ func validSignature(r *Request) bool {
 // req, based on the response resp.  This is determined using the last modified
 // time and the entity tag of resp.
 func check304(req *http.Request, resp *http.Response) bool {
+	// 只有GET/HEAD请求, 且正常返回的图片才需要验证
+	if resp.StatusCode != http.StatusOK ||
+		(req.Method != "" && req.Method != "GET" && req.Method != "HEAD") {
+		return false
+	}
 
-	// 验证Etag是否一致
-	etag := resp.Header.Get("Etag")
-	if etag != "" && etag == req.Header.Get("If-None-Match") {
-		return true
+	// 验证Etag是否一致; If-None-Match存在时忽略If-Modified-Since(RFC 7232 3.3)
+	if len(req.Header["If-None-Match"]) > 0 {
+		return ifNoneMatch(req, resp.Header.Get("Etag"))
 	}
 
-	// 验证Last-Modified是否一致
-	lastModified, err := time.Parse(time.RFC1123, resp.Header.Get("Last-Modified"))
-	if err != nil {
+	// 验证Last-Modified: 在If-Modified-Since之后没有修改过(精确到秒)
+	ifModSince, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil || ifModSince.After(time.Now()) {
+		// 无效的时间, 或者晚于服务器的当前时间的时间都忽略
 		return false
 	}
-	ifModSince, err := time.Parse(time.RFC1123, req.Header.Get("If-Modified-Since"))
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
 	if err != nil {
 		return false
 	}
-	if lastModified.Before(ifModSince) {
-		return true
-	}
-
-	return false
+	return !lastModified.Truncate(time.Second).After(ifModSince)
 }
 
 //
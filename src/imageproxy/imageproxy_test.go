@@ -3,16 +3,21 @@ package imageproxy
 import (
 	"bufio"
 	"bytes"
+	"config"
 	"errors"
 	"fmt"
 	"image"
 	"image/png"
+	"io/ioutil"
 	"media_utils"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 // go test imageproxy -v -run "TestAllowed"
@@ -61,7 +66,7 @@ func TestAllowed(t *testing.T) {
 			t.Errorf("error parsing url %q: %v", tt.url, err)
 		}
 
-		req := &Request{u, emptyOptions, tt.request}
+		req := &Request{URL: u, Options: emptyOptions, Original: tt.request}
 		if got, _ := p.allowed(req); (got == nil) != tt.allowed {
 			t.Errorf("allowed(%q) returned %v, want %v.\nTest struct: %#v", req, got, tt.allowed, tt)
 		}
@@ -139,6 +144,41 @@ func TestCheck304(t *testing.T) {
 			"HTTP/1.1 200 OK\nLast-Modified: Sat, 01 Jan 2000 00:00:00 GMT\n\n",
 			true,
 		},
+		{ // last-modified equal
+			"GET / HTTP/1.1\nIf-Modified-Since: Sat, 01 Jan 2000 00:00:00 GMT\n\n",
+			"HTTP/1.1 200 OK\nLast-Modified: Sat, 01 Jan 2000 00:00:00 GMT\n\n",
+			true,
+		},
+		{ // last-modified match, RFC 850
+			"GET / HTTP/1.1\nIf-Modified-Since: Sunday, 02-Jan-00 00:00:00 GMT\n\n",
+			"HTTP/1.1 200 OK\nLast-Modified: Sat, 01 Jan 2000 00:00:00 GMT\n\n",
+			true,
+		},
+		{ // etag list
+			"GET / HTTP/1.1\nIf-None-Match: \"a\", \"v\"\n\n",
+			"HTTP/1.1 200 OK\nEtag: \"v\"\n\n",
+			true,
+		},
+		{ // weak comparison
+			"GET / HTTP/1.1\nIf-None-Match: W/\"v\"\n\n",
+			"HTTP/1.1 200 OK\nEtag: \"v\"\n\n",
+			true,
+		},
+		{ // weak comparison
+			"GET / HTTP/1.1\nIf-None-Match: \"v\"\n\n",
+			"HTTP/1.1 200 OK\nEtag: W/\"v\"\n\n",
+			true,
+		},
+		{ // any etag
+			"GET / HTTP/1.1\nIf-None-Match: *\n\n",
+			"HTTP/1.1 200 OK\nEtag: \"v\"\n\n",
+			true,
+		},
+		{ // HEAD
+			"HEAD / HTTP/1.1\nIf-None-Match: \"v\"\n\n",
+			"HTTP/1.1 200 OK\nEtag: \"v\"\n\n",
+			true,
+		},
 
 		// mismatches
 		{
@@ -176,6 +216,26 @@ func TestCheck304(t *testing.T) {
 			"HTTP/1.1 200 OK\nLast-Modified: Sat, 01 Jan 2000 00:00:00 GMT\n\n",
 			false,
 		},
+		{ // If-None-Match mismatch takes precedence over If-Modified-Since
+			"GET / HTTP/1.1\nIf-None-Match: \"a\"\nIf-Modified-Since: Sun, 02 Jan 2000 00:00:00 GMT\n\n",
+			"HTTP/1.1 200 OK\nEtag: \"b\"\nLast-Modified: Sat, 01 Jan 2000 00:00:00 GMT\n\n",
+			false,
+		},
+		{ // If-Modified-Since in the future is ignored
+			"GET / HTTP/1.1\nIf-Modified-Since: Fri, 01 Jan 2100 00:00:00 GMT\n\n",
+			"HTTP/1.1 200 OK\nLast-Modified: Sat, 01 Jan 2000 00:00:00 GMT\n\n",
+			false,
+		},
+		{ // any etag, but no content
+			"GET / HTTP/1.1\nIf-None-Match: *\n\n",
+			"HTTP/1.1 404 Not Found\n\n",
+			false,
+		},
+		{ // unsafe method
+			"POST / HTTP/1.1\nIf-None-Match: \"v\"\n\n",
+			"HTTP/1.1 200 OK\nEtag: \"v\"\n\n",
+			false,
+		},
 	}
 
 	for _, tt := range tests {
@@ -317,3 +377,51 @@ func TestTransformingTransport(t *testing.T) {
 		}
 	}
 }
+
+func TestTransformingTransport_originExpired(t *testing.T) {
+	tr := &TransformingTransport{}
+	old := &ImageWithMeta{Created: time.Now().Add(-2 * time.Hour)}
+	if tr.originExpired(old) {
+		t.Error("origin expired without OriginTTL")
+	}
+
+	tr.OriginTTL = time.Hour
+	if !tr.originExpired(old) {
+		t.Error("origin created 2h ago did not expire after 1h")
+	}
+	if tr.originExpired(&ImageWithMeta{Created: time.Now()}) {
+		t.Error("fresh origin expired")
+	}
+	// 旧格式的数据没有Created, 需要验证一次
+	if !tr.originExpired(&ImageWithMeta{}) {
+		t.Error("legacy origin did not expire")
+	}
+}
+
+func TestProxy_Favicon(t *testing.T) {
+	defer func(path string) { config.FaviconPath = path }(config.FaviconPath)
+
+	p := &Proxy{}
+	serve := func() *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, httptest.NewRequest("GET", "/favicon.ico", nil))
+		return resp
+	}
+
+	// 没有配置favicon
+	config.FaviconPath = ""
+	if resp := serve(); resp.Code != http.StatusNotFound {
+		t.Errorf("favicon returned %d, want %d", resp.Code, http.StatusNotFound)
+	}
+
+	dir, err := ioutil.TempDir("", "favicon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config.FaviconPath = filepath.Join(dir, "favicon.ico")
+	ioutil.WriteFile(config.FaviconPath, []byte("ico"), 0644)
+	if resp := serve(); resp.Code != http.StatusOK || resp.Body.String() != "ico" {
+		t.Errorf("favicon returned %d, %q", resp.Code, resp.Body.String())
+	}
+}
@@ -0,0 +1,207 @@
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/disintegration/imaging"
+	"image"
+	"image/gif"
+	"media_utils"
+	"net/http"
+)
+
+const (
+	// /tools/im/_info/{key} 返回原始图片的meta信息
+	optInfo = "_info"
+
+	// 计算主色调时, 先将图片缩小到这个尺寸
+	dominantColorSampleSize = 64
+)
+
+//
+// 原始图片的meta信息, 方便客户端在下载图片之前布局
+//
+type ImageInfo struct {
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+	Format        string `json:"format"`
+	Frames        int    `json:"frames"`
+	Size          int    `json:"size"`
+	HasAlpha      bool   `json:"has_alpha"`
+	Orientation   int    `json:"orientation"`    // EXIF orientation, 1-8; 没有EXIF信息时为1
+	DominantColor string `json:"dominant_color"` // #rrggbb
+	BlurHash      string `json:"blurhash"`
+	LQIP          string `json:"lqip"` // data URI
+}
+
+// NewImageInfo decodes img and collects its metadata.
+func NewImageInfo(img []byte) (*ImageInfo, error) {
+	m, format, err := image.Decode(bytes.NewReader(img))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := m.Bounds()
+	info := &ImageInfo{
+		Width:         bounds.Dx(),
+		Height:        bounds.Dy(),
+		Format:        format,
+		Frames:        1,
+		Size:          len(img),
+		HasAlpha:      hasAlpha(m),
+		Orientation:   1,
+		DominantColor: DominantColor(m),
+		BlurHash:      BlurHash(m, blurHashComponentsX, blurHashComponentsY),
+	}
+
+	if info.LQIP, err = LQIP(m, ""); err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case media_utils.ImageFormatGif:
+		if g, err := gif.DecodeAll(bytes.NewReader(img)); err == nil {
+			info.Frames = len(g.Image)
+		}
+	case media_utils.ImageFormatJpeg:
+		if orientation := exifOrientation(img); orientation > 0 {
+			info.Orientation = orientation
+		}
+	}
+	return info, nil
+}
+
+//
+// 返回图片的meta信息, headers为原始图片的缓存相关的headers
+//
+func ImageInfoToHttpResponse(imageWithMeta *ImageWithMeta, req *http.Request) (*http.Response, error) {
+	info, err := NewImageInfo(imageWithMeta.Image)
+	if err != nil {
+		return nil, err
+	}
+	return JSONDataToHttpResponse(info, imageWithMeta.Headers, req)
+}
+
+// hasAlpha reports whether m contains any pixel which is not fully opaque.
+func hasAlpha(m image.Image) bool {
+	if o, ok := m.(interface {
+		Opaque() bool
+	}); ok {
+		return !o.Opaque()
+	}
+	return true
+}
+
+//
+// 计算图片的主色调: 将图片缩小之后，按照每个通道高4位做分桶，返回像素最多的桶的平均颜色
+// 透明的像素不参与计算
+//
+func DominantColor(m image.Image) string {
+	small := imaging.Fit(m, dominantColorSampleSize, dominantColorSampleSize, imaging.Box)
+
+	type bucket struct {
+		r, g, b, n int
+	}
+	buckets := make(map[int]*bucket)
+	var best *bucket
+
+	bounds := small.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := small.NRGBAAt(x, y)
+			if c.A < 128 {
+				continue
+			}
+			key := int(c.R>>4)<<8 | int(c.G>>4)<<4 | int(c.B>>4)
+			bk, ok := buckets[key]
+			if !ok {
+				bk = &bucket{}
+				buckets[key] = bk
+			}
+			bk.r += int(c.R)
+			bk.g += int(c.G)
+			bk.b += int(c.B)
+			bk.n++
+			if best == nil || bk.n > best.n {
+				best = bk
+			}
+		}
+	}
+
+	if best == nil {
+		return "#000000"
+	}
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.n, best.g/best.n, best.b/best.n)
+}
+
+//
+// 从JPEG的APP1(Exif)段中读取Orientation(0x0112), 没有找到时返回0
+//
+func exifOrientation(img []byte) int {
+	if len(img) < 4 || img[0] != 0xFF || img[1] != 0xD8 {
+		return 0
+	}
+
+	pos := 2
+	for pos+4 <= len(img) {
+		if img[pos] != 0xFF {
+			return 0
+		}
+		marker := img[pos+1]
+		// SOS之后就是图像数据了
+		if marker == 0xDA || marker == 0xD9 {
+			return 0
+		}
+		length := int(binary.BigEndian.Uint16(img[pos+2 : pos+4]))
+		if length < 2 || pos+2+length > len(img) {
+			return 0
+		}
+		segment := img[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 0
+}
+
+//
+// 解析TIFF header和IFD0, 读取Orientation
+//
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[0:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for i := 0; i < count; i++ {
+		entry := offset + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		// tag: 0x0112, type: SHORT
+		if order.Uint16(tiff[entry:entry+2]) == 0x0112 && order.Uint16(tiff[entry+2:entry+4]) == 3 {
+			orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+			if orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			return 0
+		}
+	}
+	return 0
+}
@@ -0,0 +1,189 @@
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// withExifOrientation 在JPEG的SOI之后插入一个只包含Orientation的APP1段
+func withExifOrientation(img []byte, orientation uint16) []byte {
+	tiff := new(bytes.Buffer)
+	tiff.WriteString("MM")
+	binary.Write(tiff, binary.BigEndian, uint16(0x002A))
+	binary.Write(tiff, binary.BigEndian, uint32(8))
+	binary.Write(tiff, binary.BigEndian, uint16(1))
+	binary.Write(tiff, binary.BigEndian, []uint16{0x0112, 3})
+	binary.Write(tiff, binary.BigEndian, uint32(1))
+	binary.Write(tiff, binary.BigEndian, []uint16{orientation, 0})
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	out := new(bytes.Buffer)
+	out.Write(img[:2])
+	out.Write([]byte{0xFF, 0xE1})
+	binary.Write(out, binary.BigEndian, uint16(len(segment)+2))
+	out.Write(segment)
+	out.Write(img[2:])
+	return out.Bytes()
+}
+
+// go test imageproxy -v -run "TestNewImageInfo"
+func TestNewImageInfo(t *testing.T) {
+	src := newImage(4, 2, red, red, red, blue, red, red, red, blue)
+
+	jpegBuf := new(bytes.Buffer)
+	jpeg.Encode(jpegBuf, src, nil)
+
+	pngBuf := new(bytes.Buffer)
+	png.Encode(pngBuf, src)
+
+	transparent := newImage(2, 2, red, color.NRGBA{0, 0, 0, 0}, red, red)
+	alphaBuf := new(bytes.Buffer)
+	png.Encode(alphaBuf, transparent)
+
+	palette := color.Palette{red, blue}
+	frame := image.NewPaletted(image.Rect(0, 0, 3, 3), palette)
+	gifBuf := new(bytes.Buffer)
+	gif.EncodeAll(gifBuf, &gif.GIF{
+		Image: []*image.Paletted{frame, frame, frame},
+		Delay: []int{0, 0, 0},
+	})
+
+	tests := []struct {
+		name string
+		img  []byte
+		want ImageInfo
+	}{
+		{"png", pngBuf.Bytes(), ImageInfo{4, 2, "png", 1, pngBuf.Len(), false, 1, "#ff0000", "", ""}},
+		{"png alpha", alphaBuf.Bytes(), ImageInfo{2, 2, "png", 1, alphaBuf.Len(), true, 1, "#ff0000", "", ""}},
+		{"gif", gifBuf.Bytes(), ImageInfo{3, 3, "gif", 3, gifBuf.Len(), false, 1, "#ff0000", "", ""}},
+		{"jpeg", jpegBuf.Bytes(), ImageInfo{4, 2, "jpeg", 1, jpegBuf.Len(), false, 1, "", "", ""}},
+	}
+
+	exif := withExifOrientation(jpegBuf.Bytes(), 6)
+	tests = append(tests, struct {
+		name string
+		img  []byte
+		want ImageInfo
+	}{"jpeg exif", exif, ImageInfo{4, 2, "jpeg", 1, len(exif), false, 6, "", "", ""}})
+
+	for _, tt := range tests {
+		got, err := NewImageInfo(tt.img)
+		if err != nil {
+			t.Errorf("NewImageInfo(%s) returned unexpected error: %v", tt.name, err)
+			continue
+		}
+		// jpeg有损压缩, 不比较主色调
+		if tt.want.DominantColor == "" {
+			got.DominantColor = ""
+		}
+		// placeholder的内容见TestBlurHash, TestLQIP
+		if got.BlurHash == "" || !strings.HasPrefix(got.LQIP, "data:image/jpeg;base64,") {
+			t.Errorf("NewImageInfo(%s) returned BlurHash: %q, LQIP: %q", tt.name, got.BlurHash, got.LQIP)
+		}
+		got.BlurHash, got.LQIP = "", ""
+		if *got != tt.want {
+			t.Errorf("NewImageInfo(%s) returned %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+
+	if _, err := NewImageInfo([]byte("not an image")); err == nil {
+		t.Errorf("NewImageInfo with invalid image did not return expected error")
+	}
+}
+
+// go test imageproxy -v -run "TestExifOrientation"
+func TestExifOrientation(t *testing.T) {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, newImage(1, 1, red), nil)
+	img := buf.Bytes()
+
+	if got := exifOrientation(img); got != 0 {
+		t.Errorf("exifOrientation without exif returned %d, want 0", got)
+	}
+	for orientation := uint16(1); orientation <= 8; orientation++ {
+		if got := exifOrientation(withExifOrientation(img, orientation)); got != int(orientation) {
+			t.Errorf("exifOrientation returned %d, want %d", got, orientation)
+		}
+	}
+
+	// 数据被截断
+	truncated := withExifOrientation(img, 6)[:20]
+	if got := exifOrientation(truncated); got != 0 {
+		t.Errorf("exifOrientation of truncated data returned %d, want 0", got)
+	}
+}
+
+// go test imageproxy -v -run "TestDominantColor"
+func TestDominantColor(t *testing.T) {
+	tests := []struct {
+		img  image.Image
+		want string
+	}{
+		{newImage(10, 10, blue), "#0000ff"},
+		{newImage(2, 2, red, red, red, green), "#ff0000"},
+		{newImage(2, 2, color.NRGBA{0, 0, 0, 0}), "#000000"},
+	}
+	for _, tt := range tests {
+		if got := DominantColor(tt.img); got != tt.want {
+			t.Errorf("DominantColor(%v) returned %s, want %s", tt.img.Bounds(), got, tt.want)
+		}
+	}
+}
+
+// go test imageproxy -v -run "TestNewRequestInfo"
+func TestNewRequestInfo(t *testing.T) {
+	awsUrl, _ := url.Parse("http://awss3")
+	req, _ := http.NewRequest("GET", "http://localhost/tools/im/_info/production/a.jpeg", nil)
+	req.Header.Set("Accept", "image/webp")
+
+	r, err := NewRequest(req, awsUrl, nil)
+	if err != nil {
+		t.Fatalf("NewRequest returned unexpected error: %v", err)
+	}
+	if !r.Info || r.Options != emptyOptions {
+		t.Errorf("NewRequest returned Info: %v, Options: %v", r.Info, r.Options)
+	}
+	if got, want := r.String(), "http://awss3/production/a.jpeg#_info"; got != want {
+		t.Errorf("Request.String returned %s, want %s", got, want)
+	}
+}
+
+// go test imageproxy -v -run "TestTransformingTransportInfo"
+func TestTransformingTransportInfo(t *testing.T) {
+	client := new(http.Client)
+	tr := &TransformingTransport{
+		Transport:   testTransport{},
+		CacheClient: client,
+	}
+	client.Transport = tr
+
+	req, _ := http.NewRequest("GET", "http://good.test/png#_info", nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip returned unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if got, want := resp.Header.Get("Content-Type"), "application/json"; got != want {
+		t.Errorf("RoundTrip returned Content-Type %s, want %s", got, want)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	var info ImageInfo
+	if err := json.Unmarshal(body, &info); err != nil {
+		t.Fatalf("json.Unmarshal(%s) returned error: %v", body, err)
+	}
+	if info.Width != 1 || info.Height != 1 || info.Format != "png" {
+		t.Errorf("RoundTrip returned info %+v", info)
+	}
+}
@@ -0,0 +1,114 @@
+package imageproxy
+
+import (
+	"bytes"
+	"cache"
+	"fmt"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"image"
+	"media_utils"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 没有开启负缓存时404的有效期
+const default404MaxAge = time.Hour
+
+//
+// 原始图片不存在或者无法解码时的负缓存, 避免重复请求S3
+// 格式为文本: "{created(unix秒)} {reason}"
+// 请求中的ts比created新时(例如图片刚刚上传), 忽略负缓存重新请求
+//
+type negativeEntry struct {
+	Created time.Time
+	Reason  string
+}
+
+func parseNegativeEntry(data []byte) (*negativeEntry, error) {
+	fields := strings.SplitN(string(data), " ", 2)
+	created, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid negative cache entry: %q", data)
+	}
+	entry := &negativeEntry{Created: time.Unix(created, 0)}
+	if len(fields) > 1 {
+		entry.Reason = fields[1]
+	}
+	return entry, nil
+}
+
+func (e *negativeEntry) Bytes() []byte {
+	return []byte(fmt.Sprintf("%d %s", e.Created.Unix(), e.Reason))
+}
+
+//
+// 命中负缓存时返回404; 请求的ts比负缓存新时不命中
+//
+func (t *TransformingTransport) negativeResponse(req *http.Request, origin *url.URL) (*http.Response, bool) {
+	if t.NegativeTTL <= 0 {
+		return nil, false
+	}
+	key := cache.NegativeCacheKeyForURL(origin)
+	data, ok := t.Cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	entry, err := parseNegativeEntry(data)
+	if err != nil {
+		log.ErrorErrorf(err, "Corrupt negative cache, Key: %s", key)
+		t.Cache.Delete(key)
+		return nil, false
+	}
+	// 不支持TTL的Cache, 或者NegativeTTL被调小
+	if time.Since(entry.Created) >= t.NegativeTTL {
+		t.Cache.Delete(key)
+		return nil, false
+	}
+
+	if ts, err := strconv.ParseInt(req.URL.Query().Get(media_utils.ParamVersionTs), 10, 64); err == nil && ts > entry.Created.Unix() {
+		log.Printf("Negative cache exempted by ts %d, Key: %s", ts, key)
+		return nil, false
+	}
+
+	log.Printf("Negative cache hit, Key: %s, Reason: %s", key, entry.Reason)
+	resp, err := Http404Response(req, t.negativeMaxAge(entry))
+	return resp, err == nil
+}
+
+func (t *TransformingTransport) setNegative(origin *url.URL, reason string) {
+	if t.NegativeTTL <= 0 {
+		return
+	}
+	key := cache.NegativeCacheKeyForURL(origin)
+	entry := &negativeEntry{Created: time.Now(), Reason: reason}
+	cache.SetWithTTL(t.Cache, key, entry.Bytes(), t.NegativeTTL)
+	t.Index.Add(origin, key)
+	log.Printf("Negative cache set, Key: %s, Reason: %s", key, reason)
+}
+
+//
+// 外层httpcache缓存404的时间不超过负缓存剩余的时间
+// 没有开启负缓存时和之前一样, 404的有效期为1小时
+//
+func (t *TransformingTransport) negativeMaxAge(entry *negativeEntry) time.Duration {
+	if t.NegativeTTL <= 0 {
+		return default404MaxAge
+	}
+	if entry == nil {
+		return t.NegativeTTL
+	}
+	maxAge := t.NegativeTTL - time.Since(entry.Created)
+	if maxAge < time.Second {
+		return 0
+	}
+	return maxAge
+}
+
+// 原始数据不是支持的图片格式
+func isUndecodable(data []byte) bool {
+	_, _, err := image.DecodeConfig(bytes.NewReader(data))
+	return err != nil
+}
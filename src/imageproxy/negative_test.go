@@ -0,0 +1,102 @@
+package imageproxy
+
+import (
+	"cache"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// go test imageproxy -v -run "TestS3ResourceProcessNegativeCache"
+func TestS3ResourceProcessNegativeCache(t *testing.T) {
+	origins := &memOrigins{etag: `"v1"`}
+	tr := &TransformingTransport{
+		Cache:       cache.NewMemoryCache(),
+		Origins:     origins,
+		NegativeTTL: time.Hour,
+	}
+
+	get := func(rawurl string) *http.Response {
+		req, _ := http.NewRequest("GET", rawurl, nil)
+		resp, err := tr.S3ResourceProcess(req)
+		if err != nil {
+			t.Fatalf("S3ResourceProcess(%s) returned unexpected error: %v", rawurl, err)
+		}
+		return resp
+	}
+
+	// 不存在的图片只请求一次S3
+	for i := 0; i < 2; i++ {
+		resp := get("http://awss3/production/missing.png#100x100")
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("missing origin returned status %d", resp.StatusCode)
+		}
+		if cc := resp.Header.Get("Cache-Control"); !strings.HasPrefix(cc, "max-age=") {
+			t.Errorf("missing origin returned Cache-Control %q", cc)
+		}
+	}
+	if origins.gets != 1 {
+		t.Fatalf("requested S3 %d times, want 1", origins.gets)
+	}
+
+	// 旧的ts依然命中负缓存, 更新的ts重新请求S3
+	get("http://awss3/production/missing.png?ts=1#100x100")
+	if origins.gets != 1 {
+		t.Fatalf("old ts requested S3, %d times", origins.gets)
+	}
+	ts := time.Now().Add(time.Minute).Unix()
+	get(fmt.Sprintf("http://awss3/production/missing.png?ts=%d#100x100", ts))
+	if origins.gets != 2 {
+		t.Fatalf("newer ts did not request S3, %d times", origins.gets)
+	}
+
+	// 无法解码的原始数据也作为不存在的图片处理, 并且不再缓存原始数据
+	origins.content = []byte("not an image")
+	if resp := get("http://awss3/production/text.png#100x100"); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("undecodable origin returned status %d", resp.StatusCode)
+	}
+	get("http://awss3/production/text.png#200x200")
+	if origins.gets != 3 {
+		t.Fatalf("requested S3 %d times, want 3", origins.gets)
+	}
+	if tr.Cache.Exists("v2:http://awss3/production/text.png") {
+		t.Error("undecodable origin is still cached")
+	}
+
+	// 负缓存过期之后重新请求S3
+	u, _ := url.Parse("http://awss3/production/text.png")
+	entry := &negativeEntry{Created: time.Now().Add(-2 * time.Hour), Reason: "undecodable"}
+	tr.Cache.Set(cache.NegativeCacheKeyForURL(u), entry.Bytes())
+	origins.content = testPNG(1)
+	if resp := get("http://awss3/production/text.png#0x0"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expired negative entry returned status %d", resp.StatusCode)
+	}
+
+	// 关闭负缓存时每次都请求S3, 404的有效期和之前一样为1小时
+	tr.NegativeTTL = 0
+	origins.content = nil
+	origins.gets = 0
+	for i := 0; i < 2; i++ {
+		resp := get("http://awss3/production/other.png#100x100")
+		if cc := resp.Header.Get("Cache-Control"); cc != "max-age=3600" {
+			t.Errorf("uncached 404 returned Cache-Control %q, want max-age=3600", cc)
+		}
+	}
+	if origins.gets != 2 {
+		t.Errorf("requested S3 %d times, want 2", origins.gets)
+	}
+}
+
+func TestParseNegativeEntry(t *testing.T) {
+	entry := &negativeEntry{Created: time.Unix(1500000000, 0), Reason: "NoSuchKey"}
+	got, err := parseNegativeEntry(entry.Bytes())
+	if err != nil || !got.Created.Equal(entry.Created) || got.Reason != entry.Reason {
+		t.Errorf("parseNegativeEntry(%q) returned %+v, %v", entry.Bytes(), got, err)
+	}
+	if _, err := parseNegativeEntry([]byte("garbage")); err == nil {
+		t.Error("parseNegativeEntry(garbage) did not return error")
+	}
+}
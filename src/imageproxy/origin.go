@@ -0,0 +1,86 @@
+package imageproxy
+
+import (
+	"media_utils"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//
+// 原始图片的存储, 默认为S3(config.AWSBuckets)
+// 找不到对象时返回awserr(NoSuchKey, NoSuchBucket)
+//
+type OriginStore interface {
+	// GetIfModified returns the content and the cache headers of key; if the object
+	// still matches etag or hasn't changed since lastModified, notModified is true
+	// and no content is returned.
+	GetIfModified(key, etag string, lastModified time.Time) (content []byte, headers []byte, notModified bool, err error)
+}
+
+func (s *s3Store) GetIfModified(key, etag string, lastModified time.Time) ([]byte, []byte, bool, error) {
+	return media_utils.GetContentFromAWSIfModified(media_utils.GetS3Session(), s.bucket, key, etag, lastModified)
+}
+
+//
+// 过期的原始图片通过条件请求重新验证的统计
+//
+type RevalidationStats struct {
+	Revalidations uint64  `json:"revalidations"`
+	NotModified   uint64  `json:"not_modified"` // S3返回304, 继续使用缓存的数据
+	Modified      uint64  `json:"modified"`     // 重新下载
+	Errors        uint64  `json:"errors"`       // 出错时继续使用缓存的数据
+	Deleted       uint64  `json:"deleted"`      // 原始图片已经被删除, 返回404
+	HitRate       float64 `json:"hit_rate"`     // NotModified / Revalidations
+}
+
+type revalidationCounters struct {
+	mu    sync.Mutex
+	stats RevalidationStats
+}
+
+func (c *revalidationCounters) add(notModified bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Revalidations++
+	switch {
+	case err != nil:
+		c.stats.Errors++
+	case notModified:
+		c.stats.NotModified++
+	default:
+		c.stats.Modified++
+	}
+}
+
+func (c *revalidationCounters) deleted() {
+	c.mu.Lock()
+	c.stats.Revalidations++
+	c.stats.Deleted++
+	c.mu.Unlock()
+}
+
+func (c *revalidationCounters) get() RevalidationStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	if stats.Revalidations > 0 {
+		stats.HitRate = float64(stats.NotModified) / float64(stats.Revalidations)
+	}
+	return stats
+}
+
+// 缓存的Last-Modified, 兼容S3Meta2Headers保存的RFC1123(UTC)格式
+func (this *ImageWithMeta) lastModified() time.Time {
+	value := this.Header("Last-Modified")
+	if len(value) == 0 {
+		return time.Time{}
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t
+	}
+	t, _ := time.Parse(time.RFC1123, value)
+	return t
+}
@@ -0,0 +1,158 @@
+package imageproxy
+
+import (
+	"bytes"
+	"cache"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// memOrigins 是OriginStore在内存中的实现, 按照etag返回304
+type memOrigins struct {
+	content []byte
+	etag    string
+	err     error
+
+	gets        int
+	conditional int
+}
+
+func (s *memOrigins) GetIfModified(key, etag string, lastModified time.Time) ([]byte, []byte, bool, error) {
+	s.gets++
+	if len(etag) > 0 {
+		s.conditional++
+	}
+	if s.err != nil {
+		return nil, nil, false, s.err
+	}
+	if s.content == nil {
+		return nil, nil, false, awserr.New("NoSuchKey", "not found", nil)
+	}
+	if len(etag) > 0 && etag == s.etag {
+		return nil, nil, true, nil
+	}
+	headers := "Cache-Control: max-age=2592000\nETag: " + s.etag + "\nLast-Modified: " + time.Now().UTC().Format(time.RFC1123) + "\n"
+	return s.content, []byte(headers), false, nil
+}
+
+func testPNG(width int) []byte {
+	buf := new(bytes.Buffer)
+	png.Encode(buf, image.NewNRGBA(image.Rect(0, 0, width, 1)))
+	return buf.Bytes()
+}
+
+// go test imageproxy -v -run "TestS3ResourceProcessRevalidation"
+func TestS3ResourceProcessRevalidation(t *testing.T) {
+	origins := &memOrigins{content: testPNG(1), etag: `"v1"`}
+	tr := &TransformingTransport{
+		Cache:     cache.NewMemoryCache(),
+		Origins:   origins,
+		OriginTTL: time.Hour,
+	}
+
+	// 使用png, 不做转换时返回原始数据
+	get := func() []byte {
+		req, _ := http.NewRequest("GET", "http://awss3/production/a.png#0x0", nil)
+		resp, err := tr.S3ResourceProcess(req)
+		if err != nil {
+			t.Fatalf("S3ResourceProcess returned unexpected error: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("S3ResourceProcess returned status %d", resp.StatusCode)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		return body
+	}
+	// 将缓存的原始数据设置为过期
+	expire := func() {
+		key := "v2:http://awss3/production/a.png"
+		data, _ := tr.Cache.Get(key)
+		meta, err := NewImageWithMetaFromCache(data)
+		if err != nil {
+			t.Fatalf("origin was not cached: %v", err)
+		}
+		meta.Created = time.Now().Add(-2 * time.Hour)
+		tr.Cache.Set(key, meta.Bytes())
+	}
+
+	get()
+	get()
+	if origins.gets != 1 {
+		t.Fatalf("fetched origin %d times, want 1", origins.gets)
+	}
+
+	// 过期之后条件请求, 304时继续使用缓存的数据
+	expire()
+	if body := get(); !bytes.Equal(body, origins.content) {
+		t.Error("revalidated origin returned different content")
+	}
+	if origins.conditional != 1 {
+		t.Fatalf("sent %d conditional requests, want 1", origins.conditional)
+	}
+	get()
+	if origins.gets != 2 {
+		t.Fatalf("fetched origin %d times after 304, want 2", origins.gets)
+	}
+
+	// S3出错时继续使用过期的数据
+	expire()
+	origins.err = errors.New("s3 unavailable")
+	get()
+	origins.err = nil
+
+	// 修改之后重新下载
+	origins.content, origins.etag = testPNG(2), `"v2"`
+	if body := get(); !bytes.Equal(body, origins.content) {
+		t.Error("modified origin was not downloaded again")
+	}
+
+	want := RevalidationStats{Revalidations: 3, NotModified: 1, Modified: 1, Errors: 1, HitRate: 1.0 / 3}
+	if got := tr.RevalidationStats(); got != want {
+		t.Errorf("RevalidationStats() returned %+v, want %+v", got, want)
+	}
+
+	// 删除之后返回404, 并且不再保留缓存
+	expire()
+	origins.content = nil
+	req, _ := http.NewRequest("GET", "http://awss3/production/a.png#0x0", nil)
+	if resp, err := tr.S3ResourceProcess(req); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("deleted origin did not return 404: %v, %v", resp, err)
+	}
+	if tr.Cache.Exists("v2:http://awss3/production/a.png") {
+		t.Error("deleted origin is still cached")
+	}
+	want = RevalidationStats{Revalidations: 4, NotModified: 1, Modified: 1, Errors: 1, Deleted: 1, HitRate: 1.0 / 4}
+	if got := tr.RevalidationStats(); got != want {
+		t.Errorf("RevalidationStats() after delete returned %+v, want %+v", got, want)
+	}
+}
+
+func TestImageWithMeta_Header(t *testing.T) {
+	meta := &ImageWithMeta{Headers: []byte("Cache-Control: max-age=60\nETag: \"abc\"\nLast-Modified: Mon, 02 Jan 2006 15:04:05 UTC\n")}
+	if got := meta.Header("Etag"); got != `"abc"` {
+		t.Errorf("Header(Etag) returned %q", got)
+	}
+	if got := meta.Header("Expires"); got != "" {
+		t.Errorf("Header(Expires) returned %q", got)
+	}
+	want := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	if got := meta.lastModified(); !got.Equal(want) {
+		t.Errorf("lastModified() returned %v, want %v", got, want)
+	}
+}
+
+func TestProxy_serveStats(t *testing.T) {
+	p := NewProxy(nil, nil, nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "/tools/im/_stats", nil))
+	if w.Code != http.StatusOK || !bytes.Contains(w.Body.Bytes(), []byte(`"origin_revalidation"`)) {
+		t.Errorf("serveStats returned %d: %s", w.Code, w.Body.String())
+	}
+}
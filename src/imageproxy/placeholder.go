@@ -0,0 +1,169 @@
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/chai2010/webp"
+	"github.com/disintegration/imaging"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"media_utils"
+)
+
+const (
+	// fblurhash: 返回图片的BlurHash字符串
+	formatBlurHash = "blurhash"
+
+	// BlurHash的分量个数
+	blurHashComponentsX = 4
+	blurHashComponentsY = 3
+
+	// 计算BlurHash时, 先将图片缩小到这个尺寸
+	blurHashSampleSize = 32
+
+	// LQIP的最长边
+	lqipSize    = 20
+	lqipQuality = 40
+
+	base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+)
+
+//
+// 计算图片的BlurHash(https://blurha.sh), componentsX, componentsY 的取值范围为 1-9
+//
+func BlurHash(m image.Image, componentsX, componentsY int) string {
+	small := imaging.Fit(m, blurHashSampleSize, blurHashSampleSize, imaging.Box)
+	bounds := small.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	// 每个分量对应的(r, g, b)
+	factors := make([][3]float64, 0, componentsX*componentsY)
+	for j := 0; j < componentsY; j++ {
+		for i := 0; i < componentsX; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1.0
+			}
+
+			var r, g, b float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					c := small.NRGBAAt(bounds.Min.X+x, bounds.Min.Y+y)
+					r += basis * srgbToLinear(c.R)
+					g += basis * srgbToLinear(c.G)
+					b += basis * srgbToLinear(c.B)
+				}
+			}
+
+			scale := normalisation / float64(w*h)
+			factors = append(factors, [3]float64{r * scale, g * scale, b * scale})
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteString(encodeBase83((componentsX-1)+(componentsY-1)*9, 1))
+
+	dc, ac := factors[0], factors[1:]
+	maximumValue := 1.0
+	if len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = math.Max(actualMax, math.Max(math.Abs(f[0]), math.Max(math.Abs(f[1]), math.Abs(f[2]))))
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maximumValue = float64(quantisedMax+1) / 166
+		buf.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		buf.WriteString(encodeBase83(0, 1))
+	}
+
+	dcValue := linearToSrgb(dc[0])<<16 | linearToSrgb(dc[1])<<8 | linearToSrgb(dc[2])
+	buf.WriteString(encodeBase83(dcValue, 4))
+
+	for _, f := range ac {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+		}
+		buf.WriteString(encodeBase83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+	return buf.String()
+}
+
+//
+// 生成一个很小的图片(Low Quality Image Placeholder), 以data URI的格式返回
+// format 为空或者不支持时使用jpeg
+//
+func LQIP(m image.Image, format string) (string, error) {
+	small := imaging.Fit(m, lqipSize, lqipSize, imaging.Box)
+
+	buf := new(bytes.Buffer)
+	var err error
+	switch format {
+	case media_utils.ImageFormatWebp:
+		err = webp.Encode(buf, small, &webp.Options{Lossless: false, Quality: lqipQuality})
+	case media_utils.ImageFormatPng:
+		err = png.Encode(buf, small)
+	default:
+		format = media_utils.ImageFormatJpeg
+		err = jpeg.Encode(buf, small, &jpeg.Options{Quality: lqipQuality})
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("data:%s;base64,%s", FileContentType(format), base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+//
+// 将图片转换成为placeholder: BlurHash或者LQIP
+//
+func TransformPlaceholder(img []byte, opt Options) ([]byte, error) {
+	m, _, err := image.Decode(bytes.NewReader(img))
+	if err != nil {
+		return nil, err
+	}
+
+	if opt.Format == formatBlurHash {
+		return []byte(BlurHash(m, blurHashComponentsX, blurHashComponentsY)), nil
+	}
+
+	lqip, err := LQIP(m, opt.Format)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(lqip), nil
+}
+
+func encodeBase83(value, length int) string {
+	result := make([]byte, length)
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		result[i-1] = base83Chars[digit]
+	}
+	return string(result)
+}
+
+func srgbToLinear(value uint8) float64 {
+	v := float64(value) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSrgb(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
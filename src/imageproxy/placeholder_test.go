@@ -0,0 +1,109 @@
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// go test imageproxy -v -run "TestBlurHash"
+func TestBlurHash(t *testing.T) {
+	tests := []struct {
+		img  image.Image
+		x, y int
+		want string
+	}{
+		// 黑色图片的所有分量都为0
+		{newImage(8, 8, color.NRGBA{0, 0, 0, 255}), 4, 3, "L00000" + strings.Repeat("fQ", 11)},
+		{newImage(8, 8, red), 4, 3, "LfTI:j|cfQ|c|csUfQsUfQfQfQfQ"},
+		{newImage(8, 8, red), 1, 1, "00TI:j"},
+		{newImage(2, 2, red, green, blue, yellow), 4, 3, "L~Lqdf|ldU|l~h|c_X|cfH|T|T|T"},
+	}
+	for _, tt := range tests {
+		if got := BlurHash(tt.img, tt.x, tt.y); got != tt.want {
+			t.Errorf("BlurHash(%v, %d, %d) returned %s, want %s", tt.img.Bounds(), tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+// go test imageproxy -v -run "TestLQIP"
+func TestLQIP(t *testing.T) {
+	src := newImage(100, 50, red)
+
+	tests := []struct {
+		format string
+		prefix string
+	}{
+		{"", "data:image/jpeg;base64,"},
+		{"jpeg", "data:image/jpeg;base64,"},
+		{"png", "data:image/png;base64,"},
+		{"webp", "data:image/webp;base64,"},
+	}
+	for _, tt := range tests {
+		got, err := LQIP(src, tt.format)
+		if err != nil {
+			t.Errorf("LQIP(%q) returned unexpected error: %v", tt.format, err)
+			continue
+		}
+		if !strings.HasPrefix(got, tt.prefix) {
+			t.Errorf("LQIP(%q) returned %s, want prefix %s", tt.format, got, tt.prefix)
+			continue
+		}
+
+		data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(got, tt.prefix))
+		if err != nil {
+			t.Errorf("LQIP(%q) returned invalid base64: %v", tt.format, err)
+			continue
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("LQIP(%q) returned invalid image: %v", tt.format, err)
+		} else if config.Width != lqipSize || config.Height != lqipSize/2 {
+			t.Errorf("LQIP(%q) returned %dx%d image, want %dx%d", tt.format, config.Width, config.Height, lqipSize, lqipSize/2)
+		}
+	}
+}
+
+// go test imageproxy -v -run "TestTransformingTransportPlaceholder"
+func TestTransformingTransportPlaceholder(t *testing.T) {
+	client := new(http.Client)
+	tr := &TransformingTransport{
+		Transport:   testTransport{},
+		CacheClient: client,
+	}
+	client.Transport = tr
+
+	tests := []struct {
+		url    string
+		prefix string
+	}{
+		{"http://good.test/png#0x0,fblurhash", "L00000"},
+		{"http://good.test/png#0x0,lqip", "data:image/jpeg;base64,"},
+		{"http://good.test/png#0x0,fpng,lqip", "data:image/png;base64,"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Errorf("RoundTrip(%v) returned unexpected error: %v", tt.url, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if got, want := resp.Header.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+			t.Errorf("RoundTrip(%v) returned Content-Type %s, want %s", tt.url, got, want)
+		}
+		if got := resp.Header.Get("Cache-Control"); got == "" {
+			t.Errorf("RoundTrip(%v) returned no Cache-Control header", tt.url)
+		}
+		if !strings.HasPrefix(string(body), tt.prefix) {
+			t.Errorf("RoundTrip(%v) returned %s, want prefix %s", tt.url, body, tt.prefix)
+		}
+	}
+}
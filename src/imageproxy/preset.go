@@ -0,0 +1,195 @@
+package imageproxy
+
+import (
+	"bufio"
+	"fmt"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	optPresetPrefix = "p:"
+)
+
+//
+// 命名的图片处理参数, 配置文件格式和conf/aws.ini一致:
+//   # 注释
+//   avatar_small=200x200,q80
+//   avatar_large=640x640,q85
+//
+// 请求中通过 /tools/im/p:avatar_small/{key} 来引用, 客户端不用再硬编码具体的参数
+//
+type Presets struct {
+	Path string // 配置文件路径, Reload时重新读取; 为空时通过Update修改
+	Only bool   // 只允许使用preset, 拒绝原始的options字符串; 修改时通过Update
+
+	mu    sync.RWMutex
+	items map[string]string
+}
+
+// NewPresets reads the presets defined in the file at path.
+func NewPresets(path string) (*Presets, error) {
+	p := &Presets{Path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//
+// 重新读取配置文件; 如果文件格式错误，则保留之前的presets
+//
+func (p *Presets) Reload() error {
+	f, err := os.Open(p.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	items, err := ParsePresets(f)
+	if err != nil {
+		return fmt.Errorf("presets %s: %v", p.Path, err)
+	}
+
+	p.mu.Lock()
+	p.items = items
+	p.mu.Unlock()
+
+	log.Printf("Improxy presets loaded: %s, count: %d", p.Path, len(items))
+	return nil
+}
+
+// NewPresetsFromMap creates the presets defined in a config file.
+func NewPresetsFromMap(items map[string]string, only bool) (*Presets, error) {
+	p := &Presets{}
+	if err := p.Update(items, only); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+//
+// 替换所有的presets; 如果有错误的preset, 则保留之前的presets
+//
+func (p *Presets) Update(items map[string]string, only bool) error {
+	copied := make(map[string]string, len(items))
+	for name, value := range items {
+		value = strings.TrimSpace(value)
+		if err := validatePreset(name, value); err != nil {
+			return err
+		}
+		copied[name] = value
+	}
+
+	p.mu.Lock()
+	p.items, p.Only = copied, only
+	p.mu.Unlock()
+	return nil
+}
+
+// Get returns the option string of the named preset.
+func (p *Presets) Get(name string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	p.mu.RLock()
+	value, ok := p.items[name]
+	p.mu.RUnlock()
+	return value, ok
+}
+
+// Names returns the sorted names of all presets.
+func (p *Presets) Names() []string {
+	if p == nil {
+		return nil
+	}
+	p.mu.RLock()
+	names := make([]string, 0, len(p.items))
+	for name := range p.items {
+		names = append(names, name)
+	}
+	p.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+//
+// 将options中的"p:{name}"展开为preset对应的参数, 其他的参数保持不变:
+//   p:avatar_small      --> 200x200,q80
+//   p:avatar_small,fpng --> 200x200,q80,fpng
+//
+// 在Only模式下, options中只能包含preset
+//
+func (p *Presets) Expand(str string) (string, error) {
+	only := false
+	if p != nil {
+		p.mu.RLock()
+		only = p.Only
+		p.mu.RUnlock()
+	}
+
+	opts := strings.Split(str, ",")
+	for i, opt := range opts {
+		if !strings.HasPrefix(opt, optPresetPrefix) {
+			if only && len(opt) > 0 {
+				return "", fmt.Errorf("option %q not allowed, use a preset", opt)
+			}
+			continue
+		}
+
+		name := strings.TrimPrefix(opt, optPresetPrefix)
+		value, ok := p.Get(name)
+		if !ok {
+			return "", fmt.Errorf("unknown preset %q", name)
+		}
+		opts[i] = value
+	}
+	return strings.Join(opts, ","), nil
+}
+
+//
+// 解析preset配置: 每行一个 name=options, 以#开头的行为注释
+//
+func ParsePresets(r io.Reader) (map[string]string, error) {
+	items := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("line %d: missing '='", lineNo)
+		}
+		name := strings.TrimSpace(parts[0])
+		value := strings.TrimSpace(parts[1])
+		if err := validatePreset(name, value); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		items[name] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func validatePreset(name, value string) error {
+	if len(name) == 0 || strings.ContainsAny(name, ",/") {
+		return fmt.Errorf("invalid preset name %q", name)
+	}
+	// preset不能嵌套引用
+	if strings.Contains(value, optPresetPrefix) {
+		return fmt.Errorf("preset %s references another preset", name)
+	}
+	return nil
+}
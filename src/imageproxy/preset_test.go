@@ -0,0 +1,241 @@
+package imageproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// go test imageproxy -v -run "TestParsePresets"
+func TestParsePresets(t *testing.T) {
+	conf := `
+# 头像
+avatar_small = 200x200,q80
+avatar_large=640x640,q85
+
+cover=0.5x,fit
+`
+	got, err := ParsePresets(strings.NewReader(conf))
+	if err != nil {
+		t.Fatalf("ParsePresets returned unexpected error: %v", err)
+	}
+	want := map[string]string{
+		"avatar_small": "200x200,q80",
+		"avatar_large": "640x640,q85",
+		"cover":        "0.5x,fit",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ParsePresets returned %v, want %v", got, want)
+	}
+
+	invalid := []string{
+		"avatar_small",
+		"=200x200",
+		"a/b=200x200",
+		"a=p:b",
+	}
+	for _, conf := range invalid {
+		if _, err := ParsePresets(strings.NewReader(conf)); err == nil {
+			t.Errorf("ParsePresets(%q) did not return expected error", conf)
+		}
+	}
+}
+
+// go test imageproxy -v -run "TestPresetsExpand"
+func TestPresetsExpand(t *testing.T) {
+	presets := &Presets{items: map[string]string{
+		"avatar_small": "200x200,q80",
+	}}
+
+	tests := []struct {
+		only        bool
+		input       string
+		output      string
+		expectError bool
+	}{
+		{false, "", "", false},
+		{false, "100x100", "100x100", false},
+		{false, "p:avatar_small", "200x200,q80", false},
+		{false, "p:avatar_small,fpng", "200x200,q80,fpng", false},
+		{false, "p:unknown", "", true},
+
+		// 只允许preset
+		{true, "", "", false},
+		{true, "p:avatar_small", "200x200,q80", false},
+		{true, "100x100", "", true},
+		{true, "p:avatar_small,fpng", "", true},
+	}
+
+	for _, tt := range tests {
+		presets.Only = tt.only
+		got, err := presets.Expand(tt.input)
+		if tt.expectError {
+			if err == nil {
+				t.Errorf("Expand(%q) with only=%v did not return expected error", tt.input, tt.only)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Expand(%q) with only=%v returned unexpected error: %v", tt.input, tt.only, err)
+		} else if got != tt.output {
+			t.Errorf("Expand(%q) with only=%v returned %q, want %q", tt.input, tt.only, got, tt.output)
+		}
+	}
+
+	// nil presets只能处理原始的options
+	var nilPresets *Presets
+	if got, err := nilPresets.Expand("100x100"); err != nil || got != "100x100" {
+		t.Errorf("nil Presets Expand returned (%q, %v)", got, err)
+	}
+	if _, err := nilPresets.Expand("p:avatar_small"); err == nil {
+		t.Errorf("nil Presets Expand did not return expected error")
+	}
+}
+
+// go test imageproxy -v -run "TestPresetsReload"
+func TestPresetsReload(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "presets")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	path := filepath.Join(tempDir, "presets.ini")
+	ioutil.WriteFile(path, []byte("avatar=100x100\n"), 0644)
+
+	presets, err := NewPresets(path)
+	if err != nil {
+		t.Fatalf("NewPresets returned unexpected error: %v", err)
+	}
+	if value, _ := presets.Get("avatar"); value != "100x100" {
+		t.Errorf("Get(avatar) returned %q, want 100x100", value)
+	}
+
+	// 修改配置
+	ioutil.WriteFile(path, []byte("avatar=200x200\n"), 0644)
+	if err := presets.Reload(); err != nil {
+		t.Fatalf("Reload returned unexpected error: %v", err)
+	}
+	if value, _ := presets.Get("avatar"); value != "200x200" {
+		t.Errorf("Get(avatar) after reload returned %q, want 200x200", value)
+	}
+
+	// 错误的配置不影响已有的presets
+	ioutil.WriteFile(path, []byte("avatar\n"), 0644)
+	if err := presets.Reload(); err == nil {
+		t.Errorf("Reload of invalid file did not return expected error")
+	}
+	if value, _ := presets.Get("avatar"); value != "200x200" {
+		t.Errorf("Get(avatar) after failed reload returned %q, want 200x200", value)
+	}
+}
+
+func TestPresetsUpdate(t *testing.T) {
+	presets, err := NewPresetsFromMap(map[string]string{"avatar": " 100x100 "}, false)
+	if err != nil {
+		t.Fatalf("NewPresetsFromMap returned unexpected error: %v", err)
+	}
+	if value, _ := presets.Get("avatar"); value != "100x100" {
+		t.Errorf("Get(avatar) returned %q, want 100x100", value)
+	}
+
+	if err := presets.Update(map[string]string{"cover": "750x"}, true); err != nil {
+		t.Fatalf("Update returned unexpected error: %v", err)
+	}
+	if _, ok := presets.Get("avatar"); ok {
+		t.Errorf("Get(avatar) found a removed preset")
+	}
+	if _, err := presets.Expand("100x"); err == nil {
+		t.Errorf("Expand of raw options did not return expected error after Update(only)")
+	}
+
+	// 错误的配置不影响已有的presets
+	if err := presets.Update(map[string]string{"a/b": "10x"}, false); err == nil {
+		t.Errorf("Update with invalid name did not return expected error")
+	}
+	if err := presets.Update(map[string]string{"nested": "p:cover"}, false); err == nil {
+		t.Errorf("Update with nested preset did not return expected error")
+	}
+	if value, _ := presets.Get("cover"); value != "750x" || !presets.Only {
+		t.Errorf("failed Update changed presets: %q, only: %v", value, presets.Only)
+	}
+}
+
+// go test imageproxy -v -run "TestNewRequestWithPresets"
+func TestNewRequestWithPresets(t *testing.T) {
+	presets := &Presets{items: map[string]string{
+		"avatar_small": "200x200,q80",
+	}}
+
+	tests := []struct {
+		URL         string
+		only        bool
+		RemoteURL   string
+		Options     Options
+		ExpectError bool
+	}{
+		{
+			"http://localhost/tools/im/p:avatar_small/production/a.jpeg", false,
+			"http://awss3/production/a.jpeg", Options{Width: 200, Height: 200, Quality: 80}, false,
+		},
+		{
+			"http://localhost/tools/im/p:avatar_small,fpng/production/a.jpeg", false,
+			"http://awss3/production/a.jpeg", Options{Width: 200, Height: 200, Quality: 80, Format: "png"}, false,
+		},
+		{
+			"http://localhost/tools/im/100x100/production/a.jpeg", false,
+			"http://awss3/production/a.jpeg", Options{Width: 100, Height: 100}, false,
+		},
+		{
+			"http://localhost/tools/im/p:unknown/production/a.jpeg", false, "", emptyOptions, true,
+		},
+
+		// 只允许preset
+		{
+			"http://localhost/tools/im/p:avatar_small/production/a.jpeg", true,
+			"http://awss3/production/a.jpeg", Options{Width: 200, Height: 200, Quality: 80}, false,
+		},
+		{
+			"http://localhost/tools/im/100x100/production/a.jpeg", true, "", emptyOptions, true,
+		},
+	}
+
+	awsUrl, _ := url.Parse("http://awss3")
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.URL, nil)
+		presets.Only = tt.only
+
+		r, err := NewRequest(req, awsUrl, presets)
+		if tt.ExpectError {
+			if err == nil {
+				t.Errorf("NewRequest(%q) did not return expected error", tt.URL)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("NewRequest(%q) return unexpected error: %v", tt.URL, err)
+			continue
+		}
+
+		if got, want := r.URL.String(), tt.RemoteURL; got != want {
+			t.Errorf("NewRequest(%q) request URL = %v, want %v", tt.URL, got, want)
+		}
+		if got, want := r.Options, tt.Options; got != want {
+			t.Errorf("NewRequest(%q) request options = %v, want %v", tt.URL, got, want)
+		}
+	}
+}
+
+func TestPresets_Names(t *testing.T) {
+	p := &Presets{items: map[string]string{"b": "100", "a": "200"}}
+	if got := strings.Join(p.Names(), ","); got != "a,b" {
+		t.Errorf("Names() returned %q, want a,b", got)
+	}
+	if names := (*Presets)(nil).Names(); len(names) != 0 {
+		t.Errorf("nil Names() returned %v", names)
+	}
+}
@@ -0,0 +1,67 @@
+package imageproxy
+
+import (
+	"fmt"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"media_utils"
+	"net/http"
+	"strings"
+)
+
+var (
+	// POST /tools/im/_purge/{key}?tk={token} 删除图片的所有缓存
+	PURGE_PATH_PREFIX = "/" + kCloudFrontPattern + "_purge/"
+)
+
+type PurgeResult struct {
+	Succeed  bool     `json:"succeed"`
+	Message  string   `json:"msg"`
+	Keys     []string `json:"keys"`     // 被删除的缓存key
+	Variants []string `json:"variants"` // 从VariantStore中删除的key
+}
+
+//
+// 删除图片的原始数据以及所有的variants(尺寸, 格式, ts版本等), 包括VariantStore中持久化的variants
+// 签名机制和图片的访问一致, path为tools/im/_purge/{key}
+// 只删除当前实例的本地缓存以及共享的缓存(redis, VariantStore); 多个实例时需要分别purge, 见tool_image_purge
+//
+func (p *Proxy) servePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		writeJSONResult(w, http.StatusMethodNotAllowed, &PurgeResult{Message: "method not allowed"})
+		return
+	}
+
+	queries := r.URL.Query()
+	if !media_utils.SimpleVerify(r.URL.Path, queries.Get(media_utils.ParamVersionTs), queries.Get(media_utils.ParamToken), true) {
+		writeJSONResult(w, http.StatusForbidden, &PurgeResult{Message: "invalid signature"})
+		return
+	}
+
+	u, err := parseURL(strings.TrimPrefix(r.URL.Path, PURGE_PATH_PREFIX))
+	if err != nil || len(u.Path) == 0 {
+		writeJSONResult(w, http.StatusBadRequest, &PurgeResult{Message: fmt.Sprintf("invalid key: %v", err)})
+		return
+	}
+	if p.DefaultBaseURL != nil {
+		u = p.DefaultBaseURL.ResolveReference(u)
+	}
+
+	result := &PurgeResult{Succeed: true, Keys: p.Index.Purge(u)}
+	if p.transformer != nil && p.transformer.Variants != nil {
+		if result.Variants, err = p.transformer.Variants.DeletePrefix(VariantPrefix(u)); err != nil {
+			log.ErrorErrorf(err, "Purge variants failed: %s", u.String())
+			result.Succeed, result.Message = false, fmt.Sprintf("purge variants: %v", err)
+			writeJSONResult(w, http.StatusInternalServerError, result)
+			return
+		}
+	}
+	log.Printf("Purge: %s, keys: %d, variants: %d", u.String(), len(result.Keys), len(result.Variants))
+
+	writeJSONResult(w, http.StatusOK, result)
+}
+
+// PurgeURL returns the signed path used to purge key from the cache.
+func PurgeURL(key string) string {
+	path := strings.TrimPrefix(PURGE_PATH_PREFIX, "/") + strings.TrimPrefix(key, "/")
+	return "/" + media_utils.SimpleSignUrl(path, "", 3600)
+}
@@ -0,0 +1,149 @@
+package imageproxy
+
+import (
+	"cache"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+// go test imageproxy -v -run "TestProxy_ServePurge"
+func TestProxy_ServePurge(t *testing.T) {
+	var wg sync.WaitGroup
+	p := NewProxy(nil, cache.NewMemoryCache(), &wg)
+	p.DefaultBaseURL, _ = url.Parse("http://awss3/")
+
+	key := "production/improxy/6a/82e2c962fb727886aa6d7cce7107d7.jpeg"
+	u := p.DefaultBaseURL.ResolveReference(&url.URL{Path: key})
+	variants := []string{"v2:" + u.String(), u.String() + "_100x100", u.String() + "_200x0,fwebp"}
+
+	signed := "http://localhost" + PurgeURL(key)
+
+	tests := []struct {
+		method string
+		url    string
+		code   int
+		keys   int
+	}{
+		{"GET", signed, http.StatusMethodNotAllowed, 0},
+		{"POST", "http://localhost" + PURGE_PATH_PREFIX + key, http.StatusForbidden, 0},
+		{"POST", signed + "x", http.StatusForbidden, 0},
+		{"POST", signed, http.StatusOK, len(variants)},
+		// 再次purge时已经没有缓存
+		{"POST", signed, http.StatusOK, 0},
+	}
+
+	for _, v := range variants {
+		p.Index.Cache.Set(v, []byte(v))
+		p.Index.Add(u, v)
+	}
+
+	for i, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.url, nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("%d. purge returned status %d, want %d: %s", i, got, want, resp.Body.String())
+		}
+
+		var result PurgeResult
+		if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+			t.Errorf("%d. purge returned invalid json %s: %v", i, resp.Body.String(), err)
+			continue
+		}
+		if result.Succeed != (tt.code == http.StatusOK) {
+			t.Errorf("%d. purge returned %+v", i, result)
+		}
+		if got, want := len(result.Keys), tt.keys; got != want {
+			t.Errorf("%d. purge returned %d keys, want %d", i, got, want)
+		}
+	}
+
+	for _, v := range variants {
+		if p.Index.Cache.Exists(v) {
+			t.Errorf("purge did not delete %s", v)
+		}
+	}
+}
+
+// go test imageproxy -v -run "TestProxy_ServePurge_Shared"
+func TestProxy_ServePurge_Shared(t *testing.T) {
+	var wg sync.WaitGroup
+	p1 := NewProxy(nil, cache.NewMemoryCache(), &wg)
+	p2 := NewProxy(nil, cache.NewMemoryCache(), &wg)
+	p1.DefaultBaseURL, _ = url.Parse("http://awss3/")
+	p2.DefaultBaseURL = p1.DefaultBaseURL
+
+	// 两个实例共享同一个索引(例如: redis), 本地缓存各自独立
+	p1.Index.Shared = true
+	p2.Index.Store, p2.Index.Shared = p1.Index.Store, true
+
+	key := "production/improxy/6a/82e2c962fb727886aa6d7cce7107d7.jpeg"
+	u := p1.DefaultBaseURL.ResolveReference(&url.URL{Path: key})
+	variants := []string{"v2:" + u.String(), u.String() + "_100x100", u.String() + "_200x0,fwebp"}
+	for i, v := range variants {
+		p1.Index.Cache.Set(v, []byte(v))
+		p2.Index.Cache.Set(v, []byte(v))
+		// 只有第一个variant由p2记录索引, 其他的由p1记录
+		if i == 0 {
+			p2.Index.Add(u, v)
+		} else {
+			p1.Index.Add(u, v)
+		}
+	}
+
+	// tool_image_purge -addr host1,host2: 依次purge每个实例
+	for i, p := range []*Proxy{p1, p2} {
+		req, _ := http.NewRequest("POST", "http://localhost"+PurgeURL(key), nil)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		var result PurgeResult
+		if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+			t.Fatalf("%d. purge returned invalid json %s: %v", i, resp.Body.String(), err)
+		}
+		if got, want := len(result.Keys), len(variants); got != want {
+			t.Errorf("%d. purge returned %d keys, want %d", i, got, want)
+		}
+	}
+
+	for i, p := range []*Proxy{p1, p2} {
+		for _, v := range variants {
+			if p.Index.Cache.Exists(v) {
+				t.Errorf("%d. purge did not delete %s", i, v)
+			}
+		}
+	}
+}
+
+// go test imageproxy -v -run "TestProxy_ServePurge_Variants"
+func TestProxy_ServePurge_Variants(t *testing.T) {
+	var wg sync.WaitGroup
+	p := NewProxy(nil, cache.NewMemoryCache(), &wg)
+	p.DefaultBaseURL, _ = url.Parse("http://awss3/")
+	store := newMemVariants()
+	p.SetVariantStore(store)
+
+	store.Put("production/a.jpeg/100x100", []byte("a"), "image/jpeg", `"v1"`)
+	store.Put("production/a.jpeg/ts%3D1/100x100", []byte("a"), "image/jpeg", `"v1"`)
+	store.Put("production/b.jpeg/100x100", []byte("b"), "image/jpeg", `"v1"`)
+
+	req, _ := http.NewRequest("POST", "http://localhost"+PurgeURL("production/a.jpeg"), nil)
+	resp := httptest.NewRecorder()
+	p.ServeHTTP(resp, req)
+
+	var result PurgeResult
+	if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil || !result.Succeed {
+		t.Fatalf("purge returned %d: %s", resp.Code, resp.Body.String())
+	}
+	if got := len(result.Variants); got != 2 {
+		t.Errorf("purge deleted %d variants, want 2: %q", got, result.Variants)
+	}
+	if _, ok := store.objects["production/b.jpeg/100x100"]; !ok || len(store.objects) != 1 {
+		t.Errorf("store has %d objects after purge, want only production/b.jpeg", len(store.objects))
+	}
+}
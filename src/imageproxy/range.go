@@ -0,0 +1,101 @@
+package imageproxy
+
+import (
+	"cache"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errUnsatisfiableRange = errors.New("invalid range")
+
+type byteRange struct {
+	start, length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+//
+// 解析Range: bytes=start-end, bytes=start-, bytes=-suffix
+// 只支持单个range; 多个range或者不认识的单位(例如: items=0-1)时ok为false, 返回完整的内容
+//
+func parseRange(header string, size int64) (r byteRange, ok bool, err error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return r, false, nil
+	}
+	spec := strings.TrimSpace(header[len(prefix):])
+	if strings.Contains(spec, ",") {
+		return r, false, nil
+	}
+
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return r, false, errUnsatisfiableRange
+	}
+	first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+	if len(first) == 0 {
+		// 最后的suffix个字节
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 || size == 0 {
+			return r, false, errUnsatisfiableRange
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return byteRange{size - suffix, suffix}, true, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return r, false, errUnsatisfiableRange
+	}
+	end := size - 1
+	if len(last) > 0 {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return r, false, errUnsatisfiableRange
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return byteRange{start, end - start + 1}, true, nil
+}
+
+//
+// If-Range: 只有在ETag(strong)或者Last-Modified一致时才返回部分内容, 否则返回完整的内容
+//
+func ifRangeMatches(r *http.Request, resp *http.Response) bool {
+	ifRange := r.Header.Get("If-Range")
+	if len(ifRange) == 0 {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		etag := resp.Header.Get("Etag")
+		return !strings.HasPrefix(ifRange, "W/") && len(etag) > 0 && etag == ifRange
+	}
+
+	t, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return err == nil && t.Truncate(time.Second).Equal(lastModified.Truncate(time.Second))
+}
+
+//
+// 没有从缓存中读取的response, 需要读取完整的body之后才会被写入缓存
+//
+func drainUncached(resp *http.Response) {
+	if len(resp.Header.Get(cache.XFromCache)) == 0 {
+		io.Copy(ioutil.Discard, resp.Body)
+	}
+}
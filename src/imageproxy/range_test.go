@@ -0,0 +1,130 @@
+package imageproxy
+
+import (
+	"bytes"
+	"cache"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   byteRange
+		ok     bool
+		err    bool
+	}{
+		{"bytes=0-4", byteRange{0, 5}, true, false},
+		{"bytes=5-", byteRange{5, 5}, true, false},
+		{"bytes=-3", byteRange{7, 3}, true, false},
+		{"bytes=-30", byteRange{0, 10}, true, false},
+		{"bytes=8-20", byteRange{8, 2}, true, false},
+		{"bytes=0-1,4-5", byteRange{}, false, false},
+		{"bytes=10-", byteRange{}, false, true},
+		{"bytes=4-2", byteRange{}, false, true},
+		{"bytes=-0", byteRange{}, false, true},
+		{"items=0-1", byteRange{}, false, false},
+	}
+	for _, tt := range tests {
+		got, ok, err := parseRange(tt.header, 10)
+		if got != tt.want || ok != tt.ok || (err != nil) != tt.err {
+			t.Errorf("parseRange(%q) returned %v, %v, %v", tt.header, got, ok, err)
+		}
+	}
+}
+
+// drainReader 记录body是否被完整的读取
+type drainReader struct {
+	*bytes.Reader
+	closed bool
+}
+
+func (r *drainReader) Close() error {
+	r.closed = true
+	return nil
+}
+
+func rangeResponse(cached bool) (*http.Response, *drainReader) {
+	body := &drainReader{Reader: bytes.NewReader([]byte("0123456789"))}
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		ContentLength: 10,
+		Header: http.Header{
+			"Content-Length": {"10"},
+			"Etag":           {`"e"`},
+			"Last-Modified":  {"Mon, 02 Jan 2006 15:04:05 GMT"},
+		},
+		Body: body,
+	}
+	if cached {
+		resp.Header.Set(cache.XFromCache, "1")
+	}
+	return resp, body
+}
+
+func TestWriteResponseToWriter_Range(t *testing.T) {
+	tests := []struct {
+		method, rangeHeader, ifRange string
+		code                         int
+		body, contentRange           string
+	}{
+		{"GET", "", "", http.StatusOK, "0123456789", ""},
+		{"GET", "bytes=2-4", "", http.StatusPartialContent, "234", "bytes 2-4/10"},
+		{"GET", "bytes=-2", `"e"`, http.StatusPartialContent, "89", "bytes 8-9/10"},
+		{"GET", "bytes=-2", "Mon, 02 Jan 2006 15:04:05 GMT", http.StatusPartialContent, "89", "bytes 8-9/10"},
+		{"GET", "bytes=2-4", `"other"`, http.StatusOK, "0123456789", ""},
+		{"GET", "bytes=0-1,4-5", "", http.StatusOK, "0123456789", ""},
+		{"GET", "bytes=20-", "", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"HEAD", "", "", http.StatusOK, "", ""},
+	}
+	for _, tt := range tests {
+		resp, _ := rangeResponse(true)
+		r := httptest.NewRequest(tt.method, "/tools/im/100/a.png", nil)
+		if len(tt.rangeHeader) > 0 {
+			r.Header.Set("Range", tt.rangeHeader)
+		}
+		if len(tt.ifRange) > 0 {
+			r.Header.Set("If-Range", tt.ifRange)
+		}
+		w := httptest.NewRecorder()
+		writeResponseToWriter(resp, w, r, Microseconds(), false)
+
+		if w.Code != tt.code || w.Header().Get("Content-Range") != tt.contentRange {
+			t.Errorf("%s %s returned %d, Content-Range %q", tt.method, tt.rangeHeader, w.Code, w.Header().Get("Content-Range"))
+		}
+		if tt.code != http.StatusRequestedRangeNotSatisfiable && w.Body.String() != tt.body {
+			t.Errorf("%s %s returned body %q, want %q", tt.method, tt.rangeHeader, w.Body.String(), tt.body)
+		}
+		if tt.code == http.StatusPartialContent && w.Header().Get("Content-Length") != "3" && w.Header().Get("Content-Length") != "2" {
+			t.Errorf("%s %s returned Content-Length %q", tt.method, tt.rangeHeader, w.Header().Get("Content-Length"))
+		}
+	}
+}
+
+func TestWriteResponseToWriter_Head(t *testing.T) {
+	// 缓存命中时不读取body
+	resp, body := rangeResponse(true)
+	w := httptest.NewRecorder()
+	writeResponseToWriter(resp, w, httptest.NewRequest("HEAD", "/tools/im/100/a.png", nil), Microseconds(), false)
+	if w.Header().Get("Content-Length") != "10" || w.Body.Len() != 0 {
+		t.Errorf("HEAD returned Content-Length %q, body %q", w.Header().Get("Content-Length"), w.Body.String())
+	}
+	if body.Len() != 10 || !body.closed {
+		t.Errorf("HEAD read %d bytes of a cached body", 10-body.Len())
+	}
+
+	// 没有命中缓存时读取完整的body, 以便写入缓存
+	for _, r := range []*http.Request{
+		httptest.NewRequest("HEAD", "/tools/im/100/a.png", nil),
+		httptest.NewRequest("GET", "/tools/im/100/a.png", nil),
+	} {
+		r.Header.Set("Range", "bytes=0-1")
+		resp, body = rangeResponse(false)
+		writeResponseToWriter(resp, httptest.NewRecorder(), r, Microseconds(), false)
+		if rest, _ := ioutil.ReadAll(body); len(rest) != 0 {
+			t.Errorf("%s left %d bytes of an uncached body", r.Method, len(rest))
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package imageproxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+const (
+	// GET /ready-check 深度的readiness检查, /health-check只表示进程存活
+	kReadyPath = "/ready-check"
+
+	defaultReadyTimeout = 2 * time.Second
+)
+
+//
+// readiness检查的配置; 没有配置的检查会被跳过
+//
+type ReadyOptions struct {
+	CanaryKey     string        // 原始图片存储中必须存在的key, 通过HEAD验证S3可以访问
+	CacheDir      string        // 磁盘缓存的目录, 需要可写
+	MinFreeBytes  uint64        // CacheDir所在的磁盘的最小剩余空间
+	MaxTransforms int           // 同时处理的transform超过这个数量时认为已经饱和, 0时为 4 * NumCPU
+	Timeout       time.Duration // 单个检查的超时时间, 0时为2s
+}
+
+type ReadyCheck struct {
+	OK      bool    `json:"ok"`
+	Error   string  `json:"error,omitempty"`
+	Elapsed float64 `json:"elapsed_ms"`
+
+	FreeBytes uint64 `json:"free_bytes,omitempty"` // cache_dir
+	Active    int    `json:"active,omitempty"`     // transform
+	Limit     int    `json:"limit,omitempty"`      // transform
+}
+
+type ReadyReport struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]*ReadyCheck `json:"checks"`
+}
+
+//
+// 原始图片存储支持HEAD(ObjectStore.Exists)时才能检查canary
+//
+type existsChecker interface {
+	Exists(key string) (bool, error)
+}
+
+// Ready runs the readiness checks and reports whether the proxy can serve traffic.
+func (p *Proxy) Ready() *ReadyReport {
+	opts := p.ReadyOptions
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultReadyTimeout
+	}
+
+	report := &ReadyReport{Ready: true, Checks: make(map[string]*ReadyCheck)}
+	add := func(name string, check *ReadyCheck) {
+		report.Checks[name] = check
+		report.Ready = report.Ready && check.OK
+	}
+
+	if p.Draining() {
+		add("draining", &ReadyCheck{Error: "shutting down"})
+	}
+	if len(opts.CanaryKey) > 0 && p.transformer != nil {
+		origins := p.transformer.origins()
+		add("s3", timedCheck(timeout, func(check *ReadyCheck) error {
+			return checkCanary(origins, opts.CanaryKey)
+		}))
+	}
+	if len(opts.CacheDir) > 0 {
+		add("cache_dir", timedCheck(timeout, func(check *ReadyCheck) error {
+			return checkCacheDir(opts.CacheDir, opts.MinFreeBytes, check)
+		}))
+	}
+	if p.transformer != nil {
+		limit := opts.MaxTransforms
+		if limit <= 0 {
+			limit = 4 * runtime.NumCPU()
+		}
+		active := p.transformer.ActiveTransforms()
+		check := &ReadyCheck{OK: active < limit, Active: active, Limit: limit}
+		if !check.OK {
+			check.Error = "transform workers saturated"
+		}
+		add("transform", check)
+	}
+	return report
+}
+
+//
+// 执行fn, 超过timeout时认为检查失败(fn在后台继续执行)
+//
+func timedCheck(timeout time.Duration, fn func(check *ReadyCheck) error) *ReadyCheck {
+	start := time.Now()
+	result := make(chan *ReadyCheck, 1)
+	go func() {
+		check := &ReadyCheck{}
+		err := fn(check)
+		check.OK = err == nil
+		if err != nil {
+			check.Error = err.Error()
+		}
+		result <- check
+	}()
+
+	var check *ReadyCheck
+	select {
+	case check = <-result:
+	case <-time.After(timeout):
+		check = &ReadyCheck{Error: fmt.Sprintf("timeout after %v", timeout)}
+	}
+	check.Elapsed = float64(time.Since(start)) / float64(time.Millisecond)
+	return check
+}
+
+func checkCanary(origins OriginStore, key string) error {
+	checker, ok := origins.(existsChecker)
+	if !ok {
+		return errors.New("origin store does not support HEAD")
+	}
+	exists, err := checker.Exists(key)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("canary key not found: %s", key)
+	}
+	return nil
+}
+
+//
+// 缓存目录可写, 并且剩余空间不少于minFree
+//
+func checkCacheDir(dir string, minFree uint64, check *ReadyCheck) error {
+	f, err := ioutil.TempFile(dir, ".ready-check-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte("ok"))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	os.Remove(f.Name())
+	if err != nil {
+		return err
+	}
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return err
+	}
+	check.FreeBytes = uint64(st.Bavail) * uint64(st.Bsize)
+	if check.FreeBytes < minFree {
+		return fmt.Errorf("free space %d below %d", check.FreeBytes, minFree)
+	}
+	return nil
+}
+
+func (p *Proxy) serveReady(w http.ResponseWriter, r *http.Request) {
+	report := p.Ready()
+	status := http.StatusOK
+	if !report.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSONResult(w, status, report)
+}
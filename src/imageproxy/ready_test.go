@@ -0,0 +1,130 @@
+package imageproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// canaryOrigins 支持HEAD的原始图片存储
+type canaryOrigins struct {
+	memOrigins
+	exists bool
+	err    error
+	delay  time.Duration
+}
+
+func (s *canaryOrigins) Exists(key string) (bool, error) {
+	time.Sleep(s.delay)
+	return s.exists, s.err
+}
+
+func newReadyProxy(origins OriginStore) *Proxy {
+	p := NewProxy(nil, nil, &sync.WaitGroup{})
+	p.transformer.Origins = origins
+	return p
+}
+
+func TestProxy_Ready(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	origins := &canaryOrigins{exists: true}
+	p := newReadyProxy(origins)
+	p.ReadyOptions = ReadyOptions{CanaryKey: "canary.png", CacheDir: dir, MaxTransforms: 2}
+
+	report := p.Ready()
+	if !report.Ready {
+		t.Fatalf("Ready() = %+v, want ready", report)
+	}
+	for _, name := range []string{"s3", "cache_dir", "transform"} {
+		if check, ok := report.Checks[name]; !ok || !check.OK {
+			t.Errorf("check %s = %+v", name, check)
+		}
+	}
+	if report.Checks["cache_dir"].FreeBytes == 0 {
+		t.Errorf("cache_dir check reported no free space")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("cache_dir check left %d files behind", len(files))
+	}
+
+	// 每一项检查失败都导致not ready
+	tests := []struct {
+		name  string
+		setup func()
+	}{
+		{"s3", func() { origins.exists = false }},
+		{"s3", func() { origins.err = errors.New("access denied") }},
+		{"s3", func() {
+			origins.delay = 50 * time.Millisecond
+			p.ReadyOptions.Timeout = 10 * time.Millisecond
+		}},
+		{"cache_dir", func() { p.ReadyOptions.MinFreeBytes = 1 << 62 }},
+		{"cache_dir", func() { p.ReadyOptions.CacheDir = dir + "/missing" }},
+		{"transform", func() { p.transformer.transforming = 2 }},
+		{"draining", func() { p.StartDraining() }},
+	}
+	for i, tt := range tests {
+		p.ReadyOptions = ReadyOptions{CanaryKey: "canary.png", CacheDir: dir, MaxTransforms: 2}
+		// 超时的检查在后台继续执行, 每次使用新的存储
+		origins = &canaryOrigins{exists: true}
+		p.transformer.Origins = origins
+		p.transformer.transforming = 0
+
+		tt.setup()
+		report := p.Ready()
+		if report.Ready {
+			t.Errorf("%d: Ready() = true, want %s to fail", i, tt.name)
+		}
+		if check := report.Checks[tt.name]; check == nil || check.OK || check.Error == "" {
+			t.Errorf("%d: check %s = %+v, want failure", i, tt.name, check)
+		}
+	}
+}
+
+func TestProxy_Ready_Unconfigured(t *testing.T) {
+	// 没有HEAD的存储
+	p := newReadyProxy(&memOrigins{})
+	if report := p.Ready(); !report.Ready || len(report.Checks) != 1 {
+		t.Errorf("Ready() = %+v, want only the transform check", report)
+	}
+
+	p.ReadyOptions.CanaryKey = "canary.png"
+	if report := p.Ready(); report.Ready {
+		t.Errorf("Ready() = true with an origin store that can't HEAD")
+	}
+}
+
+func TestProxy_ServeReady(t *testing.T) {
+	p := newReadyProxy(&canaryOrigins{exists: true})
+	p.ReadyOptions.CanaryKey = "canary.png"
+
+	serve := func() (int, *ReadyReport) {
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, httptest.NewRequest("GET", kReadyPath, nil))
+		report := &ReadyReport{}
+		if err := json.Unmarshal(resp.Body.Bytes(), report); err != nil {
+			t.Fatalf("invalid json %q: %v", resp.Body.String(), err)
+		}
+		return resp.Code, report
+	}
+
+	if code, report := serve(); code != http.StatusOK || !report.Ready || !report.Checks["s3"].OK {
+		t.Errorf("ready-check returned %d, %+v", code, report)
+	}
+
+	p.transformer.Origins = &canaryOrigins{}
+	if code, report := serve(); code != http.StatusServiceUnavailable || report.Ready {
+		t.Errorf("ready-check returned %d, %+v, want %d", code, report, http.StatusServiceUnavailable)
+	}
+}
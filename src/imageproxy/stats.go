@@ -0,0 +1,30 @@
+package imageproxy
+
+import (
+	"net/http"
+)
+
+var (
+	// GET /tools/im/_stats 运行时的统计信息
+	kStatsPath = "/" + kCloudFrontPattern + "_stats"
+)
+
+type ProxyStats struct {
+	OriginRevalidation RevalidationStats `json:"origin_revalidation"`
+}
+
+func (p *Proxy) Stats() *ProxyStats {
+	stats := &ProxyStats{}
+	if p.transformer != nil {
+		stats.OriginRevalidation = p.transformer.RevalidationStats()
+	}
+	return stats
+}
+
+func (p *Proxy) serveStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONResult(w, http.StatusMethodNotAllowed, &HttpProxyResult{Message: "method not allowed"})
+		return
+	}
+	writeJSONResult(w, http.StatusOK, p.Stats())
+}
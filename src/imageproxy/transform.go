@@ -31,12 +31,21 @@ import (
 	"math"
 )
 
-// default compression quality of resized jpegs
-const defaultQuality = 80
+// DefaultQuality is the compression quality of resized jpegs and webps when
+// the options don't have one. Set it before serving requests.
+var DefaultQuality = 80
 
 // resample filter used when resizing images
 var resampleFilter = imaging.Lanczos
 
+// MaxUpscale is the largest factor an image may be enlarged by when the "up"
+// option is given.
+var MaxUpscale = 2.0
+
+// MaxDPR is the largest device pixel ratio accepted by the "dpr" option; larger
+// values are clamped to it.
+var MaxDPR = 4.0
+
 func DetectFormat(img []byte, opt Options) ([]byte, string, error) {
 	m, format, err := image.Decode(bytes.NewReader(img))
 
@@ -66,7 +75,7 @@ func DetectFormat(img []byte, opt Options) ([]byte, string, error) {
 		// webp格式的数据就暂时以jpg格式保存
 		quality := opt.Quality
 		if quality == 0 {
-			quality = defaultQuality
+			quality = DefaultQuality
 		}
 		err = webp.Encode(buf, m, &webp.Options{Lossless: false, Quality: float32(quality)})
 		if err != nil {
@@ -80,7 +89,7 @@ func DetectFormat(img []byte, opt Options) ([]byte, string, error) {
 	case media_utils.ImageFormatJpeg:
 		quality := opt.Quality
 		if quality == 0 {
-			quality = defaultQuality
+			quality = DefaultQuality
 		}
 		err = jpeg.Encode(buf, m, &jpeg.Options{Quality: quality})
 		if err != nil {
@@ -148,7 +157,7 @@ func Transform(img []byte, opt Options) ([]byte, string, error) {
 		// webp格式的数据就暂时以jpg格式保存
 		quality := opt.Quality
 		if quality == 0 {
-			quality = defaultQuality
+			quality = DefaultQuality
 		}
 		if opt.transform() {
 			m = transformImage(m, opt)
@@ -164,7 +173,7 @@ func Transform(img []byte, opt Options) ([]byte, string, error) {
 	case media_utils.ImageFormatJpeg:
 		quality := opt.Quality
 		if quality == 0 {
-			quality = defaultQuality
+			quality = DefaultQuality
 		}
 		if opt.transform() {
 			m = transformImage(m, opt)
@@ -201,29 +210,44 @@ func resizeParams(m image.Image, opt Options) (w, h int, resize bool) {
 
 	// 如何进行resize呢?
 	// 1. 按照比例来做
+	// 2. 绝对像素值需要乘以dpr
 	if 0 < opt.Width && opt.Width < 1 {
 		w = int(float64(imgW) * opt.Width)
 	} else if opt.Width < 0 {
 		w = 0
 	} else {
-		w = int(opt.Width)
+		w = scaleByDPR(opt.Width, opt.DPR)
 	}
 	if 0 < opt.Height && opt.Height < 1 {
 		h = int(float64(imgH) * opt.Height)
 	} else if opt.Height < 0 {
 		h = 0
 	} else {
-		h = int(opt.Height)
+		h = scaleByDPR(opt.Height, opt.DPR)
+	}
+
+	// 输出图片的尺寸上限: 默认不放大; 指定了up之后最多放大MaxUpscale倍
+	maxScale := 1.0
+	if opt.Upscale && MaxUpscale > 1 {
+		maxScale = MaxUpscale
 	}
+	maxW := int(float64(imgW) * maxScale)
+	maxH := int(float64(imgH) * maxScale)
 
-	if w > 0 && h > 0 && !opt.Fit && (w > imgW || h > imgH) {
+	if w > 0 && h > 0 && opt.Fit && opt.Upscale {
+		// imaging.Fit不会放大图片，因此直接计算fit之后的尺寸
+		scale := math.Min(float64(w)/float64(imgW), float64(h)/float64(imgH))
+		scale = math.Min(scale, maxScale)
+		w = int(float64(imgW)*scale + 0.5)
+		h = int(float64(imgH)*scale + 0.5)
+	} else if w > 0 && h > 0 && !opt.Fit && (w > maxW || h > maxH) {
 		// 给定的w, h太大，导致图片得不到缩放；现在采取的策略是图片的w, h同时做一个scale，
 		// 保证(w, h)*scale之后能得到一个满足比例要求的图片
-		// w * scale <= imgW
-		// h * scale <= imgH
-		// scale <= Min(imgW / w, imgH / h)
-		scaleX := float64(imgW) / float64(w) // scaleX, Y 应该 >= 1,
-		scaleY := float64(imgH) / float64(h)
+		// w * scale <= maxW
+		// h * scale <= maxH
+		// scale <= Min(maxW / w, maxH / h)
+		scaleX := float64(maxW) / float64(w) // scaleX, Y 应该 >= 1,
+		scaleY := float64(maxH) / float64(h)
 		minScale := math.Min(scaleX, scaleY)
 
 		// 如果 scaleX < 1,
@@ -231,11 +255,11 @@ func resizeParams(m image.Image, opt Options) (w, h int, resize bool) {
 		h = int(float64(h) * minScale)
 
 	} else {
-		if w > imgW {
-			w = imgW
+		if w > maxW {
+			w = maxW
 		}
-		if h > imgH {
-			h = imgH
+		if h > maxH {
+			h = maxH
 		}
 	}
 
@@ -247,13 +271,24 @@ func resizeParams(m image.Image, opt Options) (w, h int, resize bool) {
 	return w, h, true
 }
 
+// scaleByDPR 将请求的像素值乘以dpr, dpr <= 0 表示没有指定
+func scaleByDPR(v float64, dpr float64) int {
+	if dpr <= 0 {
+		return int(v)
+	}
+	return int(v*dpr + 0.5)
+}
+
 // transformImage modifies the image m based on the transformations specified
 // in opt.
 func transformImage(m image.Image, opt Options) image.Image {
 	// resize if needed
 	if w, h, resize := resizeParams(m, opt); resize {
 		// log.Printf("resize w: %d, h: %d", w, h)
-		if opt.Fit {
+		if opt.Fit && opt.Upscale {
+			// resizeParams已经计算好fit之后的尺寸
+			m = imaging.Resize(m, w, h, resampleFilter)
+		} else if opt.Fit {
 			// log.Printf("resize fit")
 			m = imaging.Fit(m, w, h, resampleFilter)
 		} else {
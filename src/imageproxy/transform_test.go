@@ -72,9 +72,31 @@ func TestResizeParams(t *testing.T) {
 		{Options{Height: 0.5}, 0, 64, true},
 		{Options{Width: 0.5, Height: 0.5}, 32, 64, true},
 		{Options{Width: 100, Height: 200}, 0, 0, false},
-		{Options{Width: 100, Height: 200}, 100, 200, true},
+		{Options{Width: 100, Height: 200, Upscale: true}, 100, 200, true},
 		{Options{Width: 64}, 0, 0, false},
 		{Options{Height: 128}, 0, 0, false},
+
+		// dpr
+		{Options{Width: 16, DPR: 2}, 32, 0, true},
+		{Options{Width: 20, Height: 30, DPR: 1.5}, 30, 45, true},
+		{Options{Width: 0.25, DPR: 2}, 16, 0, true}, // 比例不受dpr影响
+		{Options{Width: 50, DPR: 2}, 0, 0, false},   // 不放大时受限于原图尺寸
+		{Options{Width: 50, Height: 50, DPR: 2}, 64, 64, true},
+		{Options{Width: 50, Height: 50, DPR: 2, Fit: true}, 64, 100, true},
+
+		// upscale
+		{Options{Width: 100, Upscale: true}, 100, 0, true},
+		{Options{Width: 200, Upscale: true}, 128, 0, true}, // 最多放大MaxUpscale倍
+		{Options{Height: 512, Upscale: true}, 0, 256, true},
+		{Options{Width: 256, Height: 256, Upscale: true}, 128, 128, true},
+		{Options{Width: 100, Height: 100, Fit: true, Upscale: true}, 50, 100, true},
+		{Options{Width: 400, Height: 400, Fit: true, Upscale: true}, 128, 256, true},
+		{Options{Width: 32, Height: 32, Fit: true, Upscale: true}, 16, 32, true},
+
+		// dpr + upscale
+		{Options{Width: 50, DPR: 2, Upscale: true}, 100, 0, true},
+		{Options{Width: 100, Height: 100, DPR: 3, Upscale: true}, 128, 128, true},
+		{Options{Width: 50, Height: 50, DPR: 2, Fit: true, Upscale: true}, 50, 100, true},
 	}
 	for _, tt := range tests {
 		w, h, resize := resizeParams(src, tt.opt)
@@ -176,7 +198,7 @@ func TestTransformImage(t *testing.T) {
 		},
 		{ // can resize larger than original image
 			ref,
-			Options{Width: 4, Height: 4},
+			Options{Width: 4, Height: 4, Upscale: true},
 			newImage(4, 4, red, red, green, green, red, red, green, green, blue, blue, yellow, yellow, blue, blue, yellow, yellow),
 		},
 		{ // invalid values
@@ -1,14 +1,18 @@
 package imageproxy
 
 import (
+	"bytes"
 	"media_utils"
 	"cache"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 	"io/ioutil"
 	"net/http"
 	"config"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 //
@@ -24,6 +28,23 @@ type TransformingTransport struct {
 	// responses are properly cached.
 	CacheClient *http.Client
 	Cache       cache.Cache
+	Index       *cache.VariantIndex // 记录原始数据的缓存key, 可以为nil
+	Variants    VariantStore        // 渲染之后的图片的持久化存储, 可以为nil
+	OriginTTL   time.Duration       // 原始数据的缓存时间, 过期之后通过条件请求重新验证; 0表示不过期
+	Origins     OriginStore         // 原始图片的存储, nil时使用S3(config.AWSBuckets)
+	NegativeTTL time.Duration       // 原始图片不存在或者无法解码时的缓存时间; 0表示不缓存
+
+	// 后台保存的variant已满时等待, 而不是丢弃; 用于预热(improxy warm), 服务时不阻塞请求
+	VariantBlocking bool
+
+	revalidation revalidationCounters
+	transforming int64 // 正在处理的transform的数量
+
+	// 后台保存到VariantStore的variant
+	variantMu       sync.Mutex
+	pendingVariants int
+	variantCond     *sync.Cond // VariantBlocking时等待pendingVariants减少
+	variantWg       sync.WaitGroup
 }
 
 func (t *TransformingTransport) S3ResourceProcess(req *http.Request) (*http.Response, error) {
@@ -35,50 +56,146 @@ func (t *TransformingTransport) S3ResourceProcess(req *http.Request) (*http.Resp
 	// 1. 下载原始的图片
 	originImageUrl := *req.URL
 	originImageUrl.Fragment = ""
-	var cacheData *ImageWithMeta
+	var cacheData, staleData *ImageWithMeta
 	originDataCacheKey := cache.DataCacheKeyForURL(&originImageUrl)
 
 	// 2. 如果存在原始版本，则在本地Cache中存在原始版本
 	// log.Printf("OriginCacheKey: %s", originCacheKey)
 	if data, ok := t.Cache.Get(originDataCacheKey); ok && len(data) > 0 {
-		cacheData = NewImageWithMetaFromCache(data)
-		log.Printf("Elapsed %.1fms, S3 Hit cache origin, Key: %s", float64(Microseconds()-start)*0.001, originDataCacheKey)
+		meta, err := NewImageWithMetaFromCache(data)
+		if err == nil && len(meta.Key) > 0 && meta.Key != originDataCacheKey {
+			err = fmt.Errorf("image cache: key mismatch %s", meta.Key)
+		}
+
+		if err != nil {
+			// 损坏的缓存直接删除, 然后重新下载
+			log.ErrorErrorf(err, "Corrupt cache origin, Key: %s", originDataCacheKey)
+			t.Cache.Delete(originDataCacheKey)
+		} else if t.originExpired(meta) {
+			// 过期的数据保留下来, 用于条件请求
+			log.Printf("S3 cache origin stale, Key: %s, Created: %s", originDataCacheKey, meta.Created.Format(time.RFC3339))
+			staleData = meta
+		} else {
+			cacheData = meta
+			log.Printf("Elapsed %.1fms, S3 Hit cache origin, Key: %s", float64(Microseconds()-start)*0.001, originDataCacheKey)
+		}
 	}
 
-	// 3. 从S3下载原始版本
+	// 3. 最近确认过不存在的图片, 直接返回404
+	if cacheData == nil && staleData == nil {
+		if resp, ok := t.negativeResponse(req, &originImageUrl); ok {
+			return resp, nil
+		}
+	}
+
+	// 4. 从S3下载原始版本; 过期的数据则带上ETag, Last-Modified做条件请求
+	//    本地没有原始版本时, 如果VariantStore中有已经渲染过的图片, 则带上渲染时原始图片的ETag做条件请求
 	if cacheData == nil {
-		// 下载数据
-		var s3session *session.Session
-		s3session = media_utils.GetS3Session()
 		s3Key := req.URL.Path[1:]
 
-		img, headers, err := media_utils.GetContentFromAWSWithMeta(s3session, config.AWSBuckets, s3Key)
+		var etag string
+		var lastModified time.Time
+		var variant *ImageWithMeta
+		if staleData != nil {
+			etag, lastModified = staleData.Header("ETag"), staleData.lastModified()
+		} else {
+			variant, etag = t.storedVariant(req)
+		}
+		img, headers, notModified, err := t.origins().GetIfModified(s3Key, etag, lastModified)
 
 		if aerr, ok := err.(awserr.Error); ok {
 			switch aerr.Code() {
 			case "NoSuchBucket":
 				fallthrough
 			case "NoSuchKey":
-				// 找不到数据，直接返回404
-				return Http404Response(req)
+				// 找不到数据，直接返回404; 已经删除的图片不再保留缓存
+				if staleData != nil {
+					t.revalidation.deleted()
+					t.Cache.Delete(originDataCacheKey)
+				}
+				t.setNegative(&originImageUrl, aerr.Code())
+				return Http404Response(req, t.negativeMaxAge(nil))
 			}
 		}
+		if staleData != nil {
+			t.revalidation.add(notModified, err)
+		}
 
-		// 未知错误
-		if err != nil {
+		switch {
+		case notModified && variant != nil:
+			// 原始图片没有变化, 直接返回已经渲染过的图片
+			log.Printf("Elapsed: %.1fms, S3 variant still valid: %s", float64(Microseconds()-start)*0.001, s3Key)
+			return ImageDataToHttpResponse(variant, variant.ContentType, req)
+		case err != nil && variant != nil:
+			// S3不可用时使用已经渲染过的图片
+			log.ErrorErrorf(err, "Failed to revalidate variant, serving stored: %s", s3Key)
+			return ImageDataToHttpResponse(variant, variant.ContentType, req)
+		case err != nil && staleData != nil:
+			// S3不可用时继续使用过期的数据, 下次请求时再验证
+			log.ErrorErrorf(err, "Failed to revalidate object, serving stale： %s", s3Key)
+			cacheData = staleData
+		case err != nil:
+			// 未知错误
 			log.ErrorErrorf(err, "Failed to get object： %s", s3Key)
 			return nil, err
+		case notModified:
+			// 数据没有变化, 只更新Created
+			cacheData = staleData
+			cacheData.Key = originDataCacheKey
+			cacheData.Created = time.Now()
+		default:
+			cacheData = &ImageWithMeta{
+				Headers:     headers,
+				Image:       img,
+				Key:         originDataCacheKey,
+				Created:     time.Now(),
+				ContentType: http.DetectContentType(img),
+			}
 		}
 
-		cacheData = &ImageWithMeta{Headers: headers, Image: img}
-
 		// 保存原始版本的数据
 		// 只在不直接请求原始版本时调用，因为在transform中会有另外的持久化
-		t.Cache.Set(originDataCacheKey, cacheData.Bytes())
+		// 不设置Cache的TTL: 过期的数据还需要用于条件请求, 由Cache自身的LRU淘汰
+		if err == nil {
+			t.Cache.Set(originDataCacheKey, cacheData.Bytes())
+			t.Index.Add(&originImageUrl, originDataCacheKey)
+		}
+	}
+
+	// 5. 然后再做Resize
+	resp, err := t.transform(req, cacheData, true)
+
+	// 原始数据不是图片: 删除缓存的原始数据, 作为不存在的图片处理
+	if err != nil && t.NegativeTTL > 0 && isUndecodable(cacheData.Image) {
+		t.Cache.Delete(originDataCacheKey)
+		t.setNegative(&originImageUrl, "undecodable")
+		return Http404Response(req, t.negativeMaxAge(nil))
+	}
+	return resp, err
+}
+
+//
+// 旧格式的数据没有Created, 设置了OriginTTL时也需要验证一次
+//
+func (t *TransformingTransport) originExpired(meta *ImageWithMeta) bool {
+	return t.OriginTTL > 0 && time.Since(meta.Created) >= t.OriginTTL
+}
+
+func (t *TransformingTransport) origins() OriginStore {
+	if t.Origins != nil {
+		return t.Origins
 	}
+	return &s3Store{bucket: config.AWSBuckets}
+}
+
+// ActiveTransforms returns the number of images being transformed right now
+func (t *TransformingTransport) ActiveTransforms() int {
+	return int(atomic.LoadInt64(&t.transforming))
+}
 
-	// 4. 然后再做Resize
-	return t.transform(req, cacheData, false)
+// RevalidationStats returns the counters of the conditional requests for stale originals
+func (t *TransformingTransport) RevalidationStats() RevalidationStats {
+	return t.revalidation.get()
 }
 
 //
@@ -141,10 +258,29 @@ func (t *TransformingTransport) RoundTrip(req *http.Request) (*http.Response, er
 }
 
 func (t *TransformingTransport) transform(req *http.Request, imageCache *ImageWithMeta, upload2S3 bool) (*http.Response, error) {
+	atomic.AddInt64(&t.transforming, 1)
+	defer atomic.AddInt64(&t.transforming, -1)
+
+	// 返回原始图片的meta信息
+	if req.URL.Fragment == optInfo {
+		return ImageInfoToHttpResponse(imageCache, req)
+	}
 
 	start := Microseconds()
 	opt := ParseOptions(req.URL.Fragment, false)
 
+	// 渐进式加载的placeholder, 和其他的版本一样由外部的httpcache层来缓存
+	if opt.Format == formatBlurHash || opt.LQIP {
+		placeholder, err := TransformPlaceholder(imageCache.Image, opt)
+		log.Printf("Elapsed: %.1fms, placeholder %s", float64(Microseconds()-start)*0.001, opt.String())
+		if err != nil {
+			log.ErrorError(err, "Image placeholder failed")
+			return nil, err
+		}
+		return ImageDataToHttpResponse(&ImageWithMeta{Headers: imageCache.Headers, Image: placeholder},
+			media_utils.ContentTypeText, req)
+	}
+
 	// imageCache vs. transformedImage
 	// imageCache 表示从网络或者本地Cache中读取到的数据
 	// transformedImage 表示被transform之后的图片数据, 最终返回给Client
@@ -187,6 +323,11 @@ func (t *TransformingTransport) transform(req *http.Request, imageCache *ImageWi
 
 	contentType := FileContentType(format)
 
+	// 持久化渲染之后的图片; 和原始图片相同时不需要保存
+	if upload2S3 && needTransform && !bytes.Equal(transImage, imageCache.Image) {
+		t.storeVariant(req, transImage, contentType, imageCache.Header("ETag"))
+	}
+
 	// 不Cache非原始数据，这个由外部的httpcache层来缓存
 	return ImageDataToHttpResponse(transformedImage, contentType, req)
 }
@@ -0,0 +1,160 @@
+package imageproxy
+
+import (
+	"bytes"
+	"cache"
+	"config"
+	"encoding/json"
+	"fmt"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"image"
+	"io/ioutil"
+	"media_utils"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	// POST /tools/im/_upload?tk={token} 上传图片
+	kUploadPath = "/" + kCloudFrontPattern + "_upload"
+)
+
+const (
+	// 上传图片的最大尺寸
+	defaultMaxUploadSize = 20 * 1024 * 1024
+
+	// 返回的demo url的有效期
+	demoUrlExpireSeconds = 3600 * 24 * 7
+)
+
+//
+// 上传图片的存储, 默认为S3(config.AWSBuckets)
+//
+type ObjectStore interface {
+	Exists(key string) (bool, error)
+	Put(key string, content []byte, contentType string) error
+}
+
+type s3Store struct {
+	bucket string
+}
+
+func (s *s3Store) Exists(key string) (bool, error) {
+	return media_utils.ExistsInAWS(media_utils.GetS3Session(), s.bucket, key)
+}
+
+func (s *s3Store) Put(key string, content []byte, contentType string) error {
+	return media_utils.PutContentToAWS(media_utils.GetS3Session(), s.bucket, key, content, contentType)
+}
+
+//
+// 上传图片:
+// 1. 验证签名(和图片的访问使用同样的签名机制, path为tools/im/_upload)
+// 2. 验证图片格式
+// 3. 按照文件的MD5去重, 保存到 fileMD5Name(md5)
+//
+func (p *Proxy) serveUpload(w http.ResponseWriter, r *http.Request) {
+	start := Microseconds()
+
+	if r.Method != "POST" {
+		writeJSONResult(w, http.StatusMethodNotAllowed, &HttpProxyResult{Message: "method not allowed"})
+		return
+	}
+
+	queries := r.URL.Query()
+	if !media_utils.SimpleVerify(r.URL.Path, queries.Get(media_utils.ParamVersionTs), queries.Get(media_utils.ParamToken), true) {
+		writeJSONResult(w, http.StatusForbidden, &HttpProxyResult{Message: "invalid signature"})
+		return
+	}
+
+	maxSize := p.MaxUploadSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxUploadSize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+
+	body, err := readUploadBody(r, maxSize)
+	if err != nil {
+		writeJSONResult(w, http.StatusBadRequest, &HttpProxyResult{Message: err.Error()})
+		return
+	}
+
+	// 只接受支持的图片格式
+	_, format, err := image.DecodeConfig(bytes.NewReader(body))
+	contentType := FileContentType(format)
+	if err != nil || len(contentType) == 0 {
+		writeJSONResult(w, http.StatusBadRequest, &HttpProxyResult{Message: "invalid image"})
+		return
+	}
+
+	store := p.UploadStore
+	if store == nil {
+		store = &s3Store{bucket: config.AWSBuckets}
+	}
+
+	key := fileMD5Name(fileMD5(body))
+	exists, err := store.Exists(key)
+	if err != nil {
+		log.ErrorErrorf(err, "Upload check exists failed: %s", key)
+		writeJSONResult(w, http.StatusInternalServerError, &HttpProxyResult{Message: "storage error"})
+		return
+	}
+
+	// 相同的文件已经存在，则不再上传
+	if !exists {
+		if err := store.Put(key, body, contentType); err != nil {
+			log.ErrorErrorf(err, "Upload failed: %s", key)
+			writeJSONResult(w, http.StatusInternalServerError, &HttpProxyResult{Message: "storage error"})
+			return
+		}
+	}
+
+	// 上传之前请求过的图片可能在负缓存中
+	if p.DefaultBaseURL != nil && p.Cache != nil {
+		p.Cache.Delete(cache.NegativeCacheKeyForURL(p.DefaultBaseURL.ResolveReference(&url.URL{Path: key})))
+	}
+
+	log.Printf("Elapsed: %.1fms, Upload: %s, size: %d, exists: %v",
+		float64(Microseconds()-start)*0.001, key, len(body), exists)
+
+	writeJSONResult(w, http.StatusOK, &HttpProxyResult{
+		Succeed:          true,
+		ImageRelativeUrl: key,
+		// options为0(原图), 否则key的第一段会被当做options
+		DemoUrl:          "/" + media_utils.SimpleSignUrl(kCloudFrontPattern+"0/"+key, "", demoUrlExpireSeconds),
+	})
+}
+
+//
+// 图片数据可以是multipart/form-data中的file字段, 也可以直接是request body
+//
+func readUploadBody(r *http.Request, maxSize int64) ([]byte, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(maxSize); err != nil {
+			return nil, err
+		}
+		f, _, err := r.FormFile("file")
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ioutil.ReadAll(f)
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		return nil, fmt.Errorf("empty body")
+	}
+	return body, nil
+}
+
+func writeJSONResult(w http.ResponseWriter, code int, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(result)
+}
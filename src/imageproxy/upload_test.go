@@ -0,0 +1,129 @@
+package imageproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"media_utils"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// memStore 是ObjectStore在内存中的实现
+type memStore struct {
+	objects map[string][]byte
+	puts    int
+}
+
+func (s *memStore) Exists(key string) (bool, error) {
+	_, ok := s.objects[key]
+	return ok, nil
+}
+
+func (s *memStore) Put(key string, content []byte, contentType string) error {
+	s.objects[key] = content
+	s.puts++
+	return nil
+}
+
+// go test imageproxy -v -run "TestProxy_ServeUpload"
+func TestProxy_ServeUpload(t *testing.T) {
+	var wg sync.WaitGroup
+	store := &memStore{objects: make(map[string][]byte)}
+	p := NewProxy(nil, nil, &wg)
+	p.UploadStore = store
+	p.MaxUploadSize = 1024
+
+	img := new(bytes.Buffer)
+	png.Encode(img, newImage(2, 2, red))
+	md5 := fileMD5(img.Bytes())
+
+	form := new(bytes.Buffer)
+	mw := multipart.NewWriter(form)
+	fw, _ := mw.CreateFormFile("file", "a.png")
+	fw.Write(img.Bytes())
+	mw.Close()
+
+	signed := "http://localhost/" + media_utils.SimpleSignUrl(kUploadPath, "", 3600)
+	baseURL, _ := url.Parse("http://awss3/")
+
+	tests := []struct {
+		method      string
+		url         string
+		contentType string
+		body        []byte
+		code        int
+		puts        int
+	}{
+		{"GET", signed, "", nil, http.StatusMethodNotAllowed, 0},
+		{"POST", "http://localhost" + kUploadPath, "image/png", img.Bytes(), http.StatusForbidden, 0},
+		{"POST", signed + "x", "image/png", img.Bytes(), http.StatusForbidden, 0},
+		{"POST", signed, "image/png", []byte("not an image"), http.StatusBadRequest, 0},
+		{"POST", signed, "image/png", nil, http.StatusBadRequest, 0},
+		{"POST", signed, "image/png", make([]byte, 2048), http.StatusBadRequest, 0},
+
+		{"POST", signed, "image/png", img.Bytes(), http.StatusOK, 1},
+		// 相同的文件不会重复上传
+		{"POST", signed, "image/png", img.Bytes(), http.StatusOK, 1},
+		{"POST", signed, mw.FormDataContentType(), form.Bytes(), http.StatusOK, 1},
+	}
+
+	for i, tt := range tests {
+		req, _ := http.NewRequest(tt.method, tt.url, bytes.NewReader(tt.body))
+		req.Header.Set("Content-Type", tt.contentType)
+		resp := httptest.NewRecorder()
+		p.ServeHTTP(resp, req)
+
+		if got, want := resp.Code, tt.code; got != want {
+			t.Errorf("%d. upload returned status %d, want %d: %s", i, got, want, resp.Body.String())
+		}
+		if got, want := store.puts, tt.puts; got != want {
+			t.Errorf("%d. upload stored %d objects, want %d", i, got, want)
+		}
+
+		var result HttpProxyResult
+		if err := json.Unmarshal(resp.Body.Bytes(), &result); err != nil {
+			t.Errorf("%d. upload returned invalid json %s: %v", i, resp.Body.String(), err)
+			continue
+		}
+		if result.Succeed != (tt.code == http.StatusOK) {
+			t.Errorf("%d. upload returned %+v", i, result)
+		}
+		if !result.Succeed {
+			continue
+		}
+
+		if got, want := result.ImageRelativeUrl, fileMD5Name(md5); got != want {
+			t.Errorf("%d. upload returned url %s, want %s", i, got, want)
+		}
+		if !bytes.Equal(store.objects[result.ImageRelativeUrl], img.Bytes()) {
+			t.Errorf("%d. upload stored different bytes", i)
+		}
+
+		// demo url 可以通过签名验证, 并且指向上传的文件
+		demo, _ := http.NewRequest("GET", "http://localhost"+result.DemoUrl, nil)
+		queries := demo.URL.Query()
+		if !media_utils.SimpleVerify(demo.URL.Path, "", queries.Get(media_utils.ParamToken), true) {
+			t.Errorf("%d. upload returned invalid demo url %s", i, result.DemoUrl)
+		}
+		demoReq, err := NewRequest(demo, baseURL, p.Presets)
+		if err != nil {
+			t.Errorf("%d. NewRequest(%s) returned error: %v", i, result.DemoUrl, err)
+			continue
+		}
+		if got, want := demoReq.URL.Host, "awss3"; got != want {
+			t.Errorf("%d. demo url %s resolved to host %s, want %s", i, result.DemoUrl, got, want)
+		}
+		if got, want := strings.TrimPrefix(demoReq.URL.Path, "/"), result.ImageRelativeUrl; got != want {
+			t.Errorf("%d. demo url %s resolved to s3 key %s, want %s", i, result.DemoUrl, got, want)
+		}
+		if _, ok := store.objects[strings.TrimPrefix(demoReq.URL.Path, "/")]; !ok {
+			t.Errorf("%d. demo url %s does not point to a stored object", i, result.DemoUrl)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package imageproxy
+
+import (
+	"bytes"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	log "github.com/wfxiang08/cyutils/utils/rolling_log"
+	"image"
+	"media_utils"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+//
+// 渲染之后的图片的持久化存储(例如: 单独的derived-assets bucket)
+// 作为本地缓存之外的第二级缓存, 重启或者新的机房不需要从原始图片重新渲染
+// 每个variant记录渲染时原始图片的ETag, 原始图片被替换或者删除之后不再使用
+//
+type VariantStore interface {
+	// Get returns the content, the cache headers and the source ETag of key, or nil
+	// content if key doesn't exist
+	Get(key string) (content []byte, headers []byte, source string, err error)
+	// Put saves content rendered from the original image whose ETag is source
+	Put(key string, content []byte, contentType string, source string) error
+	// DeletePrefix removes all the keys starting with prefix and returns them
+	DeletePrefix(prefix string) ([]string, error)
+}
+
+const (
+	// variant的S3 Meta中保存原始图片的ETag: x-amz-meta-source-etag
+	variantSourceMeta = "source-etag"
+
+	// 同时在后台保存的variant的最大数量, 超过时直接丢弃(VariantBlocking时等待), 下次渲染时再保存
+	maxPendingVariants = 32
+)
+
+type s3VariantStore struct {
+	bucket string
+}
+
+func (s *s3VariantStore) Get(key string) ([]byte, []byte, string, error) {
+	content, headers, metadata, err := media_utils.GetContentWithMetadataFromAWS(media_utils.GetS3Session(), s.bucket, key)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, nil, "", nil
+	}
+	return content, headers, metadata[variantSourceMeta], err
+}
+
+func (s *s3VariantStore) Put(key string, content []byte, contentType string, source string) error {
+	return media_utils.PutContentWithMetadataToAWS(media_utils.GetS3Session(), s.bucket, key, content, contentType,
+		map[string]string{variantSourceMeta: source})
+}
+
+func (s *s3VariantStore) DeletePrefix(prefix string) ([]string, error) {
+	return media_utils.DeletePrefixFromAWS(media_utils.GetS3Session(), s.bucket, prefix)
+}
+
+// NewS3VariantStore returns a VariantStore backed by the given S3 bucket
+func NewS3VariantStore(bucket string) VariantStore {
+	return &s3VariantStore{bucket: bucket}
+}
+
+//
+// 渲染之后的图片的key: {原始图片的key}/[{query}/]{options}
+//   awss3的图片: production/a.jpeg/200x200,q80
+//   外部的图片:  example.com/a.jpeg/ts%3D123/200x200,q80
+//
+func VariantKey(u *url.URL) string {
+	key := VariantPrefix(u)
+	if len(u.RawQuery) > 0 {
+		key += url.QueryEscape(u.RawQuery) + "/"
+	}
+	return key + ParseOptions(u.Fragment, false).String()
+}
+
+//
+// 图片的所有variant的key的前缀, 用于purge
+// 注意: 前缀同样匹配以 {key}/ 开头的其他原始图片的variant, 多删除的只是缓存, 不影响正确性
+//
+func VariantPrefix(u *url.URL) string {
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host != AWS_S3_PREFIX {
+		key = u.Host + "/" + key
+	}
+	return key + "/"
+}
+
+//
+// 只有S3上的普通的图片才会被持久化:
+//   外部的图片没有可靠的版本信息, 无法判断variant是否过期
+//   _info, placeholder等数据很小, 直接由本地缓存处理
+//
+func isStoredVariant(u *url.URL) bool {
+	if u.Host != AWS_S3_PREFIX || u.Fragment == "" || u.Fragment == optInfo {
+		return false
+	}
+	opt := ParseOptions(u.Fragment, false)
+	return opt.Format != formatBlurHash && !opt.LQIP
+}
+
+//
+// 从VariantStore中读取已经渲染好的图片, 以及渲染时原始图片的ETag
+// 调用者需要通过条件请求确认原始图片没有变化之后才能使用
+//
+func (t *TransformingTransport) storedVariant(req *http.Request) (*ImageWithMeta, string) {
+	if t.Variants == nil || !isStoredVariant(req.URL) {
+		return nil, ""
+	}
+
+	start := Microseconds()
+	key := VariantKey(req.URL)
+	content, headers, source, err := t.Variants.Get(key)
+	if err != nil {
+		log.ErrorErrorf(err, "Variant store get failed: %s", key)
+		return nil, ""
+	}
+	// 没有原始图片的版本信息的variant无法验证, 作为不存在处理
+	if content == nil || len(source) == 0 {
+		return nil, ""
+	}
+
+	_, format, err := image.DecodeConfig(bytes.NewReader(content))
+	contentType := FileContentType(format)
+	if err != nil || len(contentType) == 0 {
+		log.Errorf("Variant store returned invalid image: %s", key)
+		return nil, ""
+	}
+
+	log.Printf("Elapsed: %.1fms, Hit variant store: %s", float64(Microseconds()-start)*0.001, key)
+	return &ImageWithMeta{Headers: headers, Image: content, ContentType: contentType}, source
+}
+
+//
+// 在后台保存渲染之后的图片, 失败时只记录日志
+// source为空时(原始图片没有ETag)不保存, 因为之后无法验证
+//
+func (t *TransformingTransport) storeVariant(req *http.Request, content []byte, contentType string, source string) {
+	if t.Variants == nil || !isStoredVariant(req.URL) || len(source) == 0 {
+		return
+	}
+	key := VariantKey(req.URL)
+
+	t.variantMu.Lock()
+	for t.pendingVariants >= maxPendingVariants {
+		if !t.VariantBlocking {
+			t.variantMu.Unlock()
+			log.Printf("Variant store busy, skip: %s", key)
+			return
+		}
+		if t.variantCond == nil {
+			t.variantCond = sync.NewCond(&t.variantMu)
+		}
+		t.variantCond.Wait()
+	}
+	t.pendingVariants++
+	t.variantMu.Unlock()
+
+	t.variantWg.Add(1)
+	go func() {
+		defer func() {
+			t.variantMu.Lock()
+			t.pendingVariants--
+			if t.variantCond != nil {
+				t.variantCond.Signal()
+			}
+			t.variantMu.Unlock()
+			t.variantWg.Done()
+		}()
+
+		if err := t.Variants.Put(key, content, contentType, source); err != nil {
+			log.ErrorErrorf(err, "Variant store put failed: %s", key)
+		}
+	}()
+}
+
+// Wait blocks until all the variants being saved in the background are done.
+func (t *TransformingTransport) Wait() {
+	t.variantWg.Wait()
+}
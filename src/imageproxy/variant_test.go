@@ -0,0 +1,251 @@
+package imageproxy
+
+import (
+	"cache"
+	"fmt"
+	"image/jpeg"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memVariants 是VariantStore在内存中的实现
+type memVariants struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	sources map[string]string
+	gets    int
+}
+
+func newMemVariants() *memVariants {
+	return &memVariants{objects: make(map[string][]byte), sources: make(map[string]string)}
+}
+
+func (s *memVariants) Get(key string) ([]byte, []byte, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gets++
+	return s.objects[key], []byte("Cache-Control: max-age=60\n"), s.sources[key], nil
+}
+
+func (s *memVariants) Put(key string, content []byte, contentType string, source string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key], s.sources[key] = content, source
+	return nil
+}
+
+func (s *memVariants) DeletePrefix(prefix string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.objects, key)
+			delete(s.sources, key)
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// countingTransport 记录对原始图片的请求次数
+type countingTransport struct {
+	count int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.count++
+	return testTransport{}.RoundTrip(req)
+}
+
+// go test imageproxy -v -run "TestVariantKey"
+func TestVariantKey(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://awss3/production/a.jpeg#200x200,q80", "production/a.jpeg/200x200,q80"},
+		{"http://awss3/production/a.jpeg?ts=12#200x200,q80", "production/a.jpeg/ts%3D12/200x200,q80"},
+		{"http://example.com/a.jpeg#100x0", "example.com/a.jpeg/100x0"},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if got := VariantKey(u); got != tt.want {
+			t.Errorf("VariantKey(%q) returned %q, want %q", tt.url, got, tt.want)
+		}
+		if prefix := VariantPrefix(u); !strings.HasPrefix(tt.want, prefix) {
+			t.Errorf("VariantPrefix(%q) returned %q, want a prefix of %q", tt.url, prefix, tt.want)
+		}
+	}
+}
+
+// go test imageproxy -v -run "TestS3ResourceProcessVariantStore"
+func TestS3ResourceProcessVariantStore(t *testing.T) {
+	origins := &memOrigins{content: testPNG(1), etag: `"v1"`}
+	store := newMemVariants()
+	key := "production/a.png/0x0,fjpeg"
+
+	// 每次使用新的本地缓存, 模拟重启或者其他的机器
+	newTransport := func() *TransformingTransport {
+		return &TransformingTransport{Cache: cache.NewMemoryCache(), Origins: origins, Variants: store}
+	}
+	get := func(tr *TransformingTransport) *http.Response {
+		req, _ := http.NewRequest("GET", "http://awss3/production/a.png#0x0,fjpeg", nil)
+		resp, err := tr.S3ResourceProcess(req)
+		if err != nil {
+			t.Fatalf("S3ResourceProcess returned unexpected error: %v", err)
+		}
+		tr.Wait()
+		return resp
+	}
+	width := func(resp *http.Response) int {
+		img, err := jpeg.Decode(resp.Body)
+		if err != nil {
+			t.Fatalf("S3ResourceProcess returned invalid image: %v", err)
+		}
+		return img.Bounds().Dx()
+	}
+
+	// 第一次请求需要渲染, 然后在后台保存到store, 记录原始图片的ETag
+	tr := newTransport()
+	get(tr)
+	if store.objects[key] == nil || store.sources[key] != `"v1"` {
+		t.Fatalf("rendered variant was not stored under %s with source etag, sources: %v", key, store.sources)
+	}
+
+	// 本地已经有原始图片时不读取store
+	get(tr)
+	if store.gets != 1 {
+		t.Errorf("read variant store %d times, want 1", store.gets)
+	}
+
+	// 新的机器: 条件请求确认原始图片没有变化之后, 直接返回store中的图片
+	origins.gets, origins.conditional = 0, 0
+	resp := get(newTransport())
+	if got, want := resp.Header.Get("Content-Type"), "image/jpeg"; got != want {
+		t.Errorf("stored variant returned Content-Type %s, want %s", got, want)
+	}
+	if width(resp) != 1 || origins.gets != 1 || origins.conditional != 1 {
+		t.Errorf("origin gets: %d, conditional: %d, want 1 conditional get", origins.gets, origins.conditional)
+	}
+
+	// 原始图片被替换之后重新渲染, 并且更新store
+	origins.content, origins.etag = testPNG(2), `"v2"`
+	if got := width(get(newTransport())); got != 2 {
+		t.Errorf("replaced origin returned width %d, want 2", got)
+	}
+	if store.sources[key] != `"v2"` {
+		t.Errorf("variant source etag = %s, want \"v2\"", store.sources[key])
+	}
+
+	// 原始图片被删除之后返回404
+	origins.content = nil
+	if resp := get(newTransport()); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("deleted origin returned status %d, want 404", resp.StatusCode)
+	}
+
+	// placeholder不会被持久化
+	origins.content = testPNG(1)
+	req, _ := http.NewRequest("GET", "http://awss3/production/a.png#0x0,fblurhash", nil)
+	newTransport().S3ResourceProcess(req)
+	if len(store.objects) != 1 {
+		t.Errorf("store has %d objects, want 1", len(store.objects))
+	}
+}
+
+// go test imageproxy -v -run "TestTransformingTransportVariantStore"
+func TestTransformingTransportVariantStore(t *testing.T) {
+	origin := &countingTransport{}
+	store := newMemVariants()
+	client := new(http.Client)
+	tr := &TransformingTransport{
+		Transport:   origin,
+		CacheClient: client,
+		Variants:    store,
+	}
+	client.Transport = tr
+
+	// 外部的图片没有可靠的版本信息, 不使用store
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("GET", "http://good.test/png#0x0,fjpeg", nil)
+		if _, err := tr.RoundTrip(req); err != nil {
+			t.Fatalf("RoundTrip returned unexpected error: %v", err)
+		}
+	}
+	tr.Wait()
+	if len(store.objects) != 0 || store.gets != 0 {
+		t.Errorf("store has %d objects and %d gets, want 0", len(store.objects), store.gets)
+	}
+	if origin.count != 2 {
+		t.Errorf("fetched origin %d times, want 2", origin.count)
+	}
+}
+
+// go test imageproxy -v -run "TestStoreVariantBounded"
+func TestStoreVariantBounded(t *testing.T) {
+	store := newMemVariants()
+	tr := &TransformingTransport{Variants: store}
+	req, _ := http.NewRequest("GET", "http://awss3/production/a.png#100x0", nil)
+
+	// 后台的保存已满时直接丢弃
+	tr.pendingVariants = maxPendingVariants
+	tr.storeVariant(req, []byte("full"), "image/png", `"v1"`)
+	tr.pendingVariants = 0
+
+	// 原始图片没有ETag时无法验证, 不保存
+	tr.storeVariant(req, []byte("no source"), "image/png", "")
+	tr.Wait()
+	if len(store.objects) != 0 {
+		t.Errorf("store has %d objects, want 0", len(store.objects))
+	}
+
+	tr.storeVariant(req, []byte("ok"), "image/png", `"v1"`)
+	tr.Wait()
+	if len(store.objects) != 1 || tr.pendingVariants != 0 {
+		t.Errorf("store has %d objects, %d pending, want 1 object", len(store.objects), tr.pendingVariants)
+	}
+}
+
+// blockingVariants 在release关闭之前不完成Put
+type blockingVariants struct {
+	*memVariants
+	release chan struct{}
+}
+
+func (s *blockingVariants) Put(key string, content []byte, contentType string, source string) error {
+	<-s.release
+	return s.memVariants.Put(key, content, contentType, source)
+}
+
+// go test imageproxy -v -run "TestStoreVariantBlocking"
+func TestStoreVariantBlocking(t *testing.T) {
+	store := &blockingVariants{memVariants: newMemVariants(), release: make(chan struct{})}
+	tr := &TransformingTransport{Variants: store, VariantBlocking: true}
+
+	// 后台的保存已满时等待, 而不是丢弃
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i <= maxPendingVariants; i++ {
+			req, _ := http.NewRequest("GET", fmt.Sprintf("http://awss3/production/a.png#%dx0", i+1), nil)
+			tr.storeVariant(req, []byte("ok"), "image/png", `"v1"`)
+		}
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("storeVariant did not wait for the pending variants")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(store.release)
+	<-done
+	tr.Wait()
+	if got, want := len(store.objects), maxPendingVariants+1; got != want {
+		t.Errorf("store has %d objects, want %d", got, want)
+	}
+}
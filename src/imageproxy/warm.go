@@ -0,0 +1,195 @@
+package imageproxy
+
+import (
+	"cache"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+//
+// 缓存预热: 对每个key和每组options, 按照线上请求的路径 tools/im/{options}/{key} 构造请求,
+// 然后和ServeHTTP一样通过 NewRequest -> Client(cache.Transport -> TransformingTransport) 渲染并写入缓存
+// 不做签名等权限检查
+//
+type WarmOptions struct {
+	Options     []string          // 图片处理参数, 可以引用preset, 例如: 200x200,q80 或者 p:avatar_small
+	Webp        bool              // 同时预热支持webp的客户端请求的版本
+	Concurrency int               // 并发请求数, 默认为1
+	Progress    func(*WarmResult) // 每个请求完成之后调用, 可以为nil; 调用是串行的
+}
+
+type WarmResult struct {
+	Path    string  `json:"path"`
+	Webp    bool    `json:"webp,omitempty"`
+	Status  int     `json:"status"`
+	Cached  bool    `json:"cached"` // 请求之前已经在缓存中
+	Bytes   int64   `json:"bytes"`
+	Elapsed float64 `json:"elapsed_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type WarmReport struct {
+	Requests  int64         `json:"requests"`
+	Rendered  int64         `json:"rendered"`
+	Cached    int64         `json:"cached"`
+	Failed    int64         `json:"failed"`
+	Bytes     int64         `json:"bytes"`
+	Elapsed   float64       `json:"elapsed_ms"`
+	Failures  []*WarmResult `json:"failures,omitempty"`
+	Cancelled bool          `json:"cancelled,omitempty"`
+}
+
+type warmJob struct {
+	result *WarmResult
+	url    string // 标准化之后的请求, 为空时result中已经记录了错误
+}
+
+//
+// 预热keys中的所有图片, keys被关闭或者cancel被关闭时结束
+//
+func (p *Proxy) Warm(keys <-chan string, opts WarmOptions, cancel <-chan struct{}) *WarmReport {
+	start := Microseconds()
+	report := &WarmReport{}
+
+	concurrency := opts.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	jobs := make(chan warmJob)
+	go func() {
+		defer close(jobs)
+		for {
+			var key string
+			var ok bool
+			select {
+			case key, ok = <-keys:
+			case <-cancel:
+				return
+			}
+			if !ok {
+				return
+			}
+			// 指定了格式时, webp和非webp的请求是相同的, 只需要渲染一次
+			seen := make(map[string]bool)
+			key = strings.TrimPrefix(key, "/")
+			for _, options := range opts.Options {
+				path := kCloudFrontPattern + options + "/" + key
+				for _, webp := range []bool{false, true} {
+					if webp && !opts.Webp {
+						continue
+					}
+					job := p.warmJob(path, webp)
+					if len(job.url) > 0 {
+						if seen[job.url] {
+							continue
+						}
+						seen[job.url] = true
+					}
+					select {
+					case jobs <- job:
+					case <-cancel:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				result := p.warmOne(job)
+
+				mu.Lock()
+				report.add(result)
+				if opts.Progress != nil {
+					opts.Progress(result)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	select {
+	case <-cancel:
+		report.Cancelled = true
+	default:
+	}
+	report.Elapsed = float64(Microseconds()-start) * 0.001
+	return report
+}
+
+func (r *WarmReport) add(result *WarmResult) {
+	r.Requests++
+	r.Bytes += result.Bytes
+	switch {
+	case len(result.Error) > 0:
+		r.Failed++
+		r.Failures = append(r.Failures, result)
+	case result.Cached:
+		r.Cached++
+	default:
+		r.Rendered++
+	}
+}
+
+// 和ServeHTTP一样, 通过NewRequest解析出标准化之后的请求
+func (p *Proxy) warmJob(path string, webp bool) warmJob {
+	job := warmJob{result: &WarmResult{Path: path, Webp: webp}}
+
+	r, err := http.NewRequest("GET", "http://localhost/"+path, nil)
+	if err != nil {
+		job.result.Error = err.Error()
+		return job
+	}
+	if webp {
+		r.Header.Set("Accept", "image/webp,image/*,*/*;q=0.8")
+	}
+
+	req, err := NewRequest(r, p.DefaultBaseURL, p.Presets)
+	if err != nil {
+		job.result.Error = err.Error()
+		return job
+	}
+	job.url = req.String()
+	return job
+}
+
+func (p *Proxy) warmOne(job warmJob) *WarmResult {
+	result := job.result
+	if len(job.url) == 0 {
+		return result
+	}
+
+	start := Microseconds()
+	defer func() {
+		result.Elapsed = float64(Microseconds()-start) * 0.001
+	}()
+
+	resp, err := p.Client.Get(job.url)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer resp.Body.Close()
+
+	// 读取完整的数据之后才会写入缓存
+	result.Status = resp.StatusCode
+	result.Cached = len(resp.Header.Get(cache.XFromCache)) > 0
+	result.Bytes, err = io.Copy(ioutil.Discard, resp.Body)
+	if err != nil {
+		result.Error = err.Error()
+	} else if resp.StatusCode != http.StatusOK {
+		result.Error = resp.Status
+	}
+	return result
+}
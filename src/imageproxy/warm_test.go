@@ -0,0 +1,65 @@
+package imageproxy
+
+import (
+	"cache"
+	"net/url"
+	"testing"
+)
+
+func warmKeys(keys ...string) <-chan string {
+	ch := make(chan string, len(keys))
+	for _, key := range keys {
+		ch <- key
+	}
+	close(ch)
+	return ch
+}
+
+// go test imageproxy -v -run "TestProxy_Warm"
+func TestProxy_Warm(t *testing.T) {
+	origins := &memOrigins{content: testPNG(4), etag: `"v1"`}
+	p := NewProxy(nil, cache.NewMemoryCache(), nil)
+	p.DefaultBaseURL, _ = url.Parse("http://awss3/")
+	p.Presets = &Presets{items: map[string]string{"small": "2x1"}}
+	p.transformer.Origins = origins
+
+	var progress int
+	opts := WarmOptions{
+		Options:     []string{"p:small", "0x0,fjpeg"},
+		Webp:        true,
+		Concurrency: 1,
+		Progress:    func(*WarmResult) { progress++ },
+	}
+
+	report := p.Warm(warmKeys("production/a.png", "/production/b.png"), opts, nil)
+	// 指定了格式的options, webp的请求和普通的请求相同, 不重复渲染
+	if report.Requests != 6 || report.Rendered != 6 || report.Failed != 0 || progress != 6 {
+		t.Fatalf("Warm returned %+v, progress %d", report, progress)
+	}
+	// 原始图片只下载一次
+	if origins.gets != 2 {
+		t.Errorf("fetched origins %d times, want 2", origins.gets)
+	}
+
+	// 再次预热时都已经在缓存中
+	opts.Concurrency = 4
+	report = p.Warm(warmKeys("production/a.png"), opts, nil)
+	if report.Requests != 3 || report.Cached != 3 {
+		t.Errorf("second Warm returned %+v", report)
+	}
+
+	// 错误的options和S3出错都记录为失败
+	origins.content = nil
+	opts.Webp = false
+	report = p.Warm(warmKeys("production/missing.png"), WarmOptions{Options: []string{"p:unknown", "100x100"}}, nil)
+	if report.Requests != 2 || report.Failed != 2 || len(report.Failures) != 2 {
+		t.Errorf("Warm of missing key returned %+v", report)
+	}
+
+	// cancel之后不再发起请求
+	cancel := make(chan struct{})
+	close(cancel)
+	if report = p.Warm(make(chan string), opts, cancel); !report.Cancelled || report.Requests != 0 {
+		t.Errorf("cancelled Warm returned %+v", report)
+	}
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	log "github.com/wfxiang08/cyutils/utils/rolling_log"
 	"io/ioutil"
+	"net/http"
+	"strings"
 	"time"
 
 	"config"
@@ -20,6 +23,7 @@ const (
 	ContentTypePNG  = "image/png"
 	ContentTypeGIF  = "image/gif"
 	ContentTypeWebp = "image/webp"
+	ContentTypeText = "text/plain; charset=utf-8"
 
 	ImageFormatPng  = "png"
 	ImageFormatWebp = "webp"
@@ -56,16 +60,37 @@ func S3Meta2Headers(meta *s3.GetObjectOutput) []byte {
 // 从AWS S3上下载图片，并且返回Headers
 //
 func GetContentFromAWSWithMeta(session *session.Session, bucket, key string) (content []byte, headers []byte, err error) {
+	content, headers, _, err = GetContentFromAWSIfModified(session, bucket, key, "", time.Time{})
+	return content, headers, err
+}
+
+//
+// 条件下载: 对象的ETag等于etag, 或者在lastModified之后没有修改时, 返回notModified, 不下载数据
+// etag为空, lastModified为0时不做对应的检查
+//
+func GetContentFromAWSIfModified(session *session.Session, bucket, key, etag string, lastModified time.Time) (content []byte, headers []byte, notModified bool, err error) {
 	start := time.Now()
 	s3Client := s3.New(session)
 
-	result, err := s3Client.GetObject(&s3.GetObjectInput{
+	input := &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
-	})
+	}
+	if len(etag) > 0 {
+		input.IfNoneMatch = aws.String(etag)
+	}
+	if !lastModified.IsZero() {
+		input.IfModifiedSince = aws.Time(lastModified)
+	}
+	result, err := s3Client.GetObject(input)
 
+	// S3通过304 NotModified错误返回
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == http.StatusNotModified {
+		log.Printf("Elapsed: %.1fms, S3 not modified, key: %s", utils.ElapsedMillSeconds(start, time.Now()), key)
+		return nil, nil, true, nil
+	}
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, false, err
 	}
 
 	defer result.Body.Close()
@@ -75,5 +100,128 @@ func GetContentFromAWSWithMeta(session *session.Session, bucket, key string) (co
 	content, err = ioutil.ReadAll(result.Body)
 
 	log.Printf("Elapsed: %.1fms, S3 download, key: %s", utils.ElapsedMillSeconds(start, time.Now()), key)
-	return content, headers, err
+	return content, headers, false, err
+}
+
+//
+// 判断S3上的对象是否存在
+//
+func ExistsInAWS(session *session.Session, bucket, key string) (bool, error) {
+	s3Client := s3.New(session)
+
+	_, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	if aerr, ok := err.(awserr.Error); ok {
+		// HEAD请求没有body, 找不到对象时返回NotFound
+		switch aerr.Code() {
+		case "NotFound", s3.ErrCodeNoSuchKey:
+			return false, nil
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//
+// 上传数据到AWS S3
+//
+func PutContentToAWS(session *session.Session, bucket, key string, content []byte, contentType string) error {
+	return PutContentWithMetadataToAWS(session, bucket, key, content, contentType, nil)
+}
+
+//
+// 上传数据到AWS S3, metadata保存为对象的自定义Meta(x-amz-meta-*)
+//
+func PutContentWithMetadataToAWS(session *session.Session, bucket, key string, content []byte, contentType string, metadata map[string]string) error {
+	start := time.Now()
+	s3Client := s3.New(session)
+
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String(contentType),
+	}
+	if len(metadata) > 0 {
+		input.Metadata = aws.StringMap(metadata)
+	}
+	_, err := s3Client.PutObject(input)
+
+	log.Printf("Elapsed: %.1fms, S3 upload, key: %s, size: %d", utils.ElapsedMillSeconds(start, time.Now()), key, len(content))
+	return err
+}
+
+//
+// 从AWS S3上下载数据, 同时返回对象的自定义Meta; Meta的key和上传时一致, 不区分大小写
+//
+func GetContentWithMetadataFromAWS(session *session.Session, bucket, key string) (content []byte, headers []byte, metadata map[string]string, err error) {
+	start := time.Now()
+	s3Client := s3.New(session)
+
+	result, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer result.Body.Close()
+
+	headers = S3Meta2Headers(result)
+	metadata = make(map[string]string, len(result.Metadata))
+	for name, value := range result.Metadata {
+		metadata[strings.ToLower(name)] = aws.StringValue(value)
+	}
+	content, err = ioutil.ReadAll(result.Body)
+
+	log.Printf("Elapsed: %.1fms, S3 download, key: %s", utils.ElapsedMillSeconds(start, time.Now()), key)
+	return content, headers, metadata, err
+}
+
+//
+// 删除AWS S3上以prefix开头的所有对象, 返回被删除的key
+//
+func DeletePrefixFromAWS(session *session.Session, bucket, prefix string) ([]string, error) {
+	s3Client := s3.New(session)
+
+	var deleted []string
+	var deleteErr error
+	err := s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		if len(page.Contents) == 0 {
+			return true
+		}
+		// 每一页最多1000个对象, 和DeleteObjects的上限一致
+		objects := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
+		for _, object := range page.Contents {
+			objects = append(objects, &s3.ObjectIdentifier{Key: object.Key})
+		}
+		result, err := s3Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(false)},
+		})
+		if err != nil {
+			deleteErr = err
+			return false
+		}
+		for _, object := range result.Deleted {
+			deleted = append(deleted, aws.StringValue(object.Key))
+		}
+		if len(result.Errors) > 0 {
+			deleteErr = fmt.Errorf("delete %s: %s", aws.StringValue(result.Errors[0].Key), aws.StringValue(result.Errors[0].Message))
+			return false
+		}
+		return true
+	})
+	if err == nil {
+		err = deleteErr
+	}
+	return deleted, err
 }
@@ -64,7 +64,8 @@ func SimpleVerify(path, ts string, token string, checkExpire bool) bool {
 	}
 
 	// 1. 解码过期时间
-	expireTime := binary.BigEndian.Uint32(tokenBytes[len(tokenBytes)-4:]) ^ uint32(config.MagicNum)
+	_, magicNum := config.SignKeys()
+	expireTime := binary.BigEndian.Uint32(tokenBytes[len(tokenBytes)-4:]) ^ uint32(magicNum)
 	// fmt.Printf("ExpireTimeVerify: %d\n", expireTime)
 	// 比较过期
 	if checkExpire && (time.Now().Unix() > int64(expireTime)) {
@@ -82,7 +83,8 @@ func SimpleVerify(path, ts string, token string, checkExpire bool) bool {
 
 func SimpleToken(path, ts, oe string) []byte {
 	// fmt.Printf("path: %s, ts: %s, oe: %s\n", path, ts, oe)
-	mac := hmac.New(sha256.New, config.SimpleKey)
+	key, _ := config.SignKeys()
+	mac := hmac.New(sha256.New, key)
 	mac.Write([]byte(path))
 	if len(ts) > 0 {
 		mac.Write([]byte("?ts=" + ts))
@@ -104,7 +106,8 @@ func SimpleSignUrl(path, ts string, relativeExpire int64) string {
 
 func SimpleTimeToStr(time int64) (string, []byte) {
 	expires := make([]byte, 4)
-	binary.BigEndian.PutUint32(expires, uint32(time^config.MagicNum))
+	_, magicNum := config.SignKeys()
+	binary.BigEndian.PutUint32(expires, uint32(time^magicNum))
 	return base64.RawURLEncoding.EncodeToString(expires), expires
 }
 